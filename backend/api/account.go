@@ -0,0 +1,717 @@
+package api
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"swapper/auth"
+	"swapper/imaging"
+	"swapper/middleware"
+	"swapper/models"
+	"swapper/realtime"
+	"swapper/storage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// what a DeletionPolicy does with a kind of data
+const (
+	DeletionAnonymize = "anonymize"
+	DeletionDelete    = "delete"
+)
+
+const deletePageSize = 256
+
+// how recent the login of an account without a password or 2FA has to be to delete it
+const recentLoginWindow = 5 * time.Minute
+
+/*
+what happens to the parts of a deleted account other users see. Items, images, sessions, linked
+logins, blocks and the like are always deleted
+*/
+type DeletionPolicy struct {
+	Profile  string // anonymize keeps a nameless user so conversations and ratings still find one, delete removes it
+	Messages string // anonymize leaves the messages they sent in other users' conversations, delete unsends them
+	Ratings  string // anonymize keeps the ratings they wrote without their name, delete removes them
+}
+
+/*
+LoadDeletionPolicy reads the policy from ACCOUNT_DELETION_PROFILE, ACCOUNT_DELETION_MESSAGES and
+ACCOUNT_DELETION_RATINGS, each "anonymize" (default) or "delete"
+*/
+func LoadDeletionPolicy() (DeletionPolicy, error) {
+	policy := DeletionPolicy{}
+	for _, setting := range []struct {
+		name  string
+		value *string
+	}{
+		{"ACCOUNT_DELETION_PROFILE", &policy.Profile},
+		{"ACCOUNT_DELETION_MESSAGES", &policy.Messages},
+		{"ACCOUNT_DELETION_RATINGS", &policy.Ratings},
+	} {
+		*setting.value = os.Getenv(setting.name)
+		if *setting.value == "" {
+			*setting.value = DeletionAnonymize
+		}
+		if *setting.value != DeletionAnonymize && *setting.value != DeletionDelete {
+			return policy, fmt.Errorf("%s must be %s or %s, not %q", setting.name, DeletionAnonymize, DeletionDelete, *setting.value)
+		}
+	}
+	return policy, nil
+}
+
+type AccountHandler struct {
+	Store    *ravendb.DocumentStore
+	Blobs    storage.BlobStore
+	Sessions *auth.Sessions
+	Hub      realtime.Hub
+	Policy   DeletionPolicy
+}
+
+func NewAccountHandler(store *ravendb.DocumentStore, blobs storage.BlobStore, sessions *auth.Sessions, hub realtime.Hub, policy DeletionPolicy) *AccountHandler {
+	return &AccountHandler{
+		Store:    store,
+		Blobs:    blobs,
+		Sessions: sessions,
+		Hub:      hub,
+		Policy:   policy,
+	}
+}
+
+func (h *AccountHandler) RegisterAccountRoutes(r *gin.Engine) {
+	r.DELETE("/user", middleware.AuthMiddleware(), h.DeleteAccount)
+	r.GET("/user/export", middleware.AuthMiddleware(), h.ExportAccount)
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"` // required unless the account only logs in with a provider, which takes a login of the last minutes
+	Code     string `json:"code"`     // required when 2FA is on, from the authenticator app or a recovery code
+}
+
+// everything a user has, as the export writes it
+type accountData struct {
+	User            *models.User
+	Items           []*models.Item
+	RatingsWritten  []*models.Rating
+	RatingsReceived []*models.Rating // about the user or one of their items
+	Messages        []*models.Message
+	Conversations   []*models.Conversation
+	Swaps           []*models.SwapProposal
+	Bookings        []*models.Booking
+	Blocks          []*models.Block
+	Sessions        []*models.Session
+	Identities      []*models.Identity
+	APIKeys         []*models.APIKey
+	LoginFailures   []*models.LoginFailure
+	Moderation      []*models.ModerationAction
+}
+
+var errAccountBusy = errors.New("account has an accepted swap or an active rental")
+
+/*
+deletes the current user's account following the policy. Accepted swaps and rentals that are
+under way have to be finished or cancelled first, open ones are cancelled. Each step can run
+again, a deletion that failed halfway is finished by calling this again
+*/
+func (h *AccountHandler) DeleteAccount(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var deleteReq DeleteAccountRequest
+	if err := c.ShouldBindJSON(&deleteReq); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var u *models.User
+	if err := session.Load(&u, userID.(string)); err != nil || u == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	// a stolen access token alone can't delete the account
+	if u.PasswordHash != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(deleteReq.Password)); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+			return
+		}
+	}
+	if u.TwoFactorEnabled {
+		twoFactor, ok := loadEnabledTwoFactor(c, session, u.ID)
+		if !ok {
+			return // error is already added to gin context
+		}
+		if !useTwoFactorCode(c, session, twoFactor, deleteReq.Code) {
+			return // error is already added to gin context
+		}
+	}
+	// with neither, the login at the provider has to be fresh instead
+	if u.PasswordHash == "" && !u.TwoFactorEnabled && !checkRecentLogin(c, session) {
+		return // error is already added to gin context
+	}
+
+	err = h.deleteAccount(c.Request.Context(), u)
+	if errors.Is(err, errAccountBusy) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Finish or cancel your accepted swaps and active rentals first"})
+		return
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// accepts the request if the current session was logged in within recentLoginWindow
+func checkRecentLogin(c *gin.Context, session *ravendb.DocumentSession) bool {
+	var loginSession *models.Session
+	if err := session.Load(&loginSession, c.GetString("sessionID")); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load session"})
+		return false
+	}
+	if loginSession == nil || time.Since(loginSession.CreatedAt) > recentLoginWindow {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Log in again to delete your account", "loginRequired": true})
+		return false
+	}
+	return true
+}
+
+/*
+responds with a zip of everything stored about the current user: a JSON file per kind of
+document and the original size of their images under images/<document id>/
+*/
+func (h *AccountHandler) ExportAccount(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	data, err := h.loadAccountData(userID.(string))
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load account data"})
+		return
+	}
+	if data.User == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="swapper-export.zip"`)
+	c.Status(http.StatusOK)
+
+	// the status is sent, an error from here on can only cut the zip short
+	if err := h.writeExport(c.Request.Context(), c.Writer, data); err != nil {
+		fmt.Println(err.Error())
+		c.Abort()
+	}
+}
+
+/*
+  Helpers
+*/
+
+func (h *AccountHandler) deleteAccount(ctx context.Context, u *models.User) error {
+	userID := u.ID
+
+	if err := cancelAccountDeals(h.Store, userID); err != nil {
+		return err
+	}
+	if err := h.deleteItems(ctx, userID); err != nil {
+		return err
+	}
+	if err := deleteRatings(h.Store, userID, h.Policy.Ratings); err != nil {
+		return err
+	}
+	if h.Policy.Messages == DeletionDelete {
+		if err := h.unsendMessages(ctx, userID); err != nil {
+			return err
+		}
+	}
+	if err := leaveGroups(h.Store, userID); err != nil {
+		return err
+	}
+
+	err := deleteQueried(h.Store, func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery {
+		return q.WhereEquals("blockerID", userID).OrElse().WhereEquals("blockedID", userID)
+	}, func(*models.Block) error { return nil })
+	if err != nil {
+		return err
+	}
+	byUser := func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery {
+		return q.WhereEquals("userID", userID)
+	}
+	if err := deleteQueried(h.Store, byUser, func(*models.Identity) error { return nil }); err != nil {
+		return err
+	}
+	if err := deleteQueried(h.Store, byUser, func(*models.UserToken) error { return nil }); err != nil {
+		return err
+	}
+	if err := deleteQueried(h.Store, byUser, func(*models.APIKey) error { return nil }); err != nil {
+		return err
+	}
+
+	// the audit logs can't keep the email, address and browser of someone who left, nor what
+	// moderators wrote about them
+	if err := deleteQueried(h.Store, loginFailuresOf(u), func(*models.LoginFailure) error { return nil }); err != nil {
+		return err
+	}
+	err = deleteQueried(h.Store, func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery {
+		return q.WhereEquals("targetID", userID)
+	}, func(*models.ModerationAction) error { return nil })
+	if err != nil {
+		return err
+	}
+
+	if err := storage.DeleteAll(ctx, h.Blobs, userID); err != nil {
+		return err
+	}
+
+	if err := deleteProfile(h.Store, u, h.Policy.Profile); err != nil {
+		return err
+	}
+
+	// last, until here the user can still retry with the same token
+	return deleteQueried(h.Store, byUser, func(*models.Session) error { return nil })
+}
+
+// cancels the user's open swaps and rentals, failing with errAccountBusy if one is under way
+func cancelAccountDeals(store *ravendb.DocumentStore, userID string) error {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var proposals []*models.SwapProposal
+	q := session.QueryCollection("SwapProposals")
+	q = q.OpenSubclause().WhereEquals("proposerID", userID).OrElse().WhereEquals("ownerID", userID).CloseSubclause()
+	q = q.WhereIn("status", []interface{}{models.SwapStatusProposed, models.SwapStatusCountered, models.SwapStatusAccepted})
+	if err := q.GetResults(&proposals); err != nil {
+		return err
+	}
+	for _, proposal := range proposals {
+		if proposal.Status == models.SwapStatusAccepted {
+			return errAccountBusy
+		}
+	}
+
+	var bookings []*models.Booking
+	q = session.QueryCollection("Bookings")
+	q = q.OpenSubclause().WhereEquals("ownerID", userID).OrElse().WhereEquals("renterID", userID).CloseSubclause()
+	q = q.WhereIn("status", []interface{}{models.BookingStatusRequested, models.BookingStatusApproved, models.BookingStatusActive})
+	if err := q.GetResults(&bookings); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, booking := range bookings {
+		if booking.Status == models.BookingStatusActive {
+			return errAccountBusy
+		}
+		booking.Status = models.BookingStatusCancelled
+		booking.UpdatedAt = now
+		if err := session.Store(booking); err != nil {
+			return err
+		}
+	}
+
+	if err := cancelSwaps(session, proposals); err != nil {
+		return err
+	}
+	return session.SaveChanges()
+}
+
+// deletes the user's items with their images and ratings
+func (h *AccountHandler) deleteItems(ctx context.Context, userID string) error {
+	return deleteQueried(h.Store, func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery {
+		return q.WhereEquals("userId", userID)
+	}, func(item *models.Item) error {
+		err := deleteQueried(h.Store, func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery {
+			return q.WhereEquals("recipientID", item.ID).AndAlso().WhereEquals("recipientIsItem", true)
+		}, func(*models.Rating) error { return nil })
+		if err != nil {
+			return err
+		}
+		return storage.DeleteAll(ctx, h.Blobs, item.ID)
+	})
+}
+
+// deletes the ratings about the user, and the ones they wrote or only their name on them
+func deleteRatings(store *ravendb.DocumentStore, userID string, policy string) error {
+	err := deleteQueried(store, func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery {
+		return q.WhereEquals("recipientID", userID)
+	}, func(*models.Rating) error { return nil })
+	if err != nil {
+		return err
+	}
+
+	if policy == DeletionDelete {
+		return deleteQueried(store, func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery {
+			return q.WhereEquals("creatorID", userID)
+		}, func(*models.Rating) error { return nil })
+	}
+
+	session, err := store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var ratings []*models.Rating
+	q := session.QueryCollection("Ratings")
+	q = q.WaitForNonStaleResults(0).WhereEquals("creatorID", userID)
+	if err := q.GetResults(&ratings); err != nil {
+		return err
+	}
+	for _, rating := range ratings {
+		rating.CreatorID = ""
+		if err := session.Store(rating); err != nil {
+			return err
+		}
+	}
+	return session.SaveChanges()
+}
+
+// unsends every message the user sent, like DeleteMessage with the everyone scope
+func (h *AccountHandler) unsendMessages(ctx context.Context, userID string) error {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var messages []*models.Message
+	q := session.QueryCollection("Messages")
+	q = q.WaitForNonStaleResults(0).WhereEquals("senderID", userID).Not().WhereExists("deletedAt")
+	if err := q.GetResults(&messages); err != nil {
+		return err
+	}
+
+	for _, sent := range messages {
+		var images []string
+		message, conversation, err := updateMessage(h.Store, sent.ID, func(message *models.Message, conversation *models.Conversation) error {
+			if message.DeletedAt != nil {
+				return errMessageDeleted
+			}
+			for _, participant := range conversation.ParticipantIDs {
+				if !message.IsHiddenFor(participant) {
+					conversation.RemoveUnread(participant, message)
+				}
+			}
+			images = message.Images
+			message.Unsend(time.Now())
+			return nil
+		})
+		if errors.Is(err, errMessageDeleted) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(images) > 0 {
+			if err := storage.DeleteAll(ctx, h.Blobs, message.ID); err != nil {
+				return err
+			}
+		}
+		h.Hub.Publish(realtime.Event{
+			Type: realtime.EventDeleted,
+			Data: DeletedEvent{MessageID: message.ID, ConversationID: message.ConversationID, Scope: DeleteScopeEveryone},
+		}, conversation.ParticipantIDs...)
+	}
+	return nil
+}
+
+// removes the user from every group they are in, conversations between two users are left to the other one
+func leaveGroups(store *ravendb.DocumentStore, userID string) error {
+	for attempt := 1; ; attempt++ {
+		err := tryLeaveGroups(store, userID)
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) && attempt < maxMessageSaveAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+func tryLeaveGroups(store *ravendb.DocumentStore, userID string) error {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var conversations []*models.Conversation
+	q := session.QueryCollection("Conversations")
+	q = q.WaitForNonStaleResults(0).WhereEquals("participantIDs", userID).WhereEquals("group", true)
+	if err := q.GetResults(&conversations); err != nil {
+		return err
+	}
+
+	for _, conversation := range conversations {
+		changeVector, err := session.Advanced().GetChangeVectorFor(conversation)
+		if err != nil || changeVector == nil {
+			return fmt.Errorf("no change vector for %s: %v", conversation.ID, err)
+		}
+		conversation.RemoveParticipant(userID)
+		if err := session.StoreWithChangeVectorAndID(conversation, *changeVector, conversation.ID); err != nil {
+			return err
+		}
+	}
+	return session.SaveChanges()
+}
+
+// anonymizes or deletes the user document and the documents kept by its id
+func deleteProfile(store *ravendb.DocumentStore, u *models.User, policy string) error {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	// the counters only mattered while the email was in use
+	ids := []string{models.TwoFactorID(u.ID), models.LoginAttemptsForEmail(u.Email), models.PasswordResetAttemptsForEmail(u.Email)}
+	for _, id := range ids {
+		if err := session.DeleteByID(id, ""); err != nil {
+			return err
+		}
+	}
+
+	if policy == DeletionDelete {
+		if err := session.DeleteByID(u.ID, ""); err != nil {
+			return err
+		}
+		return session.SaveChanges()
+	}
+
+	var stored *models.User
+	if err := session.Load(&stored, u.ID); err != nil {
+		return err
+	}
+	if stored != nil {
+		stored.Anonymize(time.Now())
+		if err := session.Store(stored); err != nil {
+			return err
+		}
+	}
+	return session.SaveChanges()
+}
+
+// the failed logins on the user's email and those on an earlier email of the user
+func loginFailuresOf(u *models.User) func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery {
+	return func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery {
+		return q.WhereEquals("email", u.Email).OrElse().WhereEquals("userID", u.ID)
+	}
+}
+
+/*
+deletes every document of T the query finds, calling each with it first. A page is deleted per
+session, so a large account stays under the requests a session may make
+*/
+func deleteQueried[T any](store *ravendb.DocumentStore, where func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery, each func(doc *T) error) error {
+	for {
+		deleted, err := deleteQueriedPage(store, where, each)
+		if err != nil || deleted < deletePageSize {
+			return err
+		}
+	}
+}
+
+func deleteQueriedPage[T any](store *ravendb.DocumentStore, where func(q *ravendb.DocumentQuery) *ravendb.DocumentQuery, each func(doc *T) error) (int, error) {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	var docs []*T
+	q := session.QueryCollectionForType(reflect.TypeOf(new(T)))
+	// the previous page has to be gone from the index before asking for the next one
+	q = where(q.WaitForNonStaleResults(0)).Take(deletePageSize)
+	if err := q.GetResults(&docs); err != nil {
+		return 0, err
+	}
+
+	for _, doc := range docs {
+		if err := each(doc); err != nil {
+			return 0, err
+		}
+		if err := session.Delete(doc); err != nil {
+			return 0, err
+		}
+	}
+	return len(docs), session.SaveChanges()
+}
+
+func (h *AccountHandler) loadAccountData(userID string) (*accountData, error) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	data := &accountData{}
+	if err := session.Load(&data.User, userID); err != nil || data.User == nil {
+		return data, err
+	}
+
+	queries := []struct {
+		results interface{}
+		query   *ravendb.DocumentQuery
+	}{
+		{&data.Items, session.QueryCollection("Items").WhereEquals("userId", userID)},
+		{&data.RatingsWritten, session.QueryCollection("Ratings").WhereEquals("creatorID", userID)},
+		{&data.Swaps, session.QueryCollection("SwapProposals").WhereEquals("proposerID", userID).OrElse().WhereEquals("ownerID", userID)},
+		{&data.Bookings, session.QueryCollection("Bookings").WhereEquals("ownerID", userID).OrElse().WhereEquals("renterID", userID)},
+		{&data.Blocks, session.QueryCollection("Blocks").WhereEquals("blockerID", userID)},
+		{&data.Conversations, session.QueryCollection("Conversations").WhereEquals("participantIDs", userID)},
+		{&data.Sessions, session.QueryCollectionForType(reflect.TypeOf(&models.Session{})).WhereEquals("userID", userID)},
+		{&data.Identities, session.QueryCollectionForType(reflect.TypeOf(&models.Identity{})).WhereEquals("userID", userID)},
+		{&data.APIKeys, session.QueryCollectionForType(reflect.TypeOf(&models.APIKey{})).WhereEquals("userID", userID)},
+		{&data.LoginFailures, loginFailuresOf(data.User)(session.QueryCollectionForType(reflect.TypeOf(&models.LoginFailure{})))},
+		{&data.Moderation, session.QueryCollectionForType(reflect.TypeOf(&models.ModerationAction{})).WhereEquals("targetID", userID)},
+	}
+	for _, query := range queries {
+		if err := query.query.GetResults(query.results); err != nil {
+			return nil, err
+		}
+	}
+
+	recipientIDs := []interface{}{userID}
+	for _, item := range data.Items {
+		recipientIDs = append(recipientIDs, item.ID)
+	}
+	q := session.QueryCollection("Ratings").WhereIn("recipientID", recipientIDs)
+	if err := q.GetResults(&data.RatingsReceived); err != nil {
+		return nil, err
+	}
+
+	// what was sent to the user directly and to their groups, and what they sent
+	groupIDs := []interface{}{}
+	for _, conversation := range data.Conversations {
+		if conversation.Group {
+			groupIDs = append(groupIDs, conversation.ID)
+		}
+	}
+	q = session.QueryCollection("Messages").WhereEquals("senderID", userID).OrElse().WhereEquals("recipientID", userID)
+	if len(groupIDs) > 0 {
+		q = q.OrElse().WhereIn("conversationID", groupIDs)
+	}
+	if err := q.GetResults(&data.Messages); err != nil {
+		return nil, err
+	}
+
+	// secrets are no one's personal data, and would hand out the account
+	data.User.PasswordHash = ""
+	for _, userSession := range data.Sessions {
+		userSession.TokenHash = ""
+		userSession.PreviousTokenHash = ""
+	}
+	return data, nil
+}
+
+func (h *AccountHandler) writeExport(ctx context.Context, w io.Writer, data *accountData) error {
+	archive := zip.NewWriter(w)
+
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"user.json", data.User},
+		{"items.json", data.Items},
+		{"ratings.json", gin.H{"written": data.RatingsWritten, "received": data.RatingsReceived}},
+		{"messages.json", data.Messages},
+		{"conversations.json", data.Conversations},
+		{"swaps.json", data.Swaps},
+		{"bookings.json", data.Bookings},
+		{"blocks.json", data.Blocks},
+		{"sessions.json", data.Sessions},
+		{"identities.json", data.Identities},
+		{"api_keys.json", data.APIKeys},
+		{"login_failures.json", data.LoginFailures},
+		{"moderation.json", data.Moderation},
+	}
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.content); err != nil {
+			return err
+		}
+	}
+
+	// their avatar, their items' images and the photos they sent
+	docIDs := []string{data.User.ID}
+	for _, item := range data.Items {
+		docIDs = append(docIDs, item.ID)
+	}
+	for _, message := range data.Messages {
+		if message.SenderID == data.User.ID && len(message.Images) > 0 {
+			docIDs = append(docIDs, message.ID)
+		}
+	}
+	for _, docID := range docIDs {
+		if err := exportImages(ctx, archive, h.Blobs, docID); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// copies the images of a document into the zip, the resized copies are left out
+func exportImages(ctx context.Context, archive *zip.Writer, blobs storage.BlobStore, docID string) error {
+	infos, err := blobs.List(ctx, docID)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if imaging.IsVariantName(info.Name) {
+			continue
+		}
+
+		blob, err := blobs.Get(ctx, docID, info.Name)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue // deleted since it was listed
+		}
+		if err != nil {
+			return err
+		}
+		f, err := archive.Create("images/" + docID + "/" + info.Name)
+		if err == nil {
+			_, err = io.Copy(f, blob.Data)
+		}
+		blob.Data.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
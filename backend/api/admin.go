@@ -0,0 +1,431 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"swapper/auth"
+	"swapper/middleware"
+	"swapper/models"
+	"swapper/storage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+)
+
+const (
+	defaultAdminListLimit = 50
+	maxAdminListLimit     = 200
+)
+
+type AdminHandler struct {
+	Store    *ravendb.DocumentStore
+	Blobs    storage.BlobStore
+	Sessions *auth.Sessions
+}
+
+func NewAdminHandler(store *ravendb.DocumentStore, blobs storage.BlobStore, sessions *auth.Sessions) *AdminHandler {
+	return &AdminHandler{
+		Store:    store,
+		Blobs:    blobs,
+		Sessions: sessions,
+	}
+}
+
+func (h *AdminHandler) RegisterAdminRoutes(r *gin.Engine) {
+	admin := r.Group("/admin")
+	admin.Use(middleware.AuthMiddleware(), middleware.RequireRole(models.RoleModerator))
+	{
+		admin.GET("/users", h.GetUsers)
+		admin.POST("/users/:id/suspend", h.SuspendUser)
+		admin.DELETE("/users/:id/suspend", h.UnsuspendUser)
+		admin.DELETE("/items/:id", h.RemoveItem)
+		admin.DELETE("/ratings/:id", h.RemoveRating)
+
+		admin.PUT("/users/:id/role", middleware.RequireRole(models.RoleAdmin), h.SetUserRole)
+		admin.GET("/actions", middleware.RequireRole(models.RoleAdmin), h.GetModerationActions)
+	}
+}
+
+type ModerationRequest struct {
+	Reason string `json:"reason"`
+}
+
+type SetRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+/*
+lists users, filtered by the role, suspended (true or false), email and username url params. The
+username matches from its start, the email exactly. Paginated with skip and limit
+*/
+func (h *AdminHandler) GetUsers(c *gin.Context) {
+	limit, ok := parseLimit(c, defaultAdminListLimit, maxAdminListLimit)
+	if !ok {
+		return // error is already added to gin context
+	}
+	skip, err := strconv.Atoi(c.DefaultQuery("skip", "0"))
+	if err != nil || skip < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	q := session.QueryCollectionForType(reflect.TypeOf(&models.User{}))
+	if role := c.Query("role"); role != "" {
+		if !models.IsRole(role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			return
+		}
+		// plain users mostly have no role stored at all
+		if role == models.RoleUser {
+			q = q.Not().WhereIn("role", []interface{}{models.RoleModerator, models.RoleAdmin})
+		} else {
+			q = q.WhereEquals("role", role)
+		}
+	}
+	switch c.Query("suspended") {
+	case "":
+	case "true":
+		q = q.WhereExists("suspendedAt")
+	case "false":
+		q = q.Not().WhereExists("suspendedAt")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid suspended"})
+		return
+	}
+	if email := c.Query("email"); email != "" {
+		q = q.WhereEquals("email", email)
+	}
+	if username := c.Query("username"); username != "" {
+		q = q.WhereStartsWith("username", username)
+	}
+	q = q.OrderBy("username").Skip(skip).Take(limit)
+
+	var users []*models.User
+	if err := q.GetResults(&users); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query users"})
+		return
+	}
+	for _, u := range users {
+		u.PasswordHash = ""
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+// keeps a user from logging in and logs them out of every device
+func (h *AdminHandler) SuspendUser(c *gin.Context) {
+	moderationReq, ok := bindModerationRequest(c)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	u, ok := loadModeratedUser(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	now := time.Now()
+	u.SuspendedAt = &now
+	u.SuspendedReason = moderationReq.Reason
+	if err := session.Store(u); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store user"})
+		return
+	}
+	if !saveModeration(c, session, models.ModerationSuspendUser, u.ID, moderationReq.Reason, "") {
+		return // error is already added to gin context
+	}
+
+	if err := h.Sessions.RevokeAll(u.ID); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out sessions"})
+		return
+	}
+
+	u.PasswordHash = ""
+	c.JSON(http.StatusOK, gin.H{"user": u})
+}
+
+// lets a suspended user log in again
+func (h *AdminHandler) UnsuspendUser(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	u, ok := loadModeratedUser(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	u.SuspendedAt = nil
+	u.SuspendedReason = ""
+	if err := session.Store(u); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store user"})
+		return
+	}
+	if !saveModeration(c, session, models.ModerationUnsuspendUser, u.ID, "", "") {
+		return // error is already added to gin context
+	}
+
+	u.PasswordHash = ""
+	c.JSON(http.StatusOK, gin.H{"user": u})
+}
+
+/*
+gives a user another role, admins only. Tokens carry the role, so a user losing one is logged
+out everywhere and one gaining one gets it with their next refresh
+*/
+func (h *AdminHandler) SetUserRole(c *gin.Context) {
+	var roleReq SetRoleRequest
+	if err := c.ShouldBindJSON(&roleReq); err != nil || !models.IsRole(roleReq.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	u, ok := loadModeratedUser(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	demoted := !models.RoleAtLeast(roleReq.Role, u.Role)
+	u.Role = roleReq.Role
+	if u.Role == models.RoleUser {
+		u.Role = ""
+	}
+	if err := session.Store(u); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store user"})
+		return
+	}
+	if !saveModeration(c, session, models.ModerationSetRole, u.ID, "", roleReq.Role) {
+		return // error is already added to gin context
+	}
+
+	if demoted {
+		if err := h.Sessions.RevokeAll(u.ID); err != nil {
+			fmt.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out sessions"})
+			return
+		}
+	}
+
+	u.PasswordHash = ""
+	c.JSON(http.StatusOK, gin.H{"user": u})
+}
+
+/*
+deletes an item whatever its status. Swaps still going on for it are cancelled and the other
+items of an accepted one are released, like CancelSwap does
+*/
+func (h *AdminHandler) RemoveItem(c *gin.Context) {
+	id := "items/" + c.Param("id")
+
+	moderationReq, ok := bindModerationRequest(c)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var item *models.Item
+	if err := session.Load(&item, id); err != nil || item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	cancelledBookings, err := cancelItemBookings(session, id)
+	if errors.Is(err, errItemRentedOut) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Item is out on rent, it has to be returned first"})
+		return
+	} else if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel bookings"})
+		return
+	}
+
+	cancelled, err := cancelItemSwaps(session, id)
+	if err != nil {
+		respondSwapItemError(c, err)
+		return
+	}
+
+	if err := session.Delete(item); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
+		return
+	}
+	if !saveModeration(c, session, models.ModerationRemoveItem, id, moderationReq.Reason, "") {
+		return // error is already added to gin context
+	}
+
+	// the item is gone either way, images left behind only take up space
+	if err := storage.DeleteAll(c.Request.Context(), h.Blobs, id); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Item removed", "cancelledSwaps": cancelled, "cancelledBookings": cancelledBookings})
+}
+
+// deletes anyone's rating
+func (h *AdminHandler) RemoveRating(c *gin.Context) {
+	id := "ratings/" + c.Param("id")
+
+	moderationReq, ok := bindModerationRequest(c)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var rating *models.Rating
+	if err := session.Load(&rating, id); err != nil || rating == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rating not found"})
+		return
+	}
+
+	if err := session.Delete(rating); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete rating"})
+		return
+	}
+	if !saveModeration(c, session, models.ModerationRemoveRating, id, moderationReq.Reason, "") {
+		return // error is already added to gin context
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Rating removed"})
+}
+
+// lists what was done through the admin API, newest first, optionally about one targetID
+func (h *AdminHandler) GetModerationActions(c *gin.Context) {
+	limit, ok := parseLimit(c, defaultAdminListLimit, maxAdminListLimit)
+	if !ok {
+		return // error is already added to gin context
+	}
+	skip, err := strconv.Atoi(c.DefaultQuery("skip", "0"))
+	if err != nil || skip < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	q := session.QueryCollectionForType(reflect.TypeOf(&models.ModerationAction{}))
+	if targetID := c.Query("targetID"); targetID != "" {
+		q = q.WhereEquals("targetID", targetID)
+	}
+	q = q.OrderByDescending("createdAt").Skip(skip).Take(limit)
+
+	var actions []*models.ModerationAction
+	if err := q.GetResults(&actions); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query actions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"actions": actions})
+}
+
+/*
+  Helpers
+*/
+
+// the reason is optional, so is the body
+func bindModerationRequest(c *gin.Context) (ModerationRequest, bool) {
+	var moderationReq ModerationRequest
+	if err := c.ShouldBindJSON(&moderationReq); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return moderationReq, false
+	}
+	return moderationReq, true
+}
+
+/*
+loads the user from the id url param. Moderators can only act on users whose role is below their
+own, so they can't suspend each other or an admin
+*/
+func loadModeratedUser(c *gin.Context, session *ravendb.DocumentSession) (*models.User, bool) {
+	var u *models.User
+	if err := session.Load(&u, "users/"+c.Param("id")); err != nil || u == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+
+	if u.ID == c.GetString("userID") || models.RoleAtLeast(u.Role, c.GetString("role")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't moderate this user"})
+		return nil, false
+	}
+	return u, true
+}
+
+// saves the session together with an audit record of what the current user did
+func saveModeration(c *gin.Context, session *ravendb.DocumentSession, action string, targetID string, reason string, detail string) bool {
+	record := &models.ModerationAction{
+		ModeratorID: c.GetString("userID"),
+		Action:      action,
+		TargetID:    targetID,
+		Reason:      reason,
+		Detail:      detail,
+		CreatedAt:   time.Now(),
+	}
+	if err := session.Store(record); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store moderation action"})
+		return false
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Items were modified, please retry"})
+			return false
+		}
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return false
+	}
+	return true
+}
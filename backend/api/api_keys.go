@@ -0,0 +1,140 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"swapper/auth"
+	"swapper/middleware"
+	"swapper/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxAPIKeysPerUser = 20
+
+type APIKeyHandler struct {
+	APIKeys *auth.APIKeys
+}
+
+func NewAPIKeyHandler(apiKeys *auth.APIKeys) *APIKeyHandler {
+	return &APIKeyHandler{
+		APIKeys: apiKeys,
+	}
+}
+
+// managing keys takes an access token, a key can't make or revoke keys
+func (h *APIKeyHandler) RegisterAPIKeyRoutes(r *gin.Engine) {
+	group := r.Group("/user/api-keys")
+	group.Use(middleware.AuthMiddleware())
+	{
+		group.GET("", h.GetAPIKeys)
+		group.POST("", h.CreateAPIKey)
+		group.DELETE("/:id", h.RevokeAPIKey)
+	}
+}
+
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name" binding:"required,max=100"`
+	Scopes        []string `json:"scopes" binding:"required,min=1"`
+	ExpiresInDays int      `json:"expiresInDays" binding:"min=0"` // 0 for a key that doesn't expire
+}
+
+// lists the current user's keys with when they were last used, revoked ones included
+func (h *APIKeyHandler) GetAPIKeys(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	keys, err := h.APIKeys.List(userID.(string))
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"apiKeys": keys, "scopes": models.Scopes})
+}
+
+// makes a key with the scopes, responding with the key itself this one time
+func (h *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var createReq CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&createReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+	var scopes []string
+	for _, scope := range createReq.Scopes {
+		if !models.IsScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope " + scope, "scopes": models.Scopes})
+			return
+		}
+		if !containsString(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	keys, err := h.APIKeys.List(userID.(string))
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query API keys"})
+		return
+	}
+	active := 0
+	for _, key := range keys {
+		if key.IsActive(time.Now()) {
+			active++
+		}
+	}
+	if active >= maxAPIKeysPerUser {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("You can have at most %d API keys, revoke one first", maxAPIKeysPerUser)})
+		return
+	}
+
+	var expiresAt *time.Time
+	if createReq.ExpiresInDays > 0 {
+		at := time.Now().AddDate(0, 0, createReq.ExpiresInDays)
+		expiresAt = &at
+	}
+
+	apiKey, key, err := h.APIKeys.Create(userID.(string), createReq.Name, scopes, expiresAt)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	// shown once, only its hash is kept
+	c.JSON(http.StatusCreated, gin.H{"apiKey": apiKey, "key": key})
+}
+
+// stops one of the current user's keys from working
+func (h *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	apiKey, err := h.APIKeys.Revoke(userID.(string), "apikeys/"+c.Param("id"))
+	if errors.Is(err, auth.ErrAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"apiKey": apiKey})
+}
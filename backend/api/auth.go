@@ -0,0 +1,176 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"swapper/auth"
+	"swapper/mail"
+	"swapper/middleware"
+	"swapper/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+)
+
+type AuthHandler struct {
+	Store    *ravendb.DocumentStore
+	Sessions *auth.Sessions
+	Tokens   *auth.TokenService
+	Mailer   mail.Mailer
+	// counts the reset links asked for, see auth.NewPasswordResetThrottle
+	ResetThrottle *auth.LoginThrottle
+}
+
+func NewAuthHandler(store *ravendb.DocumentStore, sessions *auth.Sessions, tokens *auth.TokenService, mailer mail.Mailer, resetThrottle *auth.LoginThrottle) *AuthHandler {
+	return &AuthHandler{
+		Store:         store,
+		Sessions:      sessions,
+		Tokens:        tokens,
+		Mailer:        mailer,
+		ResetThrottle: resetThrottle,
+	}
+}
+
+func (h *AuthHandler) RegisterAuthRoutes(r *gin.Engine) {
+	r.POST("/auth/refresh", h.RefreshToken)
+	r.POST("/logout", middleware.AuthMiddleware(), h.Logout)
+	r.POST("/logout/all", middleware.AuthMiddleware(), h.LogoutAll)
+	r.GET("/.well-known/jwks.json", h.GetJWKS)
+	r.POST("/email/verify", h.VerifyEmail)
+	r.POST("/email/verify/resend", middleware.AuthMiddleware(), h.ResendVerificationEmail)
+	r.POST("/password/forgot", h.ForgotPassword)
+	r.POST("/password/reset", h.ResetPassword)
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+// trades a refresh token for a new access token and the refresh token to use next time
+func (h *AuthHandler) RefreshToken(c *gin.Context) {
+	var refreshReq RefreshTokenRequest
+	if err := c.ShouldBindJSON(&refreshReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	userSession, refreshToken, err := h.Sessions.Refresh(refreshReq.RefreshToken)
+	if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRefreshTokenReused) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var user *models.User
+	if err := session.Load(&user, userSession.UserID); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	// suspending revokes the sessions too, this covers a refresh racing with it
+	if user.IsSuspended() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is suspended"})
+		return
+	}
+
+	tokens, err := h.Tokens.NewTokenPair(user, userSession, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// returns the public keys tokens are signed with, for other services to verify them
+func (h *AuthHandler) GetJWKS(c *gin.Context) {
+	// rotated keys show up within the hour
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, h.Tokens.JWKS())
+}
+
+// logs out the device the request comes from
+func (h *AuthHandler) Logout(c *gin.Context) {
+	sessionID, exists := c.Get("sessionID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := h.Sessions.Revoke(sessionID.(string)); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// logs the current user out of every device, including this one
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := h.Sessions.RevokeAll(userID.(string)); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+/*
+  Helpers
+*/
+
+// starts a session for the user and responds with its tokens
+func respondNewSession(c *gin.Context, sessions *auth.Sessions, tokens *auth.TokenService, user *models.User) {
+	pair, ok := newSessionTokens(c, sessions, tokens, user)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	c.JSON(http.StatusOK, pair)
+}
+
+// starts a session for the user and returns its tokens
+func newSessionTokens(c *gin.Context, sessions *auth.Sessions, tokens *auth.TokenService, user *models.User) (*auth.TokenPair, bool) {
+	if user.IsSuspended() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is suspended"})
+		return nil, false
+	}
+
+	userSession, refreshToken, err := sessions.Create(user.ID, c.Request.UserAgent())
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return nil, false
+	}
+
+	pair, err := tokens.NewTokenPair(user, userSession, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return nil, false
+	}
+	return pair, true
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"swapper/middleware"
+	"swapper/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+)
+
+type BlockHandler struct {
+	Store *ravendb.DocumentStore
+}
+
+func NewBlockHandler(store *ravendb.DocumentStore) *BlockHandler {
+	return &BlockHandler{
+		Store: store,
+	}
+}
+
+func (h *BlockHandler) RegisterBlockRoutes(r *gin.Engine) {
+	r.GET("/user/blocks", middleware.AuthMiddleware(), h.GetBlocks)
+	r.POST("/users/:id/block", middleware.AuthMiddleware(), h.BlockUser)
+	r.DELETE("/users/:id/block", middleware.AuthMiddleware(), h.UnblockUser)
+}
+
+// returns the users the current user blocked, most recent first
+func (h *BlockHandler) GetBlocks(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var blocks []*models.Block
+	q := session.QueryCollection("Blocks")
+	q = q.WhereEquals("blockerID", userID)
+	q = q.OrderByDescending("createdAt")
+	if err := q.GetResults(&blocks); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query blocks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"blocks": blocks})
+}
+
+// blocks a user, blocking someone twice keeps the first block
+func (h *BlockHandler) BlockUser(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	blockedID := "users/" + c.Param("id")
+	if blockedID == userID.(string) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't block yourself"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var blocked *models.User
+	err = session.Load(&blocked, blockedID)
+	if err != nil || blocked == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var block *models.Block
+	if err := session.Load(&block, models.BlockID(userID.(string), blockedID)); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load block"})
+		return
+	}
+	if block != nil {
+		c.JSON(http.StatusOK, gin.H{"block": block})
+		return
+	}
+
+	block = &models.Block{
+		ID:        models.BlockID(userID.(string), blockedID),
+		BlockerID: userID.(string),
+		BlockedID: blockedID,
+		CreatedAt: time.Now(),
+	}
+	if err := session.Store(block); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store block"})
+		return
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"block": block})
+}
+
+func (h *BlockHandler) UnblockUser(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var block *models.Block
+	err = session.Load(&block, models.BlockID(userID.(string), "users/"+c.Param("id")))
+	if err != nil || block == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Block not found"})
+		return
+	}
+
+	if err := session.Delete(block); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete block"})
+		return
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unblocked successfully"})
+}
+
+/*
+  Helpers
+*/
+
+// reports whether either of the users blocked the other
+func isBlocked(session *ravendb.DocumentSession, userID string, otherUserID string) (bool, error) {
+	blocks := make(map[string]*models.Block)
+	err := session.LoadMulti(blocks, []string{models.BlockID(userID, otherUserID), models.BlockID(otherUserID, userID)})
+	if err != nil {
+		return false, err
+	}
+	for _, block := range blocks {
+		if block != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// refuses contact between users when either of them blocked the other. Doesn't say who
+// blocked whom, the blocked user shouldn't learn about it this way
+func checkNotBlocked(c *gin.Context, store *ravendb.DocumentStore, userID string, otherUserID string) bool {
+	session, err := store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return false
+	}
+	defer session.Close()
+
+	blocked, err := isBlocked(session, userID, otherUserID)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load blocks"})
+		return false
+	}
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can't contact this user"})
+		return false
+	}
+	return true
+}
+
+// returns the users who blocked the user, their items are hidden from them
+func blockerIDs(session *ravendb.DocumentSession, userID string) ([]string, error) {
+	var blocks []*models.Block
+	q := session.QueryCollection("Blocks")
+	q = q.WhereEquals("blockedID", userID)
+	if err := q.GetResults(&blocks); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		ids = append(ids, block.BlockerID)
+	}
+	return ids, nil
+}
+
+// returns the users the user blocked or was blocked by, as a set
+func blockedUserIDs(session *ravendb.DocumentSession, userID string) (map[string]bool, error) {
+	var blocks []*models.Block
+	q := session.QueryCollection("Blocks")
+	q = q.WhereEquals("blockerID", userID).OrElse().WhereEquals("blockedID", userID)
+	if err := q.GetResults(&blocks); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool, len(blocks))
+	for _, block := range blocks {
+		if block.BlockerID == userID {
+			ids[block.BlockedID] = true
+		} else {
+			ids[block.BlockerID] = true
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,683 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"swapper/middleware"
+	"swapper/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+)
+
+type BookingHandler struct {
+	Store *ravendb.DocumentStore
+}
+
+func NewBookingHandler(store *ravendb.DocumentStore) *BookingHandler {
+	return &BookingHandler{
+		Store: store,
+	}
+}
+
+func (h *BookingHandler) RegisterBookingRoutes(r *gin.Engine) {
+	r.POST("/items/:id/bookings", middleware.AuthMiddleware(), h.RequestBooking)
+	r.GET("/items/:id/availability", h.GetItemAvailability)
+
+	bookings := r.Group("/bookings")
+	bookings.Use(middleware.AuthMiddleware())
+
+	bookings.GET("", h.GetBookings)
+	bookings.GET("/:id", h.GetBooking)
+	bookings.POST("/:id/approve", h.ApproveBooking)
+	bookings.POST("/:id/reject", h.RejectBooking)
+	bookings.POST("/:id/cancel", h.CancelBooking)
+	bookings.POST("/:id/pickup", h.PickUpBooking)
+	bookings.POST("/:id/return", h.ReturnBooking)
+}
+
+// dates are exchanged as plain days, a booking covers its start and end day
+const bookingDateLayout = "2006-01-02"
+
+// the longest range a single booking or availability lookup may span
+const maxBookingDays = 366
+
+var (
+	errItemFullyBooked = errors.New("item is already booked for some of the requested days")
+	errItemRentedOut   = errors.New("item is out on rent")
+)
+
+// a booking as it is returned, whether it is overdue is worked out when it is read
+type BookingResponse struct {
+	*models.Booking
+	Overdue bool `json:"overdue"`
+}
+
+type RequestBookingRequest struct {
+	StartDate string `json:"startDate" binding:"required"`
+	EndDate   string `json:"endDate" binding:"required"`
+	Message   string `json:"message"`
+}
+
+// route for requesting to rent an item over a range of days
+func (h *BookingHandler) RequestBooking(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req RequestBookingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+
+	start, end, err := parseBookingRange(req.StartDate, req.EndDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if start.Before(today()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bookings can't start in the past"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	itemID := "items/" + c.Param("id")
+	var item *models.Item
+	err = session.Load(&item, itemID)
+	if err != nil || item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	if item.Attributes.ListingType != "rent" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Item is not listed for rent"})
+		return
+	}
+
+	if item.UserID == userID.(string) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot book your own item"})
+		return
+	}
+
+	if item.Status != models.ItemStatusAvailable {
+		c.JSON(http.StatusConflict, gin.H{"error": "Item is not available"})
+		return
+	}
+
+	if err := checkBookingCapacity(session, item, start, end, ""); err != nil {
+		respondBookingError(c, err)
+		return
+	}
+
+	now := time.Now()
+	booking := models.Booking{
+		ItemID:    item.ID,
+		OwnerID:   item.UserID,
+		RenterID:  userID.(string),
+		StartDate: start,
+		EndDate:   end,
+		Message:   req.Message,
+		Status:    models.BookingStatusRequested,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if err := session.Store(&booking); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store booking"})
+		return
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"booking": newBookingResponse(&booking, now)})
+}
+
+type BookedRange struct {
+	StartDate string `json:"startDate"`
+	EndDate   string `json:"endDate"`
+	Status    string `json:"status"`
+}
+
+/*
+Returns the availability calendar of a rentable item
+
+url params:
+- from (string): first day of the calendar as YYYY-MM-DD (default today)
+- to (string): last day of the calendar as YYYY-MM-DD (default 90 days after from)
+*/
+func (h *BookingHandler) GetItemAvailability(c *gin.Context) {
+	from := today()
+	if c.Query("from") != "" {
+		parsed, err := time.Parse(bookingDateLayout, c.Query("from"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date"})
+			return
+		}
+		from = parsed
+	}
+
+	to := from.AddDate(0, 0, 90)
+	if c.Query("to") != "" {
+		parsed, err := time.Parse(bookingDateLayout, c.Query("to"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date"})
+			return
+		}
+		to = parsed
+	}
+
+	if to.Before(from) || to.Sub(from) > maxBookingDays*24*time.Hour {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date range"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var item *models.Item
+	err = session.Load(&item, "items/"+c.Param("id"))
+	if err != nil || item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	bookings, err := getHoldingBookings(session, item.ID)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query bookings"})
+		return
+	}
+
+	booked := make([]BookedRange, 0)
+	for _, booking := range bookings {
+		if booking.Overlaps(from, to) {
+			booked = append(booked, BookedRange{
+				StartDate: booking.StartDate.Format(bookingDateLayout),
+				EndDate:   booking.EndDate.Format(bookingDateLayout),
+				Status:    booking.Status,
+			})
+		}
+	}
+
+	// a day is unavailable once every unit of the item is booked on it
+	unavailable := make([]string, 0)
+	for day, count := range countBookingsPerDay(bookings, from, to) {
+		if count >= bookingCapacity(item) {
+			unavailable = append(unavailable, day)
+		}
+	}
+	sort.Strings(unavailable)
+
+	c.JSON(http.StatusOK, gin.H{
+		"itemID":           item.ID,
+		"from":             from.Format(bookingDateLayout),
+		"to":               to.Format(bookingDateLayout),
+		"quantity":         bookingCapacity(item),
+		"bookings":         booked,
+		"unavailableDates": unavailable,
+	})
+}
+
+/*
+Returns the bookings the current user takes part in
+
+url params:
+- role (string): "renter" or "owner" to only return one side (default both)
+- status (string): only return bookings with this status
+*/
+func (h *BookingHandler) GetBookings(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	q := session.QueryCollection("Bookings")
+	switch c.Query("role") {
+	case "renter":
+		q = q.WhereEquals("renterID", userID)
+	case "owner":
+		q = q.WhereEquals("ownerID", userID)
+	case "":
+		q = q.OpenSubclause().WhereEquals("renterID", userID).OrElse().WhereEquals("ownerID", userID).CloseSubclause()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	if status := c.Query("status"); status != "" {
+		q = q.AndAlso().WhereEquals("status", status)
+	}
+	q = q.OrderBy("startDate")
+
+	var bookings []*models.Booking
+	if err := q.GetResults(&bookings); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query bookings"})
+		return
+	}
+
+	now := time.Now()
+	responses := make([]BookingResponse, 0, len(bookings))
+	for _, booking := range bookings {
+		responses = append(responses, newBookingResponse(booking, now))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"bookings": responses})
+}
+
+func (h *BookingHandler) GetBooking(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	booking, ok := loadBookingForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	c.JSON(http.StatusOK, gin.H{"booking": newBookingResponse(booking, time.Now())})
+}
+
+/*
+the owner approves a requested booking as long as the item is still free for those days. The
+item is saved along with the booking, so approvals of overlapping bookings can't both pass the
+check
+*/
+func (h *BookingHandler) ApproveBooking(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	booking, ok := loadBookingForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	if booking.OwnerID != c.GetString("userID") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if booking.Status != models.BookingStatusRequested {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only requested bookings can be approved"})
+		return
+	}
+
+	var item *models.Item
+	err = session.Load(&item, booking.ItemID)
+	if err != nil || item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	// the item is loaded before the check, an approval saved in between changes it
+	if err := checkBookingCapacity(session, item, booking.StartDate, booking.EndDate, booking.ID); err != nil {
+		respondBookingError(c, err)
+		return
+	}
+
+	if err := lockItemBookings(session, item); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store item"})
+		return
+	}
+
+	booking.Status = models.BookingStatusApproved
+	saveBooking(c, session, booking)
+}
+
+func (h *BookingHandler) RejectBooking(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	booking, ok := loadBookingForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	if booking.OwnerID != c.GetString("userID") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if booking.Status != models.BookingStatusRequested {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only requested bookings can be rejected"})
+		return
+	}
+
+	booking.Status = models.BookingStatusRejected
+	saveBooking(c, session, booking)
+}
+
+// either side can call off a booking before the item has been picked up
+func (h *BookingHandler) CancelBooking(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	booking, ok := loadBookingForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	if booking.Status != models.BookingStatusRequested && booking.Status != models.BookingStatusApproved {
+		c.JSON(http.StatusConflict, gin.H{"error": "Booking can no longer be cancelled"})
+		return
+	}
+
+	booking.Status = models.BookingStatusCancelled
+	saveBooking(c, session, booking)
+}
+
+// the owner marks an approved booking as handed over to the renter
+func (h *BookingHandler) PickUpBooking(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	booking, ok := loadBookingForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	if booking.OwnerID != c.GetString("userID") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if booking.Status != models.BookingStatusApproved {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only approved bookings can be picked up"})
+		return
+	}
+
+	now := time.Now()
+	booking.Status = models.BookingStatusActive
+	booking.PickedUpAt = &now
+	saveBooking(c, session, booking)
+}
+
+// the owner confirms the item came back, late returns are still accepted
+func (h *BookingHandler) ReturnBooking(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	booking, ok := loadBookingForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	if booking.OwnerID != c.GetString("userID") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if booking.Status != models.BookingStatusActive {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only active bookings can be returned"})
+		return
+	}
+
+	now := time.Now()
+	booking.Status = models.BookingStatusReturned
+	booking.ReturnedAt = &now
+	saveBooking(c, session, booking)
+}
+
+/*
+  Helpers
+*/
+
+func today() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func parseBookingRange(startDate string, endDate string) (time.Time, time.Time, error) {
+	start, err := time.Parse(bookingDateLayout, startDate)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("Invalid start date, expected YYYY-MM-DD")
+	}
+
+	end, err := time.Parse(bookingDateLayout, endDate)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("Invalid end date, expected YYYY-MM-DD")
+	}
+
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, errors.New("End date must not be before start date")
+	}
+
+	if end.Sub(start) >= maxBookingDays*24*time.Hour {
+		return time.Time{}, time.Time{}, errors.New("Booking is too long")
+	}
+
+	return start, end, nil
+}
+
+// an item listed with a quantity greater than 1 can be rented out that many times at once
+func bookingCapacity(item *models.Item) int {
+	if item.Quantity < 1 {
+		return 1
+	}
+	return item.Quantity
+}
+
+// returns the approved and active bookings of an item, waiting for the index so a booking
+// approved a moment ago is taken into account
+func getHoldingBookings(session *ravendb.DocumentSession, itemID string) ([]*models.Booking, error) {
+	var bookings []*models.Booking
+	q := session.QueryCollection("Bookings")
+	q = q.WhereEquals("itemID", itemID).AndAlso().
+		OpenSubclause().
+		WhereEquals("status", models.BookingStatusApproved).OrElse().
+		WhereEquals("status", models.BookingStatusActive).
+		CloseSubclause()
+	q = q.WaitForNonStaleResults(0)
+
+	err := q.GetResults(&bookings)
+	return bookings, err
+}
+
+/*
+cancels the requested and approved bookings of an item in the session, for an item about to be
+deleted. Fails with errItemRentedOut while a renter has it, they have to return it first
+*/
+func cancelItemBookings(session *ravendb.DocumentSession, itemID string) (int, error) {
+	var bookings []*models.Booking
+	q := session.QueryCollection("Bookings")
+	q = q.WhereEquals("itemID", itemID)
+	q = q.WhereIn("status", []interface{}{models.BookingStatusRequested, models.BookingStatusApproved, models.BookingStatusActive})
+	q = q.WaitForNonStaleResults(0)
+	if err := q.GetResults(&bookings); err != nil {
+		return 0, err
+	}
+	for _, booking := range bookings {
+		if booking.Status == models.BookingStatusActive {
+			return 0, errItemRentedOut
+		}
+	}
+
+	now := time.Now()
+	for _, booking := range bookings {
+		booking.Status = models.BookingStatusCancelled
+		booking.UpdatedAt = now
+		if err := session.Store(booking); err != nil {
+			return 0, err
+		}
+	}
+	return len(bookings), nil
+}
+
+// counts how many holding bookings cover each day of the inclusive range
+func countBookingsPerDay(bookings []*models.Booking, from time.Time, to time.Time) map[string]int {
+	counts := make(map[string]int)
+	for _, booking := range bookings {
+		if !booking.Overlaps(from, to) {
+			continue
+		}
+		day := booking.StartDate
+		if day.Before(from) {
+			day = from
+		}
+		for !day.After(booking.EndDate) && !day.After(to) {
+			counts[day.Format(bookingDateLayout)]++
+			day = day.AddDate(0, 0, 1)
+		}
+	}
+	return counts
+}
+
+// makes sure at least one unit of the item is free on every day of the range,
+// ignoring the booking with the given id
+func checkBookingCapacity(session *ravendb.DocumentSession, item *models.Item, start time.Time, end time.Time, ignoreID string) error {
+	bookings, err := getHoldingBookings(session, item.ID)
+	if err != nil {
+		return err
+	}
+
+	others := make([]*models.Booking, 0, len(bookings))
+	for _, booking := range bookings {
+		if booking.ID != ignoreID {
+			others = append(others, booking)
+		}
+	}
+
+	for _, count := range countBookingsPerDay(others, start, end) {
+		if count >= bookingCapacity(item) {
+			return errItemFullyBooked
+		}
+	}
+	return nil
+}
+
+// loads the booking from the id url param and makes sure the current user is the renter or owner
+func loadBookingForParticipant(c *gin.Context, session *ravendb.DocumentSession) (*models.Booking, bool) {
+	id := "bookings/" + c.Param("id")
+
+	var booking *models.Booking
+	err := session.Load(&booking, id)
+	if err != nil || booking == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return nil, false
+	}
+
+	userID := c.GetString("userID")
+	if booking.RenterID != userID && booking.OwnerID != userID {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	return booking, true
+}
+
+/*
+bumps the bookings version of the item and stores it with the change vector it was loaded with.
+Saved in the same SaveChanges as an approval, a second approval for the item that was checked
+against the same bookings fails with a ConcurrencyError
+*/
+func lockItemBookings(session *ravendb.DocumentSession, item *models.Item) error {
+	changeVector, err := session.Advanced().GetChangeVectorFor(item)
+	if err != nil {
+		return err
+	}
+	if changeVector == nil {
+		return errors.New("item " + item.ID + " has no change vector")
+	}
+
+	item.BookingsVersion++
+	return session.StoreWithChangeVectorAndID(item, *changeVector, item.ID)
+}
+
+// stores the booking guarded by its change vector and writes the response
+func saveBooking(c *gin.Context, session *ravendb.DocumentSession, booking *models.Booking) {
+	booking.UpdatedAt = time.Now()
+
+	changeVector, err := session.Advanced().GetChangeVectorFor(booking)
+	if err != nil || changeVector == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store booking"})
+		return
+	}
+
+	if err := session.StoreWithChangeVectorAndID(booking, *changeVector, booking.ID); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store booking"})
+		return
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Booking or item was modified, please retry"})
+			return
+		}
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"booking": newBookingResponse(booking, booking.UpdatedAt)})
+}
+
+func newBookingResponse(booking *models.Booking, now time.Time) BookingResponse {
+	return BookingResponse{
+		Booking: booking,
+		Overdue: booking.IsOverdue(now),
+	}
+}
+
+func respondBookingError(c *gin.Context, err error) {
+	if errors.Is(err, errItemFullyBooked) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	fmt.Println(err.Error())
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query bookings"})
+}
@@ -0,0 +1,994 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"swapper/imaging"
+	"swapper/middleware"
+	"swapper/models"
+	"swapper/realtime"
+	"swapper/storage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+)
+
+// folders of the conversation list
+const (
+	FolderInbox    = "inbox"
+	FolderRequests = "requests" // first contacts the user didn't answer or accept yet
+)
+
+var errConversationNotFound = errors.New("conversation not found")
+
+const (
+	defaultConversationLimit = 20
+	maxConversationLimit     = 100
+	// attempts at saving a message while other messages update the same conversation
+	maxMessageSaveAttempts = 5
+	// members of a group, the creator included
+	maxGroupParticipants = 20
+)
+
+type ConversationHandler struct {
+	Store *ravendb.DocumentStore
+	Blobs storage.BlobStore
+	Hub   realtime.Hub
+}
+
+func NewConversationHandler(store *ravendb.DocumentStore, blobs storage.BlobStore, hub realtime.Hub) *ConversationHandler {
+	return &ConversationHandler{
+		Store: store,
+		Blobs: blobs,
+		Hub:   hub,
+	}
+}
+
+func (h *ConversationHandler) RegisterConversationRoutes(r *gin.Engine) {
+	conversations := r.Group("/conversations")
+	conversations.GET("", middleware.AuthMiddleware(models.ScopeMessagesRead), h.GetConversations)
+	conversations.GET("/:id", middleware.AuthMiddleware(models.ScopeMessagesRead), h.GetConversation)
+	conversations.POST("/:id/read", middleware.AuthMiddleware(models.ScopeMessagesWrite), h.MarkConversationRead)
+
+	// managing conversations and groups takes an access token
+	conversations = conversations.Group("", middleware.AuthMiddleware())
+	conversations.POST("", h.CreateGroupConversation)
+	conversations.POST("/:id/accept", h.AcceptConversation)
+	conversations.POST("/:id/members", h.AddGroupMember)
+	conversations.DELETE("/:id/members/:userId", h.RemoveGroupMember)
+	conversations.POST("/:id/leave", h.LeaveGroupConversation)
+
+	r.POST("/items/:id/inquire", middleware.AuthMiddleware(), h.InquireItem)
+}
+
+// a conversation as seen by one of its participants
+type ConversationResponse struct {
+	*models.Conversation
+	UnreadCount int                 `json:"unreadCount"`
+	Item        *models.ItemSummary `json:"item,omitempty"`
+}
+
+type MembersEvent struct {
+	ConversationID string   `json:"conversationID"`
+	ParticipantIDs []string `json:"participantIDs"`
+	CreatorID      string   `json:"creatorID"`
+}
+
+type ReadEvent struct {
+	ConversationID string    `json:"conversationID"`
+	UserID         string    `json:"userID"`
+	ReadAt         time.Time `json:"readAt"`
+}
+
+/*
+Returns the current user's conversations, most recently active first. The next page is
+requested with before=nextCursor, nextCursor is null on the last page. A conversation with a
+new message moves to the top of the first page
+
+url params:
+- folder (string): "inbox" or "requests", the first contacts of users you never dealt with (default inbox)
+- limit (int): limit the number of conversations returned (default 20, max 100)
+- before (string): a conversation id or RFC3339 timestamp, only conversations last active before it
+- after (string): a conversation id or RFC3339 timestamp, only conversations active since
+- skip (int): deprecated, skip the first n conversations instead of using a cursor (default 0)
+*/
+func (h *ConversationHandler) GetConversations(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	folder := c.DefaultQuery("folder", FolderInbox)
+	if folder != FolderInbox && folder != FolderRequests {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder"})
+		return
+	}
+
+	limit, ok := parseLimit(c, defaultConversationLimit, maxConversationLimit)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	cursor, ok := parseConversationCursor(c, session, userID.(string))
+	if !ok {
+		return // error is already added to gin context
+	}
+	if !parseSkip(c, &cursor) {
+		return // error is already added to gin context
+	}
+
+	conversations, nextCursor, err := queryConversations(session, userID.(string), folder, cursor, limit)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query conversations"})
+		return
+	}
+
+	responses, err := conversationResponses(c, session, h.Blobs, conversations, userID.(string))
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load items"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"conversations": responses, "nextCursor": nextCursor})
+}
+
+func (h *ConversationHandler) GetConversation(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	conversation, ok := loadConversationForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	userID, _ := c.Get("userID")
+	h.respondConversation(c, session, conversation, userID.(string))
+}
+
+type InquireItemRequest struct {
+	Text string `json:"text"`
+}
+
+// opens the conversation with the owner about the item, the text (if any) is sent as its first message
+func (h *ConversationHandler) InquireItem(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req InquireItemRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+			return
+		}
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var item *models.Item
+	err = session.Load(&item, "items/"+c.Param("id"))
+	if err != nil || item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	if item.UserID == userID.(string) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't inquire about your own item"})
+		return
+	}
+
+	if !checkNotBlocked(c, h.Store, userID.(string), item.UserID) {
+		return // error is already added to gin context
+	}
+
+	var conversation *models.Conversation
+	if strings.TrimSpace(req.Text) != "" {
+		message := models.Message{
+			SenderID:    userID.(string),
+			RecipientID: item.UserID,
+			ItemID:      item.ID,
+			Text:        req.Text,
+			SentAt:      time.Now(),
+		}
+		conversation, err = saveMessage(h.Store, &message)
+		if err != nil {
+			fmt.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store message"})
+			return
+		}
+		h.Hub.Publish(realtime.Event{Type: realtime.EventMessage, Data: message}, message.RecipientID, message.SenderID)
+	} else {
+		conversation, err = newConversation(session, item.ID, userID.(string), item.UserID)
+		if err != nil {
+			fmt.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store conversation"})
+			return
+		}
+		if err := createConversation(h.Store, conversation); err != nil {
+			fmt.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store conversation"})
+			return
+		}
+		// it may have existed already, return it as it is
+		err = session.Load(&conversation, conversation.ID)
+		if err != nil || conversation == nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load conversation"})
+			return
+		}
+	}
+
+	h.respondConversation(c, session, conversation, userID.(string))
+}
+
+// marks the conversation read up to now for the current user and lets the other participants know
+func (h *ConversationHandler) MarkConversationRead(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	now := time.Now()
+	conversation, err := markConversationRead(h.Store, "conversations/"+c.Param("id"), userID.(string), now)
+	if errors.Is(err, errConversationNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store conversation"})
+		return
+	}
+
+	h.Hub.Publish(realtime.Event{
+		Type: realtime.EventRead,
+		Data: ReadEvent{ConversationID: conversation.ID, UserID: userID.(string), ReadAt: now},
+	}, otherParticipants(conversation, userID.(string))...)
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	h.respondConversation(c, session, conversation, userID.(string))
+}
+
+// moves a message request into the current user's inbox, answering it does the same
+func (h *ConversationHandler) AcceptConversation(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	conversation, ok := loadConversationForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	userID, _ := c.Get("userID")
+	if !conversation.IsPendingFor(userID.(string)) {
+		h.respondConversation(c, session, conversation, userID.(string))
+		return
+	}
+	conversation.Accept(userID.(string))
+
+	if !storeConversation(c, session, conversation) {
+		return // error is already added to gin context
+	}
+
+	h.respondConversation(c, session, conversation, userID.(string))
+}
+
+type CreateGroupConversationRequest struct {
+	Title          string   `json:"title" binding:"required"`
+	ParticipantIDs []string `json:"participantIDs" binding:"required,min=2"`
+}
+
+type AddGroupMemberRequest struct {
+	UserID string `json:"userID" binding:"required"`
+}
+
+// starts a group conversation of the current user with the given users, e.g. for a swap between three people
+func (h *ConversationHandler) CreateGroupConversation(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req CreateGroupConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Title) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request, a title and at least 2 participants are required"})
+		return
+	}
+
+	for i, participantID := range req.ParticipantIDs {
+		req.ParticipantIDs[i] = models.UserDocumentID(participantID)
+	}
+	conversation := models.NewGroupConversation(userID.(string), req.Title, req.ParticipantIDs...)
+	if len(conversation.ParticipantIDs) < 3 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A group needs at least 2 other participants"})
+		return
+	}
+	if len(conversation.ParticipantIDs) > maxGroupParticipants {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A group can have at most %d participants", maxGroupParticipants)})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	memberIDs := removeString(conversation.ParticipantIDs, userID.(string))
+	if !checkGroupMembers(c, session, memberIDs, []string{userID.(string)}) {
+		return // error is already added to gin context
+	}
+	if !setPendingMembers(c, session, conversation, userID.(string), memberIDs) {
+		return // error is already added to gin context
+	}
+
+	// a new group gets a generated id
+	if err := session.Store(conversation); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store conversation"})
+		return
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	h.publishMembers(conversation)
+
+	responses, err := conversationResponses(c, session, h.Blobs, []*models.Conversation{conversation}, userID.(string))
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load items"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"conversation": responses[0]})
+}
+
+// adds a user to a group, any member can invite others
+func (h *ConversationHandler) AddGroupMember(c *gin.Context) {
+	var req AddGroupMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	conversation, ok := loadGroupForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	userID, _ := c.Get("userID")
+	req.UserID = models.UserDocumentID(req.UserID)
+	if conversation.IsParticipant(req.UserID) {
+		h.respondConversation(c, session, conversation, userID.(string))
+		return
+	}
+	if len(conversation.ParticipantIDs) >= maxGroupParticipants {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A group can have at most %d participants", maxGroupParticipants)})
+		return
+	}
+
+	if !checkGroupMembers(c, session, []string{req.UserID}, conversation.ParticipantIDs) {
+		return // error is already added to gin context
+	}
+
+	conversation.AddParticipant(req.UserID)
+	if !setPendingMembers(c, session, conversation, userID.(string), []string{req.UserID}) {
+		return // error is already added to gin context
+	}
+	if !storeConversation(c, session, conversation) {
+		return // error is already added to gin context
+	}
+
+	h.publishMembers(conversation)
+
+	h.respondConversation(c, session, conversation, userID.(string))
+}
+
+// removes a member from a group, only its creator can
+func (h *ConversationHandler) RemoveGroupMember(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	conversation, ok := loadGroupForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	userID, _ := c.Get("userID")
+	if conversation.CreatorID != userID.(string) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	memberID := "users/" + c.Param("userId")
+	if memberID == userID.(string) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Leave the group to remove yourself"})
+		return
+	}
+	if !conversation.IsParticipant(memberID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+
+	conversation.RemoveParticipant(memberID)
+	if !storeConversation(c, session, conversation) {
+		return // error is already added to gin context
+	}
+
+	h.publishMembers(conversation, memberID)
+
+	h.respondConversation(c, session, conversation, userID.(string))
+}
+
+// removes the current user from a group, the group stays with the remaining members
+func (h *ConversationHandler) LeaveGroupConversation(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	conversation, ok := loadGroupForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	userID, _ := c.Get("userID")
+	conversation.RemoveParticipant(userID.(string))
+	if !storeConversation(c, session, conversation) {
+		return // error is already added to gin context
+	}
+
+	h.publishMembers(conversation, userID.(string))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Left conversation successfully"})
+}
+
+/*
+  Helpers
+*/
+
+func (h *ConversationHandler) respondConversation(c *gin.Context, session *ravendb.DocumentSession, conversation *models.Conversation, userID string) {
+	responses, err := conversationResponses(c, session, h.Blobs, []*models.Conversation{conversation}, userID)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load items"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"conversation": responses[0]})
+}
+
+// builds the responses for the user, with a summary of the item each conversation is about.
+// Items deleted since have no summary
+func conversationResponses(c *gin.Context, session *ravendb.DocumentSession, blobs storage.BlobStore, conversations []*models.Conversation, userID string) ([]ConversationResponse, error) {
+	var itemIDs []string
+	for _, conversation := range conversations {
+		if conversation.ItemID != "" && !containsString(itemIDs, conversation.ItemID) {
+			itemIDs = append(itemIDs, conversation.ItemID)
+		}
+	}
+
+	summaries := make(map[string]*models.ItemSummary)
+	if len(itemIDs) > 0 {
+		items := make(map[string]*models.Item)
+		if err := session.LoadMulti(items, itemIDs); err != nil {
+			return nil, err
+		}
+		attachments, err := storage.ListMany(c.Request.Context(), blobs, itemIDs)
+		if err != nil {
+			return nil, err
+		}
+		for id, item := range items {
+			if item == nil {
+				continue
+			}
+			summary := &models.ItemSummary{ID: item.ID, Title: item.Title, Status: item.Status}
+			urls := imageURLsFromAttachments(c, attachments[id], 1, imaging.SizeThumbnail, item)
+			if len(urls) > 0 {
+				summary.Image = urls[0]
+			}
+			summaries[id] = summary
+		}
+	}
+
+	responses := make([]ConversationResponse, 0, len(conversations))
+	for _, conversation := range conversations {
+		response := conversationResponse(conversation, userID)
+		response.Item = summaries[conversation.ItemID]
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+/*
+returns a page of the user's conversations in a folder in the cursor's order, most recently active first
+unless paging forward, and the cursor of the next page, nil on the last one
+*/
+func queryConversations(session *ravendb.DocumentSession, userID string, folder string, cursor pageCursor, limit int) ([]*models.Conversation, *string, error) {
+	var conversations []*models.Conversation
+	q := session.QueryCollection("Conversations")
+	q = q.WhereEquals("participantIDs", userID)
+	if folder == FolderRequests {
+		q = q.OpenSubclause().WhereEquals("pendingFor", userID).OrElse().WhereEquals("pendingMembers", userID).CloseSubclause()
+	} else {
+		q = q.Not().WhereEquals("pendingFor", userID).Not().WhereEquals("pendingMembers", userID)
+	}
+	q = cursor.apply(q, "updatedAt", limit)
+
+	if err := q.GetResults(&conversations); err != nil {
+		return nil, nil, err
+	}
+
+	var nextCursor *string
+	if len(conversations) > limit {
+		conversations = conversations[:limit]
+		nextCursor = &conversations[limit-1].ID
+	}
+	return conversations, nextCursor, nil
+}
+
+// the before and after url params of the conversation list, a cursor can only name one of the user's conversations
+func parseConversationCursor(c *gin.Context, session *ravendb.DocumentSession, userID string) (pageCursor, bool) {
+	return parseCursor(c, func(id string) (*time.Time, error) {
+		var conversation *models.Conversation
+		if err := session.Load(&conversation, id); err != nil || conversation == nil {
+			return nil, err
+		}
+		if !conversation.IsParticipant(userID) {
+			return nil, nil
+		}
+		return &conversation.UpdatedAt, nil
+	})
+}
+
+// loads the conversation from the id url param and makes sure the current user takes part in it
+func loadConversationForParticipant(c *gin.Context, session *ravendb.DocumentSession) (*models.Conversation, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	var conversation *models.Conversation
+	err := session.Load(&conversation, "conversations/"+c.Param("id"))
+	if err != nil || conversation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return nil, false
+	}
+
+	// not telling outsiders the conversation exists
+	if !conversation.IsParticipant(userID.(string)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return nil, false
+	}
+
+	return conversation, true
+}
+
+// loads a group from the id url param, only its members can change it
+func loadGroupForParticipant(c *gin.Context, session *ravendb.DocumentSession) (*models.Conversation, bool) {
+	conversation, ok := loadConversationForParticipant(c, session)
+	if !ok {
+		return nil, false
+	}
+	if !conversation.Group {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only group conversations have members"})
+		return nil, false
+	}
+	return conversation, true
+}
+
+/*
+new members have to exist and must not have blocked, or be blocked by, anyone in the group: the
+members already in it, the user adding them included, and each other. The error doesn't say who
+blocked whom
+*/
+func checkGroupMembers(c *gin.Context, session *ravendb.DocumentSession, memberIDs []string, existingIDs []string) bool {
+	users := make(map[string]*models.User)
+	if err := session.LoadMulti(users, memberIDs); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load users"})
+		return false
+	}
+
+	groupIDs := append(append([]string{}, existingIDs...), memberIDs...)
+	for _, memberID := range memberIDs {
+		if users[memberID] == nil || users[memberID].DeletedAt != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found: " + memberID})
+			return false
+		}
+		blocked, err := blockedUserIDs(session, memberID)
+		if err != nil {
+			fmt.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load blocks"})
+			return false
+		}
+		for _, otherID := range groupIDs {
+			if blocked[otherID] {
+				c.JSON(http.StatusForbidden, gin.H{"error": "You can't add this user"})
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// a group lands in the message requests of new members who never dealt with the user adding them,
+// like a first message would, until they write in it or accept it
+func setPendingMembers(c *gin.Context, session *ravendb.DocumentSession, conversation *models.Conversation, userID string, memberIDs []string) bool {
+	for _, memberID := range memberIDs {
+		firstContact, err := isFirstContact(session, userID, memberID)
+		if err != nil {
+			fmt.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load conversations"})
+			return false
+		}
+		if firstContact {
+			conversation.PendingMembers = append(conversation.PendingMembers, memberID)
+		}
+	}
+	return true
+}
+
+// stores a conversation with the change vector it was loaded with, so a message arriving at
+// the same time isn't overwritten
+func storeConversation(c *gin.Context, session *ravendb.DocumentSession, conversation *models.Conversation) bool {
+	changeVector, err := session.Advanced().GetChangeVectorFor(conversation)
+	if err != nil || changeVector == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store conversation"})
+		return false
+	}
+
+	if err := session.StoreWithChangeVectorAndID(conversation, *changeVector, conversation.ID); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store conversation"})
+		return false
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Conversation was modified, please retry"})
+			return false
+		}
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return false
+	}
+	return true
+}
+
+// tells the members, and the users who were just removed, who is in a group now
+func (h *ConversationHandler) publishMembers(conversation *models.Conversation, removedIDs ...string) {
+	h.Hub.Publish(realtime.Event{
+		Type: realtime.EventMembers,
+		Data: MembersEvent{ConversationID: conversation.ID, ParticipantIDs: conversation.ParticipantIDs, CreatorID: conversation.CreatorID},
+	}, append(append([]string{}, conversation.ParticipantIDs...), removedIDs...)...)
+}
+
+func conversationResponse(conversation *models.Conversation, userID string) ConversationResponse {
+	if conversation.LastMessage != nil && conversation.LastMessage.IsHiddenFor(userID) {
+		// the user deleted it for themselves, a copy so the session's conversation stays as stored
+		hidden := *conversation
+		hidden.LastMessage = nil
+		conversation = &hidden
+	}
+	return ConversationResponse{
+		Conversation: conversation,
+		UnreadCount:  conversation.UnreadCounts[userID],
+	}
+}
+
+func otherParticipants(conversation *models.Conversation, userID string) []string {
+	return removeString(conversation.ParticipantIDs, userID)
+}
+
+/*
+stores a new message and updates the header of its conversation in the same transaction. Two
+messages to one conversation at the same time would overwrite each other's unread counts, so
+the conversation is stored with the change vector it was loaded with and the loser tries again
+*/
+func saveMessage(store *ravendb.DocumentStore, message *models.Message) (*models.Conversation, error) {
+	// messages to a group name it, others go to the conversation between the two users
+	if message.ConversationID == "" {
+		message.ConversationID = models.ConversationID(message.ItemID, message.SenderID, message.RecipientID)
+	}
+
+	for attempt := 1; ; attempt++ {
+		conversation, err := trySaveMessage(store, message)
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) && attempt < maxMessageSaveAttempts {
+			continue
+		}
+		return conversation, err
+	}
+}
+
+func trySaveMessage(store *ravendb.DocumentStore, message *models.Message) (*models.Conversation, error) {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var conversation *models.Conversation
+	if err := session.Load(&conversation, message.ConversationID); err != nil {
+		return nil, err
+	}
+	if conversation == nil && message.RecipientID == "" {
+		return nil, errConversationNotFound
+	}
+	if conversation == nil {
+		conversation, err = newConversation(session, message.ItemID, message.SenderID, message.RecipientID)
+		if err != nil {
+			return nil, err
+		}
+		if err := createConversation(store, conversation); err != nil {
+			return nil, err
+		}
+		if err := session.Load(&conversation, message.ConversationID); err != nil || conversation == nil {
+			return nil, fmt.Errorf("conversation %s disappeared: %v", message.ConversationID, err)
+		}
+	}
+
+	// checked on the loaded version, the sender may just have been removed from the group
+	if !conversation.IsParticipant(message.SenderID) {
+		return nil, errConversationNotFound
+	}
+
+	changeVector, err := session.Advanced().GetChangeVectorFor(conversation)
+	if err != nil || changeVector == nil {
+		return nil, fmt.Errorf("no change vector for %s: %v", conversation.ID, err)
+	}
+
+	// the id is assigned here and kept when retrying
+	if err := session.Store(message); err != nil {
+		return nil, err
+	}
+
+	conversation.AddMessage(message)
+	if err := session.StoreWithChangeVectorAndID(conversation, *changeVector, conversation.ID); err != nil {
+		return nil, err
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		return nil, err
+	}
+	return conversation, nil
+}
+
+/*
+marks the conversation read for the user. Like saveMessage it is stored with the change vector it
+was loaded with, so a message arriving at the same time keeps its unread count, and the loser
+tries again
+*/
+func markConversationRead(store *ravendb.DocumentStore, conversationID string, userID string, at time.Time) (*models.Conversation, error) {
+	for attempt := 1; ; attempt++ {
+		conversation, err := tryMarkConversationRead(store, conversationID, userID, at)
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) && attempt < maxMessageSaveAttempts {
+			continue
+		}
+		return conversation, err
+	}
+}
+
+func tryMarkConversationRead(store *ravendb.DocumentStore, conversationID string, userID string, at time.Time) (*models.Conversation, error) {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var conversation *models.Conversation
+	if err := session.Load(&conversation, conversationID); err != nil {
+		return nil, err
+	}
+	// not telling outsiders the conversation exists
+	if conversation == nil || !conversation.IsParticipant(userID) {
+		return nil, errConversationNotFound
+	}
+
+	changeVector, err := session.Advanced().GetChangeVectorFor(conversation)
+	if err != nil || changeVector == nil {
+		return nil, fmt.Errorf("no change vector for %s: %v", conversation.ID, err)
+	}
+
+	conversation.MarkRead(userID, at)
+	if err := session.StoreWithChangeVectorAndID(conversation, *changeVector, conversation.ID); err != nil {
+		return nil, err
+	}
+	if err := session.SaveChanges(); err != nil {
+		return nil, err
+	}
+	return conversation, nil
+}
+
+/*
+applies change to a stored message and keeps the header of its conversation in step. Like
+saveMessage, the message and the conversation are stored with the change vectors they were
+loaded with and a change that lost a race is applied again to the new versions. change returns
+an error to give up without storing anything
+*/
+func updateMessage(store *ravendb.DocumentStore, messageID string, change func(message *models.Message, conversation *models.Conversation) error) (*models.Message, *models.Conversation, error) {
+	for attempt := 1; ; attempt++ {
+		message, conversation, err := tryUpdateMessage(store, messageID, change)
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) && attempt < maxMessageSaveAttempts {
+			continue
+		}
+		return message, conversation, err
+	}
+}
+
+func tryUpdateMessage(store *ravendb.DocumentStore, messageID string, change func(message *models.Message, conversation *models.Conversation) error) (*models.Message, *models.Conversation, error) {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer session.Close()
+
+	var message *models.Message
+	if err := session.Load(&message, messageID); err != nil {
+		return nil, nil, err
+	}
+	if message == nil {
+		return nil, nil, errMessageNotFound
+	}
+
+	var conversation *models.Conversation
+	if err := session.Load(&conversation, message.ConversationID); err != nil {
+		return nil, nil, err
+	}
+	if conversation == nil {
+		// every message is linked to its conversation once the backfill ran
+		return nil, nil, fmt.Errorf("conversation %s of %s not found", message.ConversationID, message.ID)
+	}
+
+	if err := change(message, conversation); err != nil {
+		return nil, nil, err
+	}
+	conversation.UpdateMessage(message)
+
+	messageChangeVector, err := session.Advanced().GetChangeVectorFor(message)
+	if err != nil || messageChangeVector == nil {
+		return nil, nil, fmt.Errorf("no change vector for %s: %v", message.ID, err)
+	}
+	conversationChangeVector, err := session.Advanced().GetChangeVectorFor(conversation)
+	if err != nil || conversationChangeVector == nil {
+		return nil, nil, fmt.Errorf("no change vector for %s: %v", conversation.ID, err)
+	}
+
+	if err := session.StoreWithChangeVectorAndID(message, *messageChangeVector, message.ID); err != nil {
+		return nil, nil, err
+	}
+	if err := session.StoreWithChangeVectorAndID(conversation, *conversationChangeVector, conversation.ID); err != nil {
+		return nil, nil, err
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		return nil, nil, err
+	}
+	return message, conversation, nil
+}
+
+// starts a conversation the sender opens with the recipient, a message request for the
+// recipient if the two never dealt with each other
+func newConversation(session *ravendb.DocumentSession, itemID string, senderID string, recipientID string) (*models.Conversation, error) {
+	conversation := models.NewConversation(itemID, senderID, recipientID)
+	firstContact, err := isFirstContact(session, senderID, recipientID)
+	if err != nil {
+		return nil, err
+	}
+	if firstContact {
+		conversation.PendingFor = recipientID
+	}
+	return conversation, nil
+}
+
+// the users never agreed on a swap and the recipient never took up a conversation with the sender
+func isFirstContact(session *ravendb.DocumentSession, senderID string, recipientID string) (bool, error) {
+	var swaps []*models.SwapProposal
+	q := session.QueryCollection("SwapProposals")
+	q = q.OpenSubclause().
+		WhereEquals("proposerID", senderID).WhereEquals("ownerID", recipientID).OrElse().
+		WhereEquals("proposerID", recipientID).WhereEquals("ownerID", senderID).
+		CloseSubclause()
+	q = q.WhereIn("status", []interface{}{models.SwapStatusAccepted, models.SwapStatusCompleted})
+	if err := q.Take(1).GetResults(&swaps); err != nil {
+		return false, err
+	}
+	if len(swaps) > 0 {
+		return false, nil
+	}
+
+	var conversations []*models.Conversation
+	q = session.QueryCollection("Conversations")
+	q = q.WhereEquals("participantIDs", senderID).WhereEquals("participantIDs", recipientID)
+	q = q.Not().WhereEquals("pendingFor", recipientID).Not().WhereEquals("pendingMembers", recipientID)
+	if err := q.Take(1).GetResults(&conversations); err != nil {
+		return false, err
+	}
+	return len(conversations) == 0, nil
+}
+
+/*
+stores a new conversation unless it exists already. Sessions can't ask for a document to not
+exist yet, so it is put directly with an empty change vector which makes RavenDB refuse to
+overwrite one created in the meantime
+*/
+func createConversation(store *ravendb.DocumentStore, conversation *models.Conversation) error {
+	data, err := json.Marshal(conversation)
+	if err != nil {
+		return err
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	document["@metadata"] = map[string]interface{}{
+		"@collection":   "Conversations",
+		"Raven-Go-Type": "models.Conversation",
+	}
+
+	noChangeVector := ""
+	cmd := ravendb.NewPutDocumentCommand(conversation.ID, &noChangeVector, document)
+	err = store.GetRequestExecutor("").ExecuteCommand(cmd, nil)
+
+	var concurrencyErr *ravendb.ConcurrencyError
+	if errors.As(err, &concurrencyErr) {
+		return nil // created by the other participant
+	}
+	return err
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"swapper/imaging"
+	"swapper/storage"
+	"swapper/uploads"
+
+	"github.com/gin-gonic/gin"
+)
+
+// image urls carry the attachment hash as a version, so a url always points at the same bytes
+// and can be cached for good. Requests without the version have to revalidate with the ETag.
+// Images only some users may see are kept out of shared caches altogether
+const (
+	immutableCacheControl   = "public, max-age=31536000, immutable"
+	revalidateCacheControl  = "public, no-cache"
+	privateCacheControl     = "private, no-cache"
+	imageVersionQueryParam  = "v"
+	imageVersionHashLength  = 16
+	contentTypeSniffLength  = 512
+	defaultImageContentType = "application/octet-stream"
+)
+
+// how long proxies and browsers may keep an image serveAttachment sends
+type attachmentCaching int
+
+const (
+	publicAttachment  attachmentCaching = iota // anyone may see it, shared caches may keep it
+	privateAttachment                          // only the browser that loaded it may keep it
+)
+
+// streams an image blob of a document, answering 304 when the client already has the current version
+func serveAttachment(c *gin.Context, blobs storage.BlobStore, docID string, name string, caching attachmentCaching) {
+	size := c.DefaultQuery("size", imaging.SizeFull)
+	if !imaging.IsValidSize(size) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid size"})
+		return
+	}
+
+	attachments, err := blobs.List(c.Request.Context(), docID)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
+		return
+	}
+
+	if imaging.IsVariantName(name) || findVariant(attachments, name, imaging.SizeFull) == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	details := findVariant(attachments, name, size)
+
+	etag := fmt.Sprintf(`"%s"`, details.Hash)
+	c.Header("ETag", etag)
+	if caching == privateAttachment {
+		c.Header("Cache-Control", privateCacheControl)
+	} else if c.Query(imageVersionQueryParam) == imageVersion(details.Hash) {
+		c.Header("Cache-Control", immutableCacheControl)
+	} else {
+		c.Header("Cache-Control", revalidateCacheControl)
+	}
+
+	if ifNoneMatch(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	blob, err := blobs.Get(c.Request.Context(), docID, details.Name)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment"})
+		return
+	}
+	defer blob.Data.Close()
+
+	// older attachments were stored without a content type, sniff it from the first bytes
+	reader := bufio.NewReaderSize(blob.Data, contentTypeSniffLength)
+	contentType := blob.ContentType
+	if contentType == "" {
+		head, _ := reader.Peek(contentTypeSniffLength)
+		contentType = http.DetectContentType(head)
+	}
+	if contentType == "" {
+		contentType = defaultImageContentType
+	}
+
+	c.DataFromReader(http.StatusOK, blob.Size, contentType, reader, nil)
+}
+
+// returns the blob holding the image at the given size, images uploaded before resized
+// copies were stored only have their original which is served for every size
+func findVariant(attachments []storage.BlobInfo, name string, size string) *storage.BlobInfo {
+	var original *storage.BlobInfo
+	variantName := imaging.VariantName(name, size)
+	for i := range attachments {
+		if attachments[i].Name == variantName {
+			return &attachments[i]
+		}
+		if attachments[i].Name == name {
+			original = &attachments[i]
+		}
+	}
+	return original
+}
+
+// stores every size of an uploaded image as blobs of the document
+func storeImageVariants(ctx context.Context, blobs storage.BlobStore, docID string, name string, file *uploads.File) error {
+	variants, err := imaging.Process(file.Data)
+	if err != nil {
+		return err
+	}
+	return putImageVariants(ctx, blobs, docID, name, variants)
+}
+
+func putImageVariants(ctx context.Context, blobs storage.BlobStore, docID string, name string, variants []imaging.Variant) error {
+	for _, variant := range variants {
+		err := blobs.Put(ctx, docID, imaging.VariantName(name, variant.Size), bytes.NewReader(variant.Data), int64(len(variant.Data)), variant.ContentType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletes an image blob together with its resized copies
+func deleteImageVariants(ctx context.Context, blobs storage.BlobStore, docID string, name string) error {
+	for _, size := range imaging.Sizes {
+		if err := blobs.Delete(ctx, docID, imaging.VariantName(name, size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parses a multipart upload, refusing requests bigger than limits.MaxRequestSize
+func parseUploadForm(c *gin.Context, limits uploads.Limits) bool {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limits.MaxRequestSize)
+	if err := c.Request.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request is too large"})
+			return false
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse multipart form"})
+		return false
+	}
+	return true
+}
+
+// validates uploaded images by their contents, writing the rejection to the gin context
+func readUploadedImages(c *gin.Context, headers []*multipart.FileHeader, limits uploads.Limits) ([]*uploads.File, bool) {
+	files, err := uploads.ReadImages(headers, limits)
+	if err == nil {
+		return files, true
+	}
+
+	switch {
+	case errors.Is(err, uploads.ErrFileTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, uploads.ErrUnsupportedType), errors.Is(err, uploads.ErrHEICUnsupported):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, uploads.ErrTooManyPixels), errors.Is(err, uploads.ErrCorruptImage):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
+	}
+	return nil, false
+}
+
+// reports whether an If-None-Match header matches the etag
+func ifNoneMatch(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func imageVersion(hash string) string {
+	version := strings.NewReplacer("+", "-", "/", "_", "=", "").Replace(hash)
+	if len(version) > imageVersionHashLength {
+		version = version[:imageVersionHashLength]
+	}
+	return version
+}
+
+// builds the absolute url of an image, path segments are escaped individually
+func imageURL(c *gin.Context, hash string, segments ...string) string {
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("%s/%s?%s=%s", publicBaseURL(c), strings.Join(escaped, "/"), imageVersionQueryParam, imageVersion(hash))
+}
+
+// the url clients reach the api on, PUBLIC_URL wins over what the request says
+func publicBaseURL(c *gin.Context) string {
+	if base := os.Getenv("PUBLIC_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// strips the collection prefix from a document id, "items/1-A" becomes "1-A"
+func shortID(id string) string {
+	if i := strings.Index(id, "/"); i >= 0 {
+		return id[i+1:]
+	}
+	return id
+}
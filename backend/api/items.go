@@ -1,18 +1,19 @@
 package api
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"mime"
 	"net/http"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"swapper/imaging"
 	"swapper/middleware"
 	"swapper/models"
+	"swapper/storage"
+	"swapper/uploads"
 	"swapper/utils"
 	"time"
 
@@ -23,23 +24,31 @@ import (
 
 type ItemHandler struct {
 	Store *ravendb.DocumentStore
+	Blobs storage.BlobStore
 }
 
-func NewItemHandler(store *ravendb.DocumentStore) *ItemHandler {
+func NewItemHandler(store *ravendb.DocumentStore, blobs storage.BlobStore) *ItemHandler {
 	return &ItemHandler{
 		Store: store,
+		Blobs: blobs,
 	}
 }
 
 func (h *ItemHandler) RegisterItemRoutes(r *gin.Engine) {
 	items := r.Group("/items")
 
-	items.POST("", middleware.AuthMiddleware(), h.AddItem)
-	items.GET("", h.GetItems)
+	items.POST("", middleware.AuthMiddleware(models.ScopeItemsWrite), h.AddItem)
+	// a token is optional, it hides the items of users who blocked the caller
+	items.GET("", middleware.OptionalAuthMiddleware(models.ScopeItemsRead), h.GetItems)
 	items.GET("/:id", h.GetItem)
-	items.DELETE("/:id", middleware.AuthMiddleware(), h.DeleteItem)
+	items.PATCH("/:id", middleware.AuthMiddleware(models.ScopeItemsWrite), h.UpdateItem)
+	items.DELETE("/:id", middleware.AuthMiddleware(models.ScopeItemsWrite), h.DeleteItem)
+	items.POST("/:id/images", middleware.AuthMiddleware(models.ScopeItemsWrite), h.AddItemImages)
+	items.PUT("/:id/images/order", middleware.AuthMiddleware(models.ScopeItemsWrite), h.ReorderItemImages)
+	items.DELETE("/:id/images/:name", middleware.AuthMiddleware(models.ScopeItemsWrite), h.DeleteItemImage)
 	items.GET("/attributes", h.GetAttributes)
 	items.GET("/:id/ratings", h.GetItemRatings)
+	items.GET("/:id/images/:name", h.GetItemImage)
 }
 
 type AddItemRequest struct {
@@ -58,9 +67,8 @@ func (h *ItemHandler) AddItem(c *gin.Context) {
 		return
 	}
 
-	if err := c.Request.ParseMultipartForm(32 << 20); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse multipart form"})
-		return
+	if !parseUploadForm(c, uploads.DefaultLimits) {
+		return // error is already added to gin context
 	}
 
 	var addItemReq AddItemRequest
@@ -83,20 +91,13 @@ func (h *ItemHandler) AddItem(c *gin.Context) {
 		Description: addItemReq.Description,
 		Quantity:    quantity,
 		Location:    addItemReq.Location,
-		Status:      "available",
+		Status:      models.ItemStatusAvailable,
 		Attributes:  addItemReq.Attributes,
 		CreatedAt:   time.Now(),
 	}
 
-	validate := validator.New()
-	if err := validate.Struct(newItem); err != nil {
-		var ve validator.ValidationErrors
-		if errors.As(err, &ve) {
-			c.JSON(http.StatusBadRequest, gin.H{"validation error": ve.Error()})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if !validateItem(c, &newItem) {
+		return // error is already added to gin context
 	}
 
 	session, err := h.Store.OpenSession("")
@@ -107,23 +108,23 @@ func (h *ItemHandler) AddItem(c *gin.Context) {
 	defer session.Close()
 
 	form, _ := c.MultipartForm()
-	files := form.File["images"]
-
-	// Filter down files if not jpg, png, or jpeg
-	for _, file := range files {
-		ext := filepath.Ext(file.Filename)
-		if ext != ".jpg" && ext != ".png" && ext != ".jpeg" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Only jpg, png, and jpeg files are allowed"})
-			return
-		}
-	}
 
 	// Require at least 1 image
-	if len(files) == 0 {
+	if len(form.File["images"]) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "At least 1 image is required"})
 		return
 	}
 
+	if !checkImageCount(c, 0, len(form.File["images"])) {
+		return // error is already added to gin context
+	}
+
+	// Validate every image before anything is stored
+	files, ok := readUploadedImages(c, form.File["images"], uploads.DefaultLimits)
+	if !ok {
+		return // error is already added to gin context
+	}
+
 	err = session.Store(&newItem)
 	if err != nil {
 		fmt.Println(err.Error())
@@ -137,21 +138,102 @@ func (h *ItemHandler) AddItem(c *gin.Context) {
 		return
 	}
 
-	for _, file := range files {
-		fileStream, err := file.Open()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
+	if !storeItemImages(c, h.Blobs, session, &newItem, files) {
+		return // error is already added to gin context
+	}
+
+	err = session.SaveChanges()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": newItem.ID})
+}
+
+type UpdateItemRequest struct {
+	Title       *string                  `json:"title"`
+	Description *string                  `json:"description"`
+	Quantity    *int                     `json:"quantity"`
+	Categories  *[]string                `json:"categories"`
+	Location    *models.Location         `json:"location"`
+	Attributes  *UpdateAttributesRequest `json:"attributes"`
+}
+
+// the attributes to change, a missing one is kept and an empty string clears it
+type UpdateAttributesRequest struct {
+	Condition        *string `json:"condition"`
+	Size             *string `json:"size"`
+	Color            *string `json:"color"`
+	ListingType      *string `json:"listingType"`
+	ItemCategory     *string `json:"itemCategory"`
+	OwnershipHistory *string `json:"ownershipHistory"`
+	Authenticity     *string `json:"authenticity"`
+}
+
+// partially updates an item, only the fields present in the body are changed. Attributes are
+// merged so sending {"attributes": {"color": "red"}} keeps every other attribute as is, and
+// {"attributes": {"color": ""}} clears the color
+func (h *ItemHandler) UpdateItem(c *gin.Context) {
+	var req UpdateItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	item, ok := loadOwnedItem(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	if req.Title != nil {
+		if strings.TrimSpace(*req.Title) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Title can't be empty"})
 			return
 		}
-		defer fileStream.Close()
+		item.Title = *req.Title
+	}
 
-		mimeType := mime.TypeByExtension(filepath.Ext(file.Filename))
-		err = session.Advanced().Attachments().Store(&newItem, file.Filename, fileStream, mimeType)
-		if err != nil {
-			fmt.Println(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+	if req.Description != nil {
+		item.Description = *req.Description
+	}
+
+	if req.Quantity != nil {
+		if *req.Quantity < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Quantity must be at least 1"})
 			return
 		}
+		item.Quantity = *req.Quantity
+	}
+
+	if req.Categories != nil {
+		item.Categories = *req.Categories
+	}
+
+	if req.Location != nil {
+		item.Location = *req.Location
+	}
+
+	if req.Attributes != nil {
+		mergeAttributes(&item.Attributes, req.Attributes)
+	}
+
+	if !validateItem(c, item) {
+		return // error is already added to gin context
+	}
+
+	err = session.Store(item)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store item"})
+		return
 	}
 
 	err = session.SaveChanges()
@@ -160,7 +242,185 @@ func (h *ItemHandler) AddItem(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"id": newItem.ID})
+	c.JSON(http.StatusOK, gin.H{"item": item})
+}
+
+// streams a single image of an item
+func (h *ItemHandler) GetItemImage(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var item *models.Item
+	err = session.Load(&item, "items/"+c.Param("id"))
+	if err != nil || item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	serveAttachment(c, h.Blobs, item.ID, c.Param("name"), publicAttachment)
+}
+
+// adds the uploaded "images" files to the end of an item's images
+func (h *ItemHandler) AddItemImages(c *gin.Context) {
+	if !parseUploadForm(c, uploads.DefaultLimits) {
+		return // error is already added to gin context
+	}
+
+	form, _ := c.MultipartForm()
+	if len(form.File["images"]) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least 1 image is required"})
+		return
+	}
+
+	files, ok := readUploadedImages(c, form.File["images"], uploads.DefaultLimits)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	item, ok := loadOwnedItem(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	if !storeItemImages(c, h.Blobs, session, item, files) {
+		return // error is already added to gin context
+	}
+
+	err = session.SaveChanges()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"images": item.ImageOrder})
+}
+
+// removes a single image from an item, an item always keeps at least one image
+func (h *ItemHandler) DeleteItemImage(c *gin.Context) {
+	name := c.Param("name")
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	item, ok := loadOwnedItem(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	names, err := getImageNames(c.Request.Context(), h.Blobs, item)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
+		return
+	}
+
+	if !containsString(names, name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if len(names) == 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "An item needs at least 1 image"})
+		return
+	}
+
+	err = deleteImageVariants(c.Request.Context(), h.Blobs, item.ID, name)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachment"})
+		return
+	}
+
+	item.ImageOrder = removeString(names, name)
+	err = session.Store(item)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store item"})
+		return
+	}
+
+	err = session.SaveChanges()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"images": item.ImageOrder})
+}
+
+type ReorderItemImagesRequest struct {
+	Images []string `json:"images" binding:"required"`
+}
+
+// sets the display order of an item's images, the first image is the one shown in listings
+func (h *ItemHandler) ReorderItemImages(c *gin.Context) {
+	var req ReorderItemImagesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	item, ok := loadOwnedItem(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	names, err := getImageNames(c.Request.Context(), h.Blobs, item)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
+		return
+	}
+
+	// the new order has to mention every current image exactly once
+	if len(req.Images) != len(names) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Order must list every image exactly once"})
+		return
+	}
+	seen := make(map[string]bool)
+	for _, name := range req.Images {
+		if seen[name] || !containsString(names, name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Order must list every image exactly once"})
+			return
+		}
+		seen[name] = true
+	}
+
+	item.ImageOrder = req.Images
+	err = session.Store(item)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store item"})
+		return
+	}
+
+	err = session.SaveChanges()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"images": item.ImageOrder})
 }
 
 type SetAttributes struct {
@@ -238,6 +498,22 @@ func (h *ItemHandler) GetItems(c *gin.Context) {
 	q := session.QueryIndex("items/ByLocationAndAttributes")
 	q = q.WithinRadiusOf("Coordinates", radius, lat, long)
 
+	if userID, exists := c.Get("userID"); exists {
+		blockers, err := blockerIDs(session, userID.(string))
+		if err != nil {
+			fmt.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query blocks"})
+			return
+		}
+		if len(blockers) > 0 {
+			ids := make([]interface{}, len(blockers))
+			for i, id := range blockers {
+				ids[i] = id
+			}
+			q = q.Not().WhereIn("UserID", ids)
+		}
+	}
+
 	//filter for attributes on items
 	condition := c.Query("condition")
 	if condition != "" {
@@ -334,7 +610,11 @@ func (h *ItemHandler) GetItems(c *gin.Context) {
 		return
 	}
 
-	// attach the first image to each item
+	if !setItemThumbnails(c, h.Blobs, items) {
+		return // error is already added to gin context
+	}
+
+	// attach the ratings to each item
 	for _, item := range items {
 		var ratings []*models.Rating
 		ratingsQuery := session.QueryCollection("Ratings") // Adjust if you have a specific collection name for ratings
@@ -358,12 +638,6 @@ func (h *ItemHandler) GetItems(c *gin.Context) {
 
 		item.NumRatings = totalRatings
 		item.AvgRating = avgRating
-
-		attachmentData, err := getItemAttachments(c, 1, item, session)
-		if err != nil {
-			return // error is already added to gin context
-		}
-		item.Attachments = attachmentData
 	}
 
 	c.JSON(http.StatusOK, gin.H{"items": items})
@@ -410,7 +684,7 @@ func (h *ItemHandler) GetItem(c *gin.Context) {
 	item.NumRatings = totalRatings
 	item.AvgRating = avgRating
 
-	attachmentData, err := getItemAttachments(c, -1, item, session)
+	attachmentData, err := getItemImageURLs(c, h.Blobs, -1, imaging.SizeFull, item)
 	if err != nil {
 		return // error is already added to gin context
 	}
@@ -432,7 +706,7 @@ func (h *ItemHandler) DeleteItem(c *gin.Context) {
 
 	var item *models.Item
 	err = session.Load(&item, id)
-	if err != nil {
+	if err != nil || item == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
 		return
 	}
@@ -448,6 +722,29 @@ func (h *ItemHandler) DeleteItem(c *gin.Context) {
 		return
 	}
 
+	// items reserved by an accepted swap can't disappear underneath the other user
+	if item.Status == models.ItemStatusPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Item is part of a pending swap"})
+		return
+	}
+
+	// renters would be left holding bookings of an item that is gone
+	if _, err := cancelItemBookings(session, id); errors.Is(err, errItemRentedOut) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Item is out on rent, it has to be returned first"})
+		return
+	} else if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel bookings"})
+		return
+	}
+
+	// open proposals for it or offering it would point at nothing
+	if _, err := cancelItemSwaps(session, id); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel swaps"})
+		return
+	}
+
 	err = session.Delete(item)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete item"})
@@ -460,6 +757,12 @@ func (h *ItemHandler) DeleteItem(c *gin.Context) {
 		return
 	}
 
+	// the item is gone either way, images left behind only take up space
+	err = storage.DeleteAll(c.Request.Context(), h.Blobs, id)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Item deleted"})
 }
 
@@ -467,41 +770,245 @@ func (h *ItemHandler) DeleteItem(c *gin.Context) {
   Helpers
 */
 
-func getItemAttachments(c *gin.Context, count int, item *models.Item, session *ravendb.DocumentSession) ([]string, error) {
-	attachments, err := session.Advanced().Attachments().GetNames(item)
+// returns the urls of an item's images in display order at the given size, count limits how
+// many are returned and -1 returns all of them
+func getItemImageURLs(c *gin.Context, blobs storage.BlobStore, count int, size string, item *models.Item) ([]string, error) {
+	urls, err := itemImageURLs(c, blobs, count, size, item)
 	if err != nil {
+		fmt.Println(err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
 		return nil, err
 	}
+	return urls, nil
+}
+
+// same as getItemImageURLs without writing the error to the gin context
+func itemImageURLs(c *gin.Context, blobs storage.BlobStore, count int, size string, item *models.Item) ([]string, error) {
+	attachments, err := blobs.List(c.Request.Context(), item.ID)
+	if err != nil {
+		return nil, err
+	}
+	return imageURLsFromAttachments(c, attachments, count, size, item), nil
+}
+
+// sets the attachments of every item to the url of its thumbnail, listing the images of all of
+// them in one go
+func setItemThumbnails(c *gin.Context, blobs storage.BlobStore, items []*models.Item) bool {
+	itemIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		itemIDs = append(itemIDs, item.ID)
+	}
+
+	attachments, err := storage.ListMany(c.Request.Context(), blobs, itemIDs)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
+		return false
+	}
+
+	for _, item := range items {
+		item.Attachments = imageURLsFromAttachments(c, attachments[item.ID], 1, imaging.SizeThumbnail, item)
+	}
+	return true
+}
+
+// builds the urls of itemImageURLs from the already listed attachments of the item
+func imageURLsFromAttachments(c *gin.Context, attachments []storage.BlobInfo, count int, size string, item *models.Item) []string {
+	ordered := orderAttachments(attachments, item)
 
 	max := count
-	if count == -1 || count > len(attachments) {
-		max = len(attachments)
+	if count == -1 || count > len(ordered) {
+		max = len(ordered)
 	}
 
-	attachmentData := make([]string, 0, len(attachments))
-	for i, attachment := range attachments {
-		if i == max {
-			break
+	urls := make([]string, 0, max)
+	for _, attachment := range ordered[:max] {
+		served := findVariant(attachments, attachment.Name, size)
+		url := imageURL(c, served.Hash, "items", shortID(item.ID), "images", attachment.Name)
+		if served.Name != attachment.Name {
+			url += "&size=" + size
 		}
-		stream, err := session.Advanced().Attachments().Get(item, attachment.Name)
-		if err != nil {
-			continue
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// returns the images of an item in display order, images the item has no stored order for
+// (items created before images could be reordered) keep the storage order
+func orderAttachments(attachments []storage.BlobInfo, item *models.Item) []storage.BlobInfo {
+	// resized copies are served through the image they belong to
+	byName := make(map[string]storage.BlobInfo)
+	for _, attachment := range attachments {
+		if !imaging.IsVariantName(attachment.Name) {
+			byName[attachment.Name] = attachment
+		}
+	}
+
+	ordered := make([]storage.BlobInfo, 0, len(byName))
+	for _, name := range item.ImageOrder {
+		if attachment, ok := byName[name]; ok {
+			ordered = append(ordered, attachment)
+			delete(byName, name)
+		}
+	}
+	for _, attachment := range attachments {
+		if _, ok := byName[attachment.Name]; ok {
+			ordered = append(ordered, attachment)
+		}
+	}
+	return ordered
+}
+
+// returns the image names of an item in display order
+func getImageNames(ctx context.Context, blobs storage.BlobStore, item *models.Item) ([]string, error) {
+	attachments, err := blobs.List(ctx, item.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := orderAttachments(attachments, item)
+	names := make([]string, 0, len(ordered))
+	for _, attachment := range ordered {
+		names = append(names, attachment.Name)
+	}
+	return names, nil
+}
+
+// stores the uploaded images as blobs of the item and appends them to its image order, the
+// item has to be saved already and the caller saves the session again afterwards
+func storeItemImages(c *gin.Context, blobs storage.BlobStore, session *ravendb.DocumentSession, item *models.Item, files []*uploads.File) bool {
+	names, err := getImageNames(c.Request.Context(), blobs, item)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
+		return false
+	}
+
+	if !checkImageCount(c, len(names), len(files)) {
+		return false
+	}
+
+	for _, file := range files {
+		name := uniqueImageName(names, file.Name)
+		err = storeImageVariants(c.Request.Context(), blobs, item.ID, name, file)
+		if errors.Is(err, imaging.ErrUnsupportedImage) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image: " + file.Name})
+			return false
 		}
-		bytes, err := io.ReadAll(stream.Data)
-		stream.Close()
 		if err != nil {
-			continue
+			fmt.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+			return false
+		}
+		names = append(names, name)
+	}
+
+	item.ImageOrder = names
+	err = session.Store(item)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store item"})
+		return false
+	}
+	return true
+}
+
+// an item can hold at most uploads.DefaultLimits.MaxImagesPerDoc images
+func checkImageCount(c *gin.Context, existing int, added int) bool {
+	if existing+added > uploads.DefaultLimits.MaxImagesPerDoc {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("An item can have at most %d images", uploads.DefaultLimits.MaxImagesPerDoc)})
+		return false
+	}
+	return true
+}
+
+// numbers a file name like "photo-2.jpg" if the item already has an image called "photo.jpg"
+func uniqueImageName(existing []string, filename string) string {
+	if !containsString(existing, filename) {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for i := 2; ; i++ {
+		name := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if !containsString(existing, name) {
+			return name
 		}
+	}
+}
 
-		base64Encoded := base64.StdEncoding.EncodeToString(bytes)
+// validates an item the same way on creation and on update
+func validateItem(c *gin.Context, item *models.Item) bool {
+	validate := validator.New()
+	if err := validate.Struct(item); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			c.JSON(http.StatusBadRequest, gin.H{"validation error": ve.Error()})
+			return false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// the attributes present in the update replace the current ones, empty ones clear them
+func mergeAttributes(current *models.Attributes, update *UpdateAttributesRequest) {
+	for _, attribute := range []struct {
+		current *string
+		update  *string
+	}{
+		{&current.Condition, update.Condition},
+		{&current.Size, update.Size},
+		{&current.Color, update.Color},
+		{&current.ListingType, update.ListingType},
+		{&current.ItemCategory, update.ItemCategory},
+		{&current.OwnershipHistory, update.OwnershipHistory},
+		{&current.Authenticity, update.Authenticity},
+	} {
+		if attribute.update != nil {
+			*attribute.current = *attribute.update
+		}
+	}
+}
+
+// loads the item from the id url param and makes sure the current user owns it
+func loadOwnedItem(c *gin.Context, session *ravendb.DocumentSession) (*models.Item, bool) {
+	id := "items/" + c.Param("id")
+
+	var item *models.Item
+	err := session.Load(&item, id)
+	if err != nil || item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return nil, false
+	}
 
-		// add front mimetype to base64 string
-		base64Encoded = fmt.Sprintf("data:%s;base64,%s", stream.Details.ContentType, base64Encoded)
+	userID, exists := c.Get("userID")
+	if !exists || item.UserID != userID.(string) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	return item, true
+}
 
-		attachmentData = append(attachmentData, base64Encoded)
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(values []string, value string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
 	}
-	return attachmentData, nil
+	return result
 }
 
 func (h *ItemHandler) GetAttributes(c *gin.Context) {
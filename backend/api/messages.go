@@ -1,41 +1,96 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"sort"
+	"net/url"
+	"strings"
+	"swapper/auth"
+	"swapper/imaging"
 	"swapper/middleware"
 	"swapper/models"
+	"swapper/realtime"
+	"swapper/storage"
+	"swapper/uploads"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ravendb/ravendb-go-client"
 )
 
+const (
+	defaultMessageLimit = 50
+	maxMessageLimit     = 200
+	// how long the sender can still correct a message
+	messageEditWindow = 15 * time.Minute
+)
+
+// who a deleted message disappears for
+const (
+	DeleteScopeEveryone = "everyone"
+	DeleteScopeMe       = "me"
+)
+
+var (
+	errNotMessageSender  = errors.New("only the sender can change a message")
+	errEditWindowExpired = errors.New("message can no longer be edited")
+	errMessageDeleted    = errors.New("message was deleted")
+)
+
+// photos in a chat show details during a negotiation, fewer and smaller than an item's photos
+var messageUploadLimits = uploads.Limits{
+	MaxFileSize:     5 << 20,
+	MaxRequestSize:  25 << 20,
+	MaxImagesPerDoc: 4,
+	MaxPixels:       uploads.DefaultLimits.MaxPixels,
+}
+
 type MessageHandler struct {
-	Store *ravendb.DocumentStore
+	Store  *ravendb.DocumentStore
+	Blobs  storage.BlobStore
+	Hub    realtime.Hub
+	Tokens *auth.TokenService
 }
 
-func NewMessageHandler(store *ravendb.DocumentStore) *MessageHandler {
+func NewMessageHandler(store *ravendb.DocumentStore, blobs storage.BlobStore, hub realtime.Hub, tokens *auth.TokenService) *MessageHandler {
 	return &MessageHandler{
-		Store: store,
+		Store:  store,
+		Blobs:  blobs,
+		Hub:    hub,
+		Tokens: tokens,
 	}
 }
 
 func (h *MessageHandler) RegisterMessageRoutes(r *gin.Engine) {
 	messages := r.Group("/messages")
 	// Use auth middleware for all messages routes
-	messages.POST("", middleware.AuthMiddleware(), h.PostMessage)
-	messages.GET("/conversations", middleware.AuthMiddleware(), h.GetUserConversations)
-	messages.GET("", middleware.AuthMiddleware(), h.GetMessageHistory)
+	messages.POST("", middleware.AuthMiddleware(models.ScopeMessagesWrite), h.PostMessage)
+	messages.GET("/conversations", middleware.AuthMiddleware(models.ScopeMessagesRead), h.GetUserConversations)
+	messages.GET("", middleware.AuthMiddleware(models.ScopeMessagesRead), h.GetMessageHistory)
+	messages.GET("/search", middleware.AuthMiddleware(models.ScopeMessagesRead), h.SearchMessages)
+	messages.PATCH("/:id", middleware.AuthMiddleware(models.ScopeMessagesWrite), h.EditMessage)
+	messages.DELETE("/:id", middleware.AuthMiddleware(models.ScopeMessagesWrite), h.DeleteMessage)
+	messages.POST("/ws/ticket", middleware.AuthMiddleware(), h.GetSocketTicket)
+	messages.GET("/ws", middleware.SocketAuthMiddleware(), h.MessageSocket)
+	messages.GET("/:id/images", middleware.AuthMiddleware(models.ScopeMessagesRead), h.GetMessageImageURLs)
+	// <img> tags can't send the token in a header, they use the signed urls of the route above
+	messages.GET("/:id/images/:name", middleware.OptionalAuthMiddleware(models.ScopeMessagesRead), h.GetMessageImage)
 }
 
+// a message goes either to a user or to a group conversation
 type SendMessageReq struct {
-	RecipientID string `json:"recipientID" binding:"required"`
-	Text        string `json:"text" binding:"required"`
+	RecipientID    string `json:"recipientID" form:"recipientID"`
+	ConversationID string `json:"conversationID" form:"conversationID"`
+	ItemID         string `json:"itemID" form:"itemID"`
+	Text           string `json:"text" form:"text"`
 }
 
-// route for sending a message
+/*
+route for sending a message. Takes either a json body or a multipart form with the same fields
+and up to 4 photos as "images", a message needs text, photos or both
+*/
 func (h *MessageHandler) PostMessage(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
@@ -44,49 +99,249 @@ func (h *MessageHandler) PostMessage(c *gin.Context) {
 	}
 
 	var messageReq SendMessageReq
-	if err := c.ShouldBindJSON(&messageReq); err != nil {
+	var files []*uploads.File
+	if c.ContentType() == "multipart/form-data" {
+		if !parseUploadForm(c, messageUploadLimits) {
+			return // error is already added to gin context
+		}
+		if err := c.ShouldBind(&messageReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request" + err.Error()})
+			return
+		}
+
+		form, _ := c.MultipartForm()
+		if len(form.File["images"]) > messageUploadLimits.MaxImagesPerDoc {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A message can have at most %d images", messageUploadLimits.MaxImagesPerDoc)})
+			return
+		}
+		// Validate every image before anything is stored
+		var ok bool
+		files, ok = readUploadedImages(c, form.File["images"], messageUploadLimits)
+		if !ok {
+			return // error is already added to gin context
+		}
+	} else if err := c.ShouldBindJSON(&messageReq); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request" + err.Error()})
 		return
 	}
 
-	newMessage := models.Message{
-		SenderID:    userID.(string),
-		RecipientID: messageReq.RecipientID,
-		Text:        messageReq.Text,
-		SentAt:      time.Now(), //set sent at time to current time
+	if (messageReq.RecipientID == "") == (messageReq.ConversationID == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either recipientID or conversationID is required"})
+		return
 	}
 
-	session, err := h.Store.OpenSession("")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+	if strings.TrimSpace(messageReq.Text) == "" && len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A message needs text or images"})
 		return
 	}
-	defer session.Close()
 
-	err = session.Store(&newMessage)
+	newMessage := models.Message{
+		ConversationID: messageReq.ConversationID,
+		SenderID:       userID.(string),
+		RecipientID:    models.UserDocumentID(messageReq.RecipientID),
+		ItemID:         messageReq.ItemID,
+		Text:           messageReq.Text,
+		SentAt:         time.Now(), //set sent at time to current time
+	}
+
+	if newMessage.ConversationID != "" {
+		if newMessage.ItemID != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Group messages can't be about an item"})
+			return
+		}
+		if !h.checkGroupMember(c, &newMessage) {
+			return // error is already added to gin context
+		}
+	} else {
+		if newMessage.RecipientID == newMessage.SenderID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Can't send a message to yourself"})
+			return
+		}
+
+		if !h.checkRecipient(c, newMessage.RecipientID) {
+			return // error is already added to gin context
+		}
+
+		if !checkNotBlocked(c, h.Store, newMessage.SenderID, newMessage.RecipientID) {
+			return // error is already added to gin context
+		}
+
+		if newMessage.ItemID != "" && !h.checkMessageItem(c, &newMessage) {
+			return // error is already added to gin context
+		}
+	}
+
+	if len(files) > 0 && !h.storeMessageImages(c, &newMessage, files) {
+		return // error is already added to gin context
+	}
+
+	conversation, err := saveMessage(h.Store, &newMessage)
 	if err != nil {
+		if len(newMessage.Images) > 0 {
+			// nobody can reach the photos of a message that was never stored
+			if err := storage.DeleteAll(context.Background(), h.Blobs, newMessage.ID); err != nil {
+				fmt.Println(err.Error())
+			}
+		}
+		if errors.Is(err, errConversationNotFound) {
+			// removed from the group since the check above
+			c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+			return
+		}
+		fmt.Println(err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store message"})
 		return
 	}
 
-	err = session.SaveChanges()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+	// push to the other participants and to the sender's other open tabs
+	h.Hub.Publish(realtime.Event{Type: realtime.EventMessage, Data: newMessage}, conversation.ParticipantIDs...)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message sent successfully", "id": newMessage.RecipientID, "messageID": newMessage.ID, "images": newMessage.Images})
+}
+
+type EditMessageRequest struct {
+	Text string `json:"text" binding:"required"`
+}
+
+// pushed when a message is removed, for both participants or only for one of them
+type DeletedEvent struct {
+	MessageID      string `json:"messageID"`
+	ConversationID string `json:"conversationID"`
+	Scope          string `json:"scope"`
+}
+
+// replaces the text of a message, only the sender can and only shortly after sending it
+func (h *MessageHandler) EditMessage(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request, text is required"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Message sent successfully", "id": newMessage.RecipientID})
+	now := time.Now()
+	message, conversation, err := updateMessage(h.Store, "messages/"+c.Param("id"), func(message *models.Message, conversation *models.Conversation) error {
+		if !conversation.IsParticipant(userID.(string)) {
+			return errMessageNotFound
+		}
+		if message.SenderID != userID.(string) {
+			return errNotMessageSender
+		}
+		if message.DeletedAt != nil {
+			return errMessageDeleted
+		}
+		if now.Sub(message.SentAt) > messageEditWindow {
+			return errEditWindowExpired
+		}
+		message.Edit(req.Text, now)
+		return nil
+	})
+	if !checkMessageUpdate(c, err) {
+		return // error is already added to gin context
+	}
+
+	h.Hub.Publish(realtime.Event{Type: realtime.EventEdited, Data: message}, conversation.ParticipantIDs...)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
 }
 
-// route to get all user conversations for messages landing page
-// TO DO: Define conversation header model
-func (h *MessageHandler) GetUserConversations(c *gin.Context) {
+/*
+unsends a message or hides it for the current user. An unsent message is kept as a tombstone
+without its text and photos, so the other participants see that something was retracted
+
+url params:
+- scope (string): "everyone" to unsend (sender only) or "me" to hide it for yourself (default me)
+*/
+func (h *MessageHandler) DeleteMessage(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	scope := c.DefaultQuery("scope", DeleteScopeMe)
+	if scope != DeleteScopeEveryone && scope != DeleteScopeMe {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scope"})
+		return
+	}
+
+	var images []string
+	message, conversation, err := updateMessage(h.Store, "messages/"+c.Param("id"), func(message *models.Message, conversation *models.Conversation) error {
+		if !conversation.IsParticipant(userID.(string)) {
+			return errMessageNotFound
+		}
+
+		if scope == DeleteScopeMe {
+			if message.IsHiddenFor(userID.(string)) {
+				return nil
+			}
+			if message.DeletedAt == nil {
+				conversation.RemoveUnread(userID.(string), message)
+			}
+			message.Hide(userID.(string))
+			return nil
+		}
+
+		if message.SenderID != userID.(string) {
+			return errNotMessageSender
+		}
+		if message.DeletedAt != nil {
+			return errMessageDeleted
+		}
+		for _, participant := range conversation.ParticipantIDs {
+			if !message.IsHiddenFor(participant) {
+				conversation.RemoveUnread(participant, message)
+			}
+		}
+		images = message.Images
+		message.Unsend(time.Now())
+		return nil
+	})
+	if !checkMessageUpdate(c, err) {
+		return // error is already added to gin context
+	}
+
+	if len(images) > 0 {
+		// the message is a tombstone either way, photos left behind only take up space
+		if err := storage.DeleteAll(context.Background(), h.Blobs, message.ID); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+
+	event := realtime.Event{
+		Type: realtime.EventDeleted,
+		Data: DeletedEvent{MessageID: message.ID, ConversationID: message.ConversationID, Scope: scope},
+	}
+	if scope == DeleteScopeEveryone {
+		h.Hub.Publish(event, conversation.ParticipantIDs...)
+	} else {
+		h.Hub.Publish(event, userID.(string))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message deleted successfully"})
+}
+
+type MessageImageURL struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+/*
+returns urls of the photos of a message that work without the access token, for <img> tags. They
+only open this message's photos and expire after auth.ImageTokenTTL, the access token never ends
+up in a url where logs and Referer headers would keep it
+*/
+func (h *MessageHandler) GetMessageImageURLs(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
-	//limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
 
 	session, err := h.Store.OpenSession("")
 	if err != nil {
@@ -95,66 +350,141 @@ func (h *MessageHandler) GetUserConversations(c *gin.Context) {
 	}
 	defer session.Close()
 
-	var conversations []*models.Message
-	//query grabs all messages where the user is the sender or recipient, and orders by sentAt
-	q := session.QueryCollection("messages")
-	q = q.WhereEquals("senderID", userID).OrElse().WhereEquals("recipientID", userID)
-	q = q.OrderByDescending("sentAt")
+	message, ok := loadParticipantMessage(c, session, "messages/"+c.Param("id"), userID.(string))
+	if !ok {
+		return // error is already added to gin context
+	}
 
-	err = q.GetResults(&conversations)
+	token, expiresAt, err := h.Tokens.IssueImageToken(userID.(string), message.ID)
 	if err != nil {
 		fmt.Println(err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query conversations"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign image urls"})
 		return
 	}
 
-	//post process messages to only be the most recent message per conversation
-	mostRecentMessages := getMostRecentMessagePerConversation(conversations, userID.(string))
+	images := make([]MessageImageURL, 0, len(message.Images))
+	for _, name := range message.Images {
+		images = append(images, MessageImageURL{
+			Name: name,
+			URL:  fmt.Sprintf("%s/messages/%s/images/%s?sig=%s", publicBaseURL(c), url.PathEscape(shortID(message.ID)), url.PathEscape(name), url.QueryEscape(token)),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"images": images, "expiresAt": expiresAt})
+}
 
-	var filteredConversations []*models.Message
-	for _, msg := range mostRecentMessages {
-		filteredConversations = append(filteredConversations, msg)
+/*
+streams a photo sent with a message, only to the participants of its conversation
+
+url params:
+- size (string): thumbnail, medium or full (default full)
+- sig (string): the signature of a url from GET /messages/:id/images, when the access token can't
+be sent in the Authorization header
+*/
+func (h *MessageHandler) GetMessageImage(c *gin.Context) {
+	messageID := "messages/" + c.Param("id")
+	userID := c.GetString("userID")
+	if sig := c.Query("sig"); sig != "" {
+		signedFor, err := h.Tokens.VerifyImageToken(sig, messageID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Image url is invalid or expired"})
+			return
+		}
+		userID = signedFor
+	}
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
 	}
 
-	sort.Slice(filteredConversations, func(i, j int) bool {
-		return filteredConversations[i].SentAt.After(filteredConversations[j].SentAt)
-	})
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
 
-	//return filtered conversations array
-	c.JSON(http.StatusOK, gin.H{"conversations": filteredConversations})
+	// still checked for signed urls, someone who left the group can't keep loading its photos
+	message, ok := loadParticipantMessage(c, session, messageID, userID)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	name := c.Param("name")
+	if !containsString(message.Images, name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	// a shared cache could hand the photo to someone else long after the url expired
+	serveAttachment(c, h.Blobs, message.ID, name, privateAttachment)
 }
 
-// post-processing helper to filter out only the most recent message per conversation
-func getMostRecentMessagePerConversation(conversations []*models.Message, userID string) map[string]*models.Message {
-	//use a map to track the most recent message for each conversation
-	mostRecentMessages := make(map[string]*models.Message)
+/*
+route to get all user conversations for messages landing page, the latest message of each
+conversation in the inbox most recent first. GET /conversations returns the conversations themselves
 
-	for _, msg := range conversations {
-		otherParticipant := msg.SenderID
-		if msg.SenderID == userID {
-			otherParticipant = msg.RecipientID
-		}
+url params:
+- limit (int): limit the number of conversations returned (default 20, max 100)
+- before (string): a conversation id or RFC3339 timestamp, the next page is before=nextCursor
+- after (string): a conversation id or RFC3339 timestamp, only conversations active since
+*/
+func (h *MessageHandler) GetUserConversations(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
 
-		//create a sorted slice of the participant IDs to generate a consistent key
-		participants := []string{userID, otherParticipant}
-		sort.Strings(participants)
-		convoKey := fmt.Sprintf("%s-%s", participants[0], participants[1])
+	limit, ok := parseLimit(c, defaultConversationLimit, maxConversationLimit)
+	if !ok {
+		return // error is already added to gin context
+	}
 
-		//check to see if message already exists for this conversation
-		if existingMsg, exists := mostRecentMessages[convoKey]; exists {
-			//update if message is more recent
-			if msg.SentAt.After(existingMsg.SentAt) {
-				mostRecentMessages[convoKey] = msg
-			}
-		} else {
-			mostRecentMessages[convoKey] = msg
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	cursor, ok := parseConversationCursor(c, session, userID.(string))
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	conversations, nextCursor, err := queryConversations(session, userID.(string), FolderInbox, cursor, limit)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query conversations"})
+		return
+	}
+
+	filteredConversations := make([]*models.Message, 0, len(conversations))
+	for _, conversation := range conversations {
+		if conversation.LastMessage != nil && !conversation.LastMessage.IsHiddenFor(userID.(string)) {
+			filteredConversations = append(filteredConversations, conversation.LastMessage)
 		}
 	}
 
-	return mostRecentMessages
+	//return filtered conversations array
+	c.JSON(http.StatusOK, gin.H{"conversations": filteredConversations, "nextCursor": nextCursor})
 }
 
-// returns all messages between the current user and another user
+/*
+returns the messages between the current user and another user, or of a conversation the user
+takes part in (e.g. a group), a page at a time. Without a
+cursor the latest messages, the next pages go back in time with before=nextCursor. Paging with
+after instead (e.g. to catch up after reconnecting) goes forward with after=nextCursor. Every
+page is ordered oldest first, nextCursor is null on the last one
+
+url params:
+- otherUserID (string): the other user, required without conversationID
+- itemID (string): only the messages about this item
+- conversationID (string): the messages of this conversation instead
+- before (string): a message id or RFC3339 timestamp, only messages sent before it
+- after (string): a message id or RFC3339 timestamp, only messages sent after it
+- limit (int): limit the number of messages returned (default 50, max 200)
+*/
 func (h *MessageHandler) GetMessageHistory(c *gin.Context) {
 	currentUserID, exists := c.Get("userID")
 	if !exists {
@@ -162,13 +492,19 @@ func (h *MessageHandler) GetMessageHistory(c *gin.Context) {
 		return
 	}
 
-	//other user ID is a required query parameter
-	otherUserID := c.Query("otherUserID")
-	if otherUserID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing query parameter: otherUserID"})
+	//other user ID or conversation ID is a required query parameter
+	otherUserID := models.UserDocumentID(c.Query("otherUserID"))
+	conversationID := c.Query("conversationID")
+	if otherUserID == "" && conversationID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing query parameter: otherUserID or conversationID"})
 		return
 	}
 
+	limit, ok := parseLimit(c, defaultMessageLimit, maxMessageLimit)
+	if !ok {
+		return // error is already added to gin context
+	}
+
 	session, err := h.Store.OpenSession("")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
@@ -176,12 +512,49 @@ func (h *MessageHandler) GetMessageHistory(c *gin.Context) {
 	}
 	defer session.Close()
 
+	if conversationID != "" {
+		var conversation *models.Conversation
+		err = session.Load(&conversation, conversationID)
+		if err != nil || conversation == nil || !conversation.IsParticipant(currentUserID.(string)) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+			return
+		}
+	}
+
+	cursor, ok := parseCursor(c, func(id string) (*time.Time, error) {
+		var message *models.Message
+		if err := session.Load(&message, id); err != nil || message == nil {
+			return nil, err
+		}
+		// only messages of this conversation, the cursor must not reveal others
+		if conversationID != "" && message.ConversationID != conversationID {
+			return nil, nil
+		}
+		if conversationID == "" && !isMessageBetween(message, currentUserID.(string), otherUserID) {
+			return nil, nil
+		}
+		return &message.SentAt, nil
+	})
+	if !ok {
+		return // error is already added to gin context
+	}
+
 	var messages []*models.Message
-	//query for all messages between these users, ordered by the time
+	//query for the messages between these users on the page
 	q := session.QueryCollection("messages")
-	q = q.WhereEquals("senderID", currentUserID).WhereEquals("recipientID", otherUserID).OrElse().
-		WhereEquals("senderID", otherUserID).WhereEquals("recipientID", currentUserID)
-	q = q.OrderBy("sentAt")
+	if conversationID != "" {
+		q = q.WhereEquals("conversationID", conversationID)
+	} else if itemID := c.Query("itemID"); itemID != "" {
+		q = q.WhereEquals("conversationID", models.ConversationID(itemID, currentUserID.(string), otherUserID))
+	} else {
+		q = q.OpenSubclause().
+			WhereEquals("senderID", currentUserID).WhereEquals("recipientID", otherUserID).OrElse().
+			WhereEquals("senderID", otherUserID).WhereEquals("recipientID", currentUserID).
+			CloseSubclause()
+	}
+	// messages the user deleted for themselves
+	q = q.Not().WhereEquals("hiddenFor", currentUserID)
+	q = cursor.apply(q, "sentAt", limit)
 
 	err = q.GetResults(&messages)
 	if err != nil {
@@ -190,5 +563,158 @@ func (h *MessageHandler) GetMessageHistory(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"messages": messages})
+	var nextCursor *string
+	if len(messages) > limit {
+		messages = messages[:limit]
+		// the last message in query order is where the next page continues
+		nextCursor = &messages[limit-1].ID
+	}
+	if !cursor.forward() {
+		// queried newest first
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"messages": messages, "nextCursor": nextCursor})
+}
+
+// only members of a group can write to it
+func (h *MessageHandler) checkGroupMember(c *gin.Context, message *models.Message) bool {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return false
+	}
+	defer session.Close()
+
+	var conversation *models.Conversation
+	err = session.Load(&conversation, message.ConversationID)
+	if err != nil || conversation == nil || !conversation.Group || !conversation.IsParticipant(message.SenderID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return false
+	}
+	return true
+}
+
+// messages can only go to users who exist and haven't deleted their account
+func (h *MessageHandler) checkRecipient(c *gin.Context, recipientID string) bool {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return false
+	}
+	defer session.Close()
+
+	var recipient *models.User
+	err = session.Load(&recipient, recipientID)
+	if err != nil || recipient == nil || recipient.DeletedAt != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return false
+	}
+	return true
+}
+
+// a message can only be about an item one of the two participants owns
+func (h *MessageHandler) checkMessageItem(c *gin.Context, message *models.Message) bool {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return false
+	}
+	defer session.Close()
+
+	var item *models.Item
+	err = session.Load(&item, message.ItemID)
+	if err != nil || item == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return false
+	}
+
+	if item.UserID != message.SenderID && item.UserID != message.RecipientID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Item must belong to one of the participants"})
+		return false
+	}
+	return true
+}
+
+/*
+stores the photos of a new message before the message itself, under an id generated for it up
+front. The photos of a message never change, so the message is only stored once they are all there
+*/
+func (h *MessageHandler) storeMessageImages(c *gin.Context, message *models.Message, files []*uploads.File) bool {
+	id, err := h.Store.GetConventions().GenerateDocumentID("", message)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store message"})
+		return false
+	}
+	message.ID = id
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		name := uniqueImageName(names, file.Name)
+		err = storeImageVariants(c.Request.Context(), h.Blobs, message.ID, name, file)
+		if err == nil {
+			names = append(names, name)
+			continue
+		}
+
+		if err := storage.DeleteAll(context.Background(), h.Blobs, message.ID); err != nil {
+			fmt.Println(err.Error())
+		}
+		if errors.Is(err, imaging.ErrUnsupportedImage) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image: " + file.Name})
+			return false
+		}
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+		return false
+	}
+
+	message.Images = names
+	return true
+}
+
+// loads a message of a conversation the user takes part in, outsiders aren't told it exists
+func loadParticipantMessage(c *gin.Context, session *ravendb.DocumentSession, messageID string, userID string) (*models.Message, bool) {
+	var message *models.Message
+	err := session.Load(&message, messageID)
+	if err != nil || message == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return nil, false
+	}
+
+	var conversation *models.Conversation
+	err = session.Load(&conversation, message.ConversationID)
+	if err != nil || conversation == nil || !conversation.IsParticipant(userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return nil, false
+	}
+	return message, true
+}
+
+// writes the reason a message could not be changed to the gin context
+func checkMessageUpdate(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+	case errors.Is(err, errNotMessageSender):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	case errors.Is(err, errMessageDeleted):
+		c.JSON(http.StatusGone, gin.H{"error": "Message was deleted"})
+	case errors.Is(err, errEditWindowExpired):
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Messages can only be edited for %d minutes", int(messageEditWindow.Minutes()))})
+	default:
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
+	}
+	return false
+}
+
+func isMessageBetween(message *models.Message, userID string, otherUserID string) bool {
+	return (message.SenderID == userID && message.RecipientID == otherUserID) ||
+		(message.SenderID == otherUserID && message.RecipientID == userID)
 }
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"swapper/auth"
+	"swapper/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+)
+
+const (
+	oidcStateCookie   = "oidc_state"
+	oidcCallbackPath  = "/login/callback" // page of the website that receives the tokens
+	oidcTwoFactorPath = "/login/2fa"      // page of the website that asks for the code of a user with 2FA
+	usernameAttempts  = 5
+)
+
+// why a login at a provider failed, sent to the website as "error"
+const (
+	OIDCErrorDenied        = "denied"
+	OIDCErrorInvalidLogin  = "invalid_login"
+	OIDCErrorEmailRequired = "email_required"
+	OIDCErrorAccountExists = "account_exists"
+	OIDCErrorSuspended     = "suspended"
+	OIDCErrorServer        = "server_error"
+)
+
+type OIDCHandler struct {
+	Store     *ravendb.DocumentStore
+	Sessions  *auth.Sessions
+	Tokens    *auth.TokenService
+	Providers map[string]*auth.OIDCProvider
+}
+
+func NewOIDCHandler(store *ravendb.DocumentStore, sessions *auth.Sessions, tokens *auth.TokenService, providers map[string]*auth.OIDCProvider) *OIDCHandler {
+	return &OIDCHandler{
+		Store:     store,
+		Sessions:  sessions,
+		Tokens:    tokens,
+		Providers: providers,
+	}
+}
+
+func (h *OIDCHandler) RegisterOIDCRoutes(r *gin.Engine) {
+	r.GET("/auth/oidc/providers", h.GetProviders)
+	r.GET("/auth/oidc/:provider/login", h.StartLogin)
+	r.GET("/auth/oidc/:provider/callback", h.FinishLogin)
+}
+
+// returns the names of the providers users can log in with, for the login page to offer
+func (h *OIDCHandler) GetProviders(c *gin.Context) {
+	names := make([]string, 0, len(h.Providers))
+	for name := range h.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c.JSON(http.StatusOK, gin.H{"providers": names})
+}
+
+/*
+sends the browser to the provider to log in, it comes back to FinishLogin
+
+url params:
+- returnTo (string): path of the website to open once logged in (default "/")
+*/
+func (h *OIDCHandler) StartLogin(c *gin.Context) {
+	provider, ok := h.Providers[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Login provider not found"})
+		return
+	}
+
+	returnTo := c.DefaultQuery("returnTo", "/")
+	// only paths, the website must not become a redirect to anywhere
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, "\\") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid returnTo"})
+		return
+	}
+
+	redirectURL := publicBaseURL(c) + "/auth/oidc/" + provider.Name + "/callback"
+	state, authURL, err := auth.StartOIDCLogin(c.Request.Context(), h.Store, provider, redirectURL, returnTo)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reach login provider"})
+		return
+	}
+
+	// ties the login to this browser, a link to the callback sent to someone else doesn't log them in
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(auth.OIDCLoginTTL.Seconds()), "/auth/oidc", "", isSecure(c), true)
+
+	c.Redirect(http.StatusFound, authURL)
+}
+
+/*
+finishes a login at a provider and sends the browser to the website with Swapper tokens in the
+url fragment, which never reaches a server. The user is found by the provider's account, or by
+email the first time when the provider verified it, or created. Users with 2FA are sent to the
+website's code step with a twoFactorToken instead, the provider doesn't replace the second factor
+*/
+func (h *OIDCHandler) FinishLogin(c *gin.Context) {
+	provider, ok := h.Providers[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Login provider not found"})
+		return
+	}
+
+	state, _ := c.Cookie(oidcStateCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, "", -1, "/auth/oidc", "", isSecure(c), true)
+
+	if c.Query("error") != "" {
+		redirectOIDCError(c, OIDCErrorDenied)
+		return
+	}
+	if state == "" || state != c.Query("state") || c.Query("code") == "" {
+		redirectOIDCError(c, OIDCErrorInvalidLogin)
+		return
+	}
+
+	identity, login, err := auth.FinishOIDCLogin(c.Request.Context(), h.Store, provider, state, c.Query("code"))
+	if err != nil {
+		fmt.Println(err.Error())
+		redirectOIDCError(c, OIDCErrorInvalidLogin)
+		return
+	}
+
+	user, revokeSessions, errorCode, err := h.resolveUser(provider.Name, identity)
+	if err != nil {
+		fmt.Println(err.Error())
+		redirectOIDCError(c, OIDCErrorServer)
+		return
+	}
+	if errorCode != "" {
+		redirectOIDCError(c, errorCode)
+		return
+	}
+
+	if revokeSessions {
+		if err := h.Sessions.RevokeAll(user.ID); err != nil {
+			fmt.Println(err.Error())
+			redirectOIDCError(c, OIDCErrorServer)
+			return
+		}
+	}
+
+	if user.IsSuspended() {
+		redirectOIDCError(c, OIDCErrorSuspended)
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		token, expiresAt, err := h.Tokens.IssueTwoFactorToken(user)
+		if err != nil {
+			fmt.Println(err.Error())
+			redirectOIDCError(c, OIDCErrorServer)
+			return
+		}
+		fragment := url.Values{}
+		fragment.Set("twoFactorToken", token)
+		fragment.Set("expiresAt", expiresAt.Format(time.RFC3339))
+		fragment.Set("returnTo", login.ReturnTo)
+		c.Redirect(http.StatusFound, websiteURL()+oidcTwoFactorPath+"#"+fragment.Encode())
+		return
+	}
+
+	userSession, refreshToken, err := h.Sessions.Create(user.ID, c.Request.UserAgent())
+	if err != nil {
+		fmt.Println(err.Error())
+		redirectOIDCError(c, OIDCErrorServer)
+		return
+	}
+	pair, err := h.Tokens.NewTokenPair(user, userSession, refreshToken)
+	if err != nil {
+		fmt.Println(err.Error())
+		redirectOIDCError(c, OIDCErrorServer)
+		return
+	}
+
+	fragment := url.Values{}
+	fragment.Set("token", pair.Token)
+	fragment.Set("refreshToken", pair.RefreshToken)
+	fragment.Set("expiresAt", pair.ExpiresAt.Format(time.RFC3339))
+	fragment.Set("returnTo", login.ReturnTo)
+	c.Redirect(http.StatusFound, websiteURL()+oidcCallbackPath+"#"+fragment.Encode())
+}
+
+/*
+  Helpers
+*/
+
+/*
+finds the user of a provider's account, linking or creating one on the first login. Returns an
+error code for the website instead when the account can't be used. revokeSessions is set when
+linking took over an account whose email was never verified: whoever signed up with the address
+without owning it is logged out and loses the password
+*/
+func (h *OIDCHandler) resolveUser(provider string, identity *auth.OIDCIdentity) (user *models.User, revokeSessions bool, errorCode string, err error) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		return nil, false, "", err
+	}
+	defer session.Close()
+
+	now := time.Now()
+	var linked *models.Identity
+	if err := session.Load(&linked, models.IdentityID(provider, identity.Subject)); err != nil {
+		return nil, false, "", err
+	}
+	if linked != nil {
+		if err := session.Load(&user, linked.UserID); err != nil {
+			return nil, false, "", err
+		}
+		if user != nil {
+			linked.Email = identity.Email
+			if err := session.Store(linked); err != nil {
+				return nil, false, "", err
+			}
+			return user, false, "", session.SaveChanges()
+		}
+		// the user was deleted, the account starts over
+	}
+
+	if identity.Email == "" {
+		return nil, false, OIDCErrorEmailRequired, nil
+	}
+
+	var users []*models.User
+	q := session.QueryCollectionForType(reflect.TypeOf(&models.User{}))
+	q = q.WhereEquals("email", identity.Email).Take(1)
+	if err := q.GetResults(&users); err != nil {
+		return nil, false, "", err
+	}
+
+	if len(users) > 0 {
+		// an address the provider didn't verify could belong to anyone
+		if !identity.EmailVerified {
+			return nil, false, OIDCErrorAccountExists, nil
+		}
+		user = users[0]
+		if user.EmailVerifiedAt == nil {
+			user.PasswordHash = ""
+			user.EmailVerifiedAt = &now
+			revokeSessions = true
+			// a second factor they added would lock the owner of the address out
+			if user.TwoFactorEnabled {
+				user.TwoFactorEnabled = false
+				if err := session.DeleteByID(models.TwoFactorID(user.ID), ""); err != nil {
+					return nil, false, "", err
+				}
+			}
+		}
+	} else {
+		username, err := availableUsername(session, identity)
+		if err != nil {
+			return nil, false, "", err
+		}
+		user = &models.User{
+			Name:     identity.Name,
+			Email:    identity.Email,
+			Username: username,
+		}
+		if user.Name == "" {
+			user.Name = username
+		}
+		if identity.EmailVerified {
+			user.EmailVerifiedAt = &now
+		}
+	}
+	if err := session.Store(user); err != nil {
+		return nil, false, "", err
+	}
+
+	if linked == nil {
+		linked = &models.Identity{
+			ID:       models.IdentityID(provider, identity.Subject),
+			Provider: provider,
+			Subject:  identity.Subject,
+		}
+	}
+	linked.UserID = user.ID
+	linked.Email = identity.Email
+	linked.LinkedAt = now
+	if err := session.Store(linked); err != nil {
+		return nil, false, "", err
+	}
+	if err := session.SaveChanges(); err != nil {
+		return nil, false, "", err
+	}
+	return user, revokeSessions, "", nil
+}
+
+// the username the provider suggests, or the start of the email, with a number if it is taken
+func availableUsername(session *ravendb.DocumentSession, identity *auth.OIDCIdentity) (string, error) {
+	base := identity.Username
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	username := base
+	for attempt := 0; attempt < usernameAttempts; attempt++ {
+		var users []*models.User
+		q := session.QueryCollectionForType(reflect.TypeOf(&models.User{}))
+		q = q.WhereEquals("username", username).Take(1)
+		if err := q.GetResults(&users); err != nil {
+			return "", err
+		}
+		if len(users) == 0 {
+			return username, nil
+		}
+		username = base + strconv.Itoa(1000+rand.Intn(9000))
+	}
+	return "", errors.New("no free username for " + base)
+}
+
+func redirectOIDCError(c *gin.Context, code string) {
+	c.Redirect(http.StatusFound, websiteURL()+oidcCallbackPath+"#"+url.Values{"error": {code}}.Encode())
+}
+
+// whether the browser reached the api over https, cookies set over it are only sent back over it
+func isSecure(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
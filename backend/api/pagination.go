@@ -0,0 +1,153 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+)
+
+/*
+position in a list paginated by time, from the before and after url params. Each of them is
+either the id of a document from a page the client already has or a RFC3339 timestamp, and
+the zero time when not given. Documents with the same time are told apart by their id, so a
+cursor naming a document keeps its id too
+*/
+type pageCursor struct {
+	Before   time.Time
+	BeforeID string // "" when before is a plain timestamp
+	After    time.Time
+	AfterID  string
+	Skip     int // deprecated offset, only used when neither before nor after is given
+}
+
+// only after was given, the page continues forward in time from it
+func (p pageCursor) forward() bool {
+	return !p.After.IsZero() && p.Before.IsZero()
+}
+
+/*
+parses the before and after url params. timeOf returns the time of a document the cursor
+names, nil if the document doesn't exist or the user may not see it
+*/
+func parseCursor(c *gin.Context, timeOf func(id string) (*time.Time, error)) (pageCursor, bool) {
+	var cursor pageCursor
+	var ok bool
+	if cursor.Before, cursor.BeforeID, ok = parseCursorParam(c, "before", timeOf); !ok {
+		return cursor, false
+	}
+	if cursor.After, cursor.AfterID, ok = parseCursorParam(c, "after", timeOf); !ok {
+		return cursor, false
+	}
+	if !cursor.Before.IsZero() && !cursor.After.IsZero() && !cursor.After.Before(cursor.Before) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "after must be earlier than before"})
+		return cursor, false
+	}
+	return cursor, true
+}
+
+// returns the time of the cursor and the id of the document it names, "" for a timestamp
+func parseCursorParam(c *gin.Context, name string, timeOf func(id string) (*time.Time, error)) (time.Time, string, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, "", true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, "", true
+	}
+
+	t, err := timeOf(value)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cursor"})
+		return time.Time{}, "", false
+	}
+	if t == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor: " + name})
+		return time.Time{}, "", false
+	}
+	return *t, value, true
+}
+
+/*
+reads the deprecated skip url param into the cursor, an offset from the first page that misses
+or repeats documents when the list changes in between. Only allowed without before and after
+*/
+func parseSkip(c *gin.Context, cursor *pageCursor) bool {
+	value := c.Query("skip")
+	if value == "" {
+		return true
+	}
+	skip, err := strconv.Atoi(value)
+	if err != nil || skip < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip"})
+		return false
+	}
+	if !cursor.Before.IsZero() || !cursor.After.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "skip can't be combined with before or after"})
+		return false
+	}
+	c.Header("Deprecation", "true")
+	cursor.Skip = skip
+	return true
+}
+
+/*
+limits the query to the cursor's range of field and orders it from the cursor on: newest first,
+oldest first when paging forward, by id where the times are the same. Takes one more than limit
+so the caller can tell whether there is a next page
+*/
+func (p pageCursor) apply(q *ravendb.DocumentQuery, field string, limit int) *ravendb.DocumentQuery {
+	if !p.Before.IsZero() {
+		q = whereBeyond(q, field, p.Before, p.BeforeID, false)
+	}
+	if !p.After.IsZero() {
+		q = whereBeyond(q, field, p.After, p.AfterID, true)
+	}
+	// "ID" is the document id, id() in the query
+	if p.forward() {
+		q = q.OrderBy(field).OrderBy("ID")
+	} else {
+		q = q.OrderByDescending(field).OrderByDescending("ID")
+	}
+	if p.Skip > 0 {
+		q = q.Skip(p.Skip)
+	}
+	return q.Take(limit + 1)
+}
+
+// field after t when later is set, before it otherwise. Documents at t itself are compared by their id to id
+func whereBeyond(q *ravendb.DocumentQuery, field string, t time.Time, id string, later bool) *ravendb.DocumentQuery {
+	if id == "" {
+		if later {
+			return q.WhereGreaterThan(field, t)
+		}
+		return q.WhereLessThan(field, t)
+	}
+
+	q = q.OpenSubclause()
+	if later {
+		q = q.WhereGreaterThan(field, t).OrElse().
+			OpenSubclause().WhereEquals(field, t).AndAlso().WhereGreaterThan("ID", id).CloseSubclause()
+	} else {
+		q = q.WhereLessThan(field, t).OrElse().
+			OpenSubclause().WhereEquals(field, t).AndAlso().WhereLessThan("ID", id).CloseSubclause()
+	}
+	return q.CloseSubclause()
+}
+
+// reads the limit url param, values above max are lowered to max
+func parseLimit(c *gin.Context, defaultLimit int, maxLimit int) (int, bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return 0, false
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, true
+}
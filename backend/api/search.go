@@ -0,0 +1,250 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"swapper/models"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+	// characters of a snippet, and how many of them come before the first match
+	snippetLength = 160
+	snippetLead   = 40
+)
+
+// a message found by a search, with the conversation it belongs to
+type MessageSearchHit struct {
+	Message      *models.Message      `json:"message"`
+	Snippet      []SnippetPart        `json:"snippet"`
+	Conversation ConversationResponse `json:"conversation"`
+}
+
+/*
+a piece of a snippet, the parts put together are the excerpt of the message around the first
+match. Clients render the matching parts highlighted, there is no markup to escape
+*/
+type SnippetPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+/*
+searches the messages of the current user's conversations, best matches first
+
+url params:
+- q (string): the words to look for, required
+- conversationID (string): only search this conversation
+- limit (int): limit the number of messages returned (default 20, max 50)
+- skip (int): skip the first n messages (default 0)
+*/
+func (h *MessageHandler) SearchMessages(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	terms := searchTerms(c.Query("q"))
+	if len(terms) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing query parameter: q"})
+		return
+	}
+
+	limit, ok := parseLimit(c, defaultSearchLimit, maxSearchLimit)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	skip, err := strconv.Atoi(c.DefaultQuery("skip", "0"))
+	if err != nil || skip < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid skip"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	groupIDs, err := groupConversationIDs(session, userID.(string))
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query conversations"})
+		return
+	}
+
+	var messages []*models.Message
+	q := session.QueryIndex("Messages/ByText")
+	q = q.OpenSubclause().WhereEquals("ParticipantIDs", userID)
+	if len(groupIDs) > 0 {
+		q = q.OrElse().WhereIn("ConversationID", groupIDs)
+	}
+	q = q.CloseSubclause()
+	q = q.Not().WhereEquals("HiddenFor", userID)
+	if conversationID := c.Query("conversationID"); conversationID != "" {
+		q = q.WhereEquals("ConversationID", conversationID)
+	}
+	// the terms are plain words, nothing in them means anything to the query parser
+	q = q.Search("Text", strings.Join(terms, " "))
+	q = q.Skip(skip).Take(limit)
+
+	if err := q.GetResults(&messages); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search messages"})
+		return
+	}
+
+	var conversationIDs []string
+	for _, message := range messages {
+		if !containsString(conversationIDs, message.ConversationID) {
+			conversationIDs = append(conversationIDs, message.ConversationID)
+		}
+	}
+
+	conversations := make([]*models.Conversation, 0, len(conversationIDs))
+	if len(conversationIDs) > 0 {
+		loaded := make(map[string]*models.Conversation)
+		if err := session.LoadMulti(loaded, conversationIDs); err != nil {
+			fmt.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load conversations"})
+			return
+		}
+		for _, conversation := range loaded {
+			if conversation != nil {
+				conversations = append(conversations, conversation)
+			}
+		}
+	}
+
+	responses, err := conversationResponses(c, session, h.Blobs, conversations, userID.(string))
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load items"})
+		return
+	}
+	byID := make(map[string]ConversationResponse, len(responses))
+	for _, response := range responses {
+		byID[response.ID] = response
+	}
+
+	hits := make([]MessageSearchHit, 0, len(messages))
+	for _, message := range messages {
+		conversation, ok := byID[message.ConversationID]
+		if !ok {
+			continue
+		}
+		hits = append(hits, MessageSearchHit{
+			Message:      message,
+			Snippet:      highlightSnippet(message.Text, terms),
+			Conversation: conversation,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": hits})
+}
+
+/*
+  Helpers
+*/
+
+// splits a search into lower case words the way the index's analyzer does
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !isWordRune(r)
+	})
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// cuts the excerpt of the text around the first word matching a term, marking every matching word in it
+func highlightSnippet(text string, terms []string) []SnippetPart {
+	runes := []rune(text)
+
+	type span struct{ start, end int }
+	var matches []span
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && isWordRune(runes[j]) {
+			j++
+		}
+		if containsString(terms, strings.ToLower(string(runes[i:j]))) {
+			matches = append(matches, span{i, j})
+		}
+		i = j
+	}
+
+	start := 0
+	if len(matches) > 0 && matches[0].start > snippetLead {
+		start = matches[0].start - snippetLead
+		// don't start in the middle of a word
+		for start < matches[0].start && isWordRune(runes[start-1]) {
+			start++
+		}
+	}
+	end := start + snippetLength
+	if end >= len(runes) {
+		end = len(runes)
+	} else {
+		for end > start && isWordRune(runes[end]) && isWordRune(runes[end-1]) {
+			end--
+		}
+		if end == start {
+			end = start + snippetLength // one very long word
+		}
+	}
+
+	var parts []SnippetPart
+	if start > 0 {
+		parts = append(parts, SnippetPart{Text: "…"})
+	}
+	pos := start
+	for _, match := range matches {
+		if match.start < start || match.end > end {
+			continue
+		}
+		if match.start > pos {
+			parts = append(parts, SnippetPart{Text: string(runes[pos:match.start])})
+		}
+		parts = append(parts, SnippetPart{Text: string(runes[match.start:match.end]), Match: true})
+		pos = match.end
+	}
+	if pos < end {
+		parts = append(parts, SnippetPart{Text: string(runes[pos:end])})
+	}
+	if end < len(runes) {
+		parts = append(parts, SnippetPart{Text: "…"})
+	}
+	return parts
+}
+
+// returns the ids of the groups the user is a member of
+func groupConversationIDs(session *ravendb.DocumentSession, userID string) ([]interface{}, error) {
+	var conversations []*models.Conversation
+	q := session.QueryCollection("Conversations")
+	q = q.WhereEquals("participantIDs", userID).WhereEquals("group", true)
+	if err := q.GetResults(&conversations); err != nil {
+		return nil, err
+	}
+
+	ids := make([]interface{}, len(conversations))
+	for i, conversation := range conversations {
+		ids[i] = conversation.ID
+	}
+	return ids, nil
+}
@@ -0,0 +1,322 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"swapper/auth"
+	"swapper/models"
+	"swapper/realtime"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	socketWriteWait      = 10 * time.Second
+	socketPongWait       = 60 * time.Second
+	socketPingPeriod     = socketPongWait * 9 / 10
+	socketMaxFrameLength = 4096
+	socketReplyBuffer    = 8
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// same as the cors config, any origin may call the api with a token
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+/*
+frames a client sends over the socket:
+
+- {"type": "ack", "messageID": "messages/1-A"}: the message arrived, the sender is told it was delivered
+- {"type": "typing", "recipientID": "users/1-A", "typing": true}: shown to the recipient, if the two have a conversation
+and neither blocked the other
+- {"type": "typing", "conversationID": "conversations/7-A", "typing": true}: shown to the other members of a group,
+except those blocked either way
+*/
+type socketFrame struct {
+	Type           string `json:"type"`
+	MessageID      string `json:"messageID"`
+	RecipientID    string `json:"recipientID"`
+	ConversationID string `json:"conversationID"`
+	Typing         bool   `json:"typing"`
+}
+
+var (
+	errMessageNotFound  = errors.New("message not found")
+	errAlreadyDelivered = errors.New("message was delivered already")
+	errContactBlocked   = errors.New("one of the users blocked the other")
+)
+
+type DeliveredEvent struct {
+	MessageID   string    `json:"messageID"`
+	DeliveredAt time.Time `json:"deliveredAt"`
+}
+
+type TypingEvent struct {
+	UserID         string `json:"userID"`
+	ConversationID string `json:"conversationID,omitempty"` // set in groups
+	Typing         bool   `json:"typing"`
+}
+
+/*
+returns a ticket to open the websocket with as the "ticket" url param, for browsers that can't send
+the access token in a header. It works for auth.SocketTicketTTL, ask for it right before connecting
+*/
+func (h *MessageHandler) GetSocketTicket(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ticket, expiresAt, err := h.Tokens.IssueSocketTicket(&auth.Claims{
+		ID:        userID.(string),
+		Email:     c.GetString("email"),
+		Name:      c.GetString("name"),
+		SessionID: c.GetString("sessionID"),
+		Role:      c.GetString("role"),
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate ticket"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ticket": ticket, "expiresAt": expiresAt})
+}
+
+// upgrades to a websocket that pushes new messages, delivery acknowledgements and typing
+// indicators of the current user's conversations
+func (h *MessageHandler) MessageSocket(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader already answered the request
+		fmt.Println(err.Error())
+		return
+	}
+
+	subscription := h.Hub.Subscribe(userID.(string))
+	replies := make(chan realtime.Event, socketReplyBuffer)
+	done := make(chan struct{})
+	go h.readSocket(conn, subscription.UserID, replies, done)
+	writeSocket(conn, subscription, replies, done)
+}
+
+// forwards the events of the subscription and the replies to the client's own frames until
+// either side goes away, the only goroutine writing to the connection
+func writeSocket(conn *websocket.Conn, subscription *realtime.Subscription, replies chan realtime.Event, done chan struct{}) {
+	ticker := time.NewTicker(socketPingPeriod)
+	defer func() {
+		ticker.Stop()
+		subscription.Close()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events:
+			conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if !ok {
+				// dropped by the hub for falling behind
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, ""))
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case reply := <-replies:
+			conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := conn.WriteJSON(reply); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// handles the frames the client sends, closes done once the client is gone
+func (h *MessageHandler) readSocket(conn *websocket.Conn, userID string, replies chan realtime.Event, done chan struct{}) {
+	defer close(done)
+
+	reply := func(message string) {
+		select {
+		case replies <- realtime.Event{Type: realtime.EventError, Data: gin.H{"error": message}}:
+		default: // a client flooding us with bad frames doesn't need every answer
+		}
+	}
+
+	conn.SetReadLimit(socketMaxFrameLength)
+	conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var frame socketFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			reply("Invalid frame")
+			continue
+		}
+
+		switch frame.Type {
+		case "ack":
+			err := h.acknowledgeMessage(userID, frame.MessageID)
+			if errors.Is(err, errMessageNotFound) {
+				reply("Message not found")
+			} else if err != nil {
+				fmt.Println(err.Error())
+				reply("Failed to acknowledge message")
+			}
+		case "typing":
+			frame.RecipientID = models.UserDocumentID(frame.RecipientID)
+			if frame.ConversationID != "" {
+				members, err := h.typingMembers(frame.ConversationID, userID)
+				if errors.Is(err, errConversationNotFound) {
+					reply("Conversation not found")
+					continue
+				} else if err != nil {
+					fmt.Println(err.Error())
+					reply("Failed to load conversation")
+					continue
+				}
+				h.Hub.Publish(realtime.Event{
+					Type: realtime.EventTyping,
+					Data: TypingEvent{UserID: userID, ConversationID: frame.ConversationID, Typing: frame.Typing},
+				}, members...)
+				continue
+			}
+			if frame.RecipientID == "" || frame.RecipientID == userID {
+				reply("Invalid recipient")
+				continue
+			}
+			err := h.checkTypingRecipient(userID, frame.RecipientID)
+			if errors.Is(err, errConversationNotFound) {
+				reply("Conversation not found")
+				continue
+			} else if errors.Is(err, errContactBlocked) {
+				reply("You can't contact this user")
+				continue
+			} else if err != nil {
+				fmt.Println(err.Error())
+				reply("Failed to load conversations")
+				continue
+			}
+			h.Hub.Publish(realtime.Event{
+				Type: realtime.EventTyping,
+				Data: TypingEvent{UserID: userID, Typing: frame.Typing},
+			}, frame.RecipientID)
+		default:
+			reply("Unknown frame type")
+		}
+	}
+}
+
+// marks a message the user received as delivered and lets the sender know, repeated acks
+// keep the first delivery time. In a group the first member to receive it counts
+func (h *MessageHandler) acknowledgeMessage(userID string, messageID string) error {
+	if messageID == "" {
+		return errMessageNotFound
+	}
+
+	now := time.Now()
+	message, _, err := updateMessage(h.Store, messageID, func(message *models.Message, conversation *models.Conversation) error {
+		if message.SenderID == userID || !conversation.IsParticipant(userID) {
+			return errMessageNotFound
+		}
+		if message.DeliveredAt != nil {
+			return errAlreadyDelivered
+		}
+		message.DeliveredAt = &now
+		return nil
+	})
+	if errors.Is(err, errAlreadyDelivered) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	h.Hub.Publish(realtime.Event{
+		Type: realtime.EventDelivered,
+		Data: DeliveredEvent{MessageID: message.ID, DeliveredAt: now},
+	}, message.SenderID)
+	return nil
+}
+
+// returns the members of a group the user belongs to who may see them typing, members blocked
+// either way aren't told, the same as in a conversation of two
+func (h *MessageHandler) typingMembers(conversationID string, userID string) ([]string, error) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var conversation *models.Conversation
+	err = session.Load(&conversation, conversationID)
+	if err != nil || conversation == nil || !conversation.Group || !conversation.IsParticipant(userID) {
+		return nil, errConversationNotFound
+	}
+
+	blocked, err := blockedUserIDs(session, userID)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(conversation.ParticipantIDs))
+	for _, memberID := range conversation.ParticipantIDs {
+		if memberID != userID && !blocked[memberID] {
+			members = append(members, memberID)
+		}
+	}
+	return members, nil
+}
+
+// only users who take part in a conversation together and haven't blocked each other see each
+// other typing
+func (h *MessageHandler) checkTypingRecipient(userID string, recipientID string) error {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	q := session.QueryCollection("Conversations")
+	q = q.WhereEquals("participantIDs", userID).AndAlso().WhereEquals("participantIDs", recipientID)
+	shared, err := q.Any()
+	if err != nil {
+		return err
+	}
+	if !shared {
+		return errConversationNotFound
+	}
+
+	blocked, err := isBlocked(session, userID, recipientID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errContactBlocked
+	}
+	return nil
+}
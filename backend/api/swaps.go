@@ -0,0 +1,544 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"swapper/middleware"
+	"swapper/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+)
+
+type SwapHandler struct {
+	Store *ravendb.DocumentStore
+}
+
+func NewSwapHandler(store *ravendb.DocumentStore) *SwapHandler {
+	return &SwapHandler{
+		Store: store,
+	}
+}
+
+func (h *SwapHandler) RegisterSwapRoutes(r *gin.Engine) {
+	swaps := r.Group("/swaps")
+	// every swap route acts on behalf of a logged in user
+	swaps.Use(middleware.AuthMiddleware())
+
+	swaps.POST("", h.ProposeSwap)
+	swaps.GET("", h.GetSwaps)
+	swaps.GET("/:id", h.GetSwap)
+	swaps.POST("/:id/counter", h.CounterSwap)
+	swaps.POST("/:id/accept", h.AcceptSwap)
+	swaps.POST("/:id/decline", h.DeclineSwap)
+	swaps.POST("/:id/cancel", h.CancelSwap)
+	swaps.POST("/:id/complete", h.CompleteSwap)
+}
+
+var (
+	errItemNotFound    = errors.New("item not found")
+	errItemUnavailable = errors.New("one or more items are no longer available")
+	errItemNotOwned    = errors.New("offered items must belong to the proposer")
+)
+
+type ProposeSwapRequest struct {
+	TargetItemID   string   `json:"targetItemID" binding:"required"`
+	OfferedItemIDs []string `json:"offeredItemIDs" binding:"required,min=1"`
+	Message        string   `json:"message"`
+}
+
+// route for offering one or more of your own items in exchange for another user's item
+func (h *SwapHandler) ProposeSwap(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req ProposeSwapRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var target *models.Item
+	err = session.Load(&target, req.TargetItemID)
+	if err != nil || target == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	if target.UserID == userID.(string) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot propose a swap for your own item"})
+		return
+	}
+
+	if target.Status != models.ItemStatusAvailable {
+		c.JSON(http.StatusConflict, gin.H{"error": "Item is not available"})
+		return
+	}
+
+	if !checkNotBlocked(c, h.Store, userID.(string), target.UserID) {
+		return // error is already added to gin context
+	}
+
+	if err := checkOfferedItems(session, userID.(string), req.TargetItemID, req.OfferedItemIDs); err != nil {
+		respondSwapItemError(c, err)
+		return
+	}
+
+	now := time.Now()
+	proposal := models.SwapProposal{
+		ProposerID:     userID.(string),
+		OwnerID:        target.UserID,
+		TargetItemID:   req.TargetItemID,
+		OfferedItemIDs: req.OfferedItemIDs,
+		Status:         models.SwapStatusProposed,
+		AwaitingUserID: target.UserID,
+		History: []models.SwapOffer{{
+			ProposedBy:     userID.(string),
+			OfferedItemIDs: req.OfferedItemIDs,
+			Message:        req.Message,
+			CreatedAt:      now,
+		}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if err := session.Store(&proposal); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store swap"})
+		return
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"swap": proposal})
+}
+
+/*
+Returns the swaps the current user takes part in
+
+url params:
+- status (string): only return swaps with this status
+- role (string): "proposer" or "owner" to only return one side (default both)
+*/
+func (h *SwapHandler) GetSwaps(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	q := session.QueryCollection("SwapProposals")
+	switch c.Query("role") {
+	case "proposer":
+		q = q.WhereEquals("proposerID", userID)
+	case "owner":
+		q = q.WhereEquals("ownerID", userID)
+	case "":
+		q = q.OpenSubclause().WhereEquals("proposerID", userID).OrElse().WhereEquals("ownerID", userID).CloseSubclause()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	if status := c.Query("status"); status != "" {
+		q = q.AndAlso().WhereEquals("status", status)
+	}
+	q = q.OrderByDescending("updatedAt")
+
+	var swaps []*models.SwapProposal
+	if err := q.GetResults(&swaps); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query swaps"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"swaps": swaps})
+}
+
+func (h *SwapHandler) GetSwap(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	proposal, ok := loadSwapForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	c.JSON(http.StatusOK, gin.H{"swap": proposal})
+}
+
+type CounterSwapRequest struct {
+	OfferedItemIDs []string `json:"offeredItemIDs" binding:"required,min=1"`
+	Message        string   `json:"message"`
+}
+
+// replaces the offered items of an open swap, the offered items always belong to the proposer
+// so the owner counters by asking for a different selection of the proposer's items
+func (h *SwapHandler) CounterSwap(c *gin.Context) {
+	var req CounterSwapRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	proposal, ok := loadSwapForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	userID := c.GetString("userID")
+	if !proposal.IsOpen() || proposal.AwaitingUserID != userID {
+		c.JSON(http.StatusConflict, gin.H{"error": "Swap is not awaiting your response"})
+		return
+	}
+
+	if err := checkOfferedItems(session, proposal.ProposerID, proposal.TargetItemID, req.OfferedItemIDs); err != nil {
+		respondSwapItemError(c, err)
+		return
+	}
+
+	now := time.Now()
+	proposal.OfferedItemIDs = req.OfferedItemIDs
+	proposal.Status = models.SwapStatusCountered
+	proposal.AwaitingUserID = otherSwapParticipant(proposal, userID)
+	proposal.History = append(proposal.History, models.SwapOffer{
+		ProposedBy:     userID,
+		OfferedItemIDs: req.OfferedItemIDs,
+		Message:        req.Message,
+		CreatedAt:      now,
+	})
+	proposal.UpdatedAt = now
+
+	saveSwap(c, session, proposal)
+}
+
+// accepting a swap reserves every involved item, all items move from available to pending in
+// a single transaction or none of them do
+func (h *SwapHandler) AcceptSwap(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	proposal, ok := loadSwapForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	if !proposal.IsOpen() || proposal.AwaitingUserID != c.GetString("userID") {
+		c.JSON(http.StatusConflict, gin.H{"error": "Swap is not awaiting your response"})
+		return
+	}
+
+	if err := setItemsStatus(session, proposal.ItemIDs(), models.ItemStatusAvailable, models.ItemStatusPending); err != nil {
+		respondSwapItemError(c, err)
+		return
+	}
+
+	proposal.Status = models.SwapStatusAccepted
+	proposal.AwaitingUserID = ""
+	proposal.UpdatedAt = time.Now()
+
+	saveSwap(c, session, proposal)
+}
+
+func (h *SwapHandler) DeclineSwap(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	proposal, ok := loadSwapForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	if !proposal.IsOpen() || proposal.AwaitingUserID != c.GetString("userID") {
+		c.JSON(http.StatusConflict, gin.H{"error": "Swap is not awaiting your response"})
+		return
+	}
+
+	proposal.Status = models.SwapStatusDeclined
+	proposal.AwaitingUserID = ""
+	proposal.UpdatedAt = time.Now()
+
+	saveSwap(c, session, proposal)
+}
+
+// either participant can call off a swap while it is open or accepted, pending items are released
+func (h *SwapHandler) CancelSwap(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	proposal, ok := loadSwapForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	switch {
+	case proposal.IsOpen():
+	case proposal.Status == models.SwapStatusAccepted:
+		if err := setItemsStatus(session, proposal.ItemIDs(), models.ItemStatusPending, models.ItemStatusAvailable); err != nil {
+			respondSwapItemError(c, err)
+			return
+		}
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": "Swap can no longer be cancelled"})
+		return
+	}
+
+	proposal.Status = models.SwapStatusCancelled
+	proposal.AwaitingUserID = ""
+	proposal.UpdatedAt = time.Now()
+
+	saveSwap(c, session, proposal)
+}
+
+/*
+confirms for the current user that the items of an accepted swap changed hands. The swap is done
+and its items swapped once both participants have confirmed
+*/
+func (h *SwapHandler) CompleteSwap(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	proposal, ok := loadSwapForParticipant(c, session)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	if proposal.Status != models.SwapStatusAccepted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only accepted swaps can be completed"})
+		return
+	}
+
+	userID := c.GetString("userID")
+	if containsString(proposal.CompletedBy, userID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already confirmed this swap"})
+		return
+	}
+	proposal.CompletedBy = append(proposal.CompletedBy, userID)
+	proposal.AwaitingUserID = otherSwapParticipant(proposal, userID)
+
+	if containsString(proposal.CompletedBy, proposal.AwaitingUserID) {
+		if err := setItemsStatus(session, proposal.ItemIDs(), models.ItemStatusPending, models.ItemStatusSwapped); err != nil {
+			respondSwapItemError(c, err)
+			return
+		}
+		proposal.Status = models.SwapStatusCompleted
+		proposal.AwaitingUserID = ""
+	}
+	proposal.UpdatedAt = time.Now()
+
+	saveSwap(c, session, proposal)
+}
+
+/*
+  Helpers
+*/
+
+// loads the swap from the id url param and makes sure the current user takes part in it
+func loadSwapForParticipant(c *gin.Context, session *ravendb.DocumentSession) (*models.SwapProposal, bool) {
+	id := "swapproposals/" + c.Param("id")
+
+	var proposal *models.SwapProposal
+	err := session.Load(&proposal, id)
+	if err != nil || proposal == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Swap not found"})
+		return nil, false
+	}
+
+	if !proposal.IsParticipant(c.GetString("userID")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	return proposal, true
+}
+
+// stores the proposal with the change vector it was loaded with so two participants acting at
+// the same time can't both succeed, then writes the response
+func saveSwap(c *gin.Context, session *ravendb.DocumentSession, proposal *models.SwapProposal) {
+	changeVector, err := session.Advanced().GetChangeVectorFor(proposal)
+	if err != nil || changeVector == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store swap"})
+		return
+	}
+
+	if err := session.StoreWithChangeVectorAndID(proposal, *changeVector, proposal.ID); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store swap"})
+		return
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Swap or items were modified, please retry"})
+			return
+		}
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"swap": proposal})
+}
+
+// makes sure every offered item exists, belongs to the proposer and is available
+func checkOfferedItems(session *ravendb.DocumentSession, proposerID string, targetItemID string, itemIDs []string) error {
+	seen := make(map[string]bool)
+	for _, id := range itemIDs {
+		if id == targetItemID || seen[id] {
+			return errItemUnavailable
+		}
+		seen[id] = true
+
+		var item *models.Item
+		if err := session.Load(&item, id); err != nil {
+			return err
+		}
+		if item == nil {
+			return errItemNotFound
+		}
+		if item.UserID != proposerID {
+			return errItemNotOwned
+		}
+		if item.Status != models.ItemStatusAvailable {
+			return errItemUnavailable
+		}
+	}
+	return nil
+}
+
+// moves every item from one status to another in the session. Each item is stored with the change
+// vector it was loaded with, so SaveChanges fails as a whole if any item was modified concurrently
+func setItemsStatus(session *ravendb.DocumentSession, itemIDs []string, from string, to string) error {
+	for _, id := range itemIDs {
+		var item *models.Item
+		if err := session.Load(&item, id); err != nil {
+			return err
+		}
+		if item == nil {
+			return errItemNotFound
+		}
+		if item.Status != from {
+			return errItemUnavailable
+		}
+
+		changeVector, err := session.Advanced().GetChangeVectorFor(item)
+		if err != nil {
+			return err
+		}
+
+		item.Status = to
+		if err := session.StoreWithChangeVectorAndID(item, *changeVector, item.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cancels the swaps still going on for an item about to be deleted, returning how many there were
+func cancelItemSwaps(session *ravendb.DocumentSession, itemID string) (int, error) {
+	var proposals []*models.SwapProposal
+	q := session.QueryCollection("SwapProposals")
+	q = q.OpenSubclause().WhereEquals("targetItemID", itemID).OrElse().WhereEquals("offeredItemIDs", itemID).CloseSubclause()
+	q = q.WhereIn("status", []interface{}{models.SwapStatusProposed, models.SwapStatusCountered, models.SwapStatusAccepted})
+	if err := q.GetResults(&proposals); err != nil {
+		return 0, err
+	}
+	return len(proposals), cancelSwaps(session, proposals, itemID)
+}
+
+/*
+cancels the swaps in the session like CancelSwap does, releasing the items of accepted ones
+except removedIDs, which are about to be deleted
+*/
+func cancelSwaps(session *ravendb.DocumentSession, proposals []*models.SwapProposal, removedIDs ...string) error {
+	now := time.Now()
+	for _, proposal := range proposals {
+		if proposal.Status == models.SwapStatusAccepted {
+			itemIDs := proposal.ItemIDs()
+			for _, removedID := range removedIDs {
+				itemIDs = removeString(itemIDs, removedID)
+			}
+			if err := setItemsStatus(session, itemIDs, models.ItemStatusPending, models.ItemStatusAvailable); err != nil {
+				return err
+			}
+		}
+		proposal.Status = models.SwapStatusCancelled
+		proposal.AwaitingUserID = ""
+		proposal.UpdatedAt = now
+		if err := session.Store(proposal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func respondSwapItemError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errItemNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+	case errors.Is(err, errItemNotOwned):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errItemUnavailable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load items"})
+	}
+}
+
+func otherSwapParticipant(proposal *models.SwapProposal, userID string) string {
+	if userID == proposal.ProposerID {
+		return proposal.OwnerID
+	}
+	return proposal.ProposerID
+}
@@ -0,0 +1,475 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"swapper/auth"
+	"swapper/middleware"
+	"swapper/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+)
+
+type TwoFactorHandler struct {
+	Store    *ravendb.DocumentStore
+	Sessions *auth.Sessions
+	Tokens   *auth.TokenService
+	Throttle *auth.LoginThrottle
+}
+
+func NewTwoFactorHandler(store *ravendb.DocumentStore, sessions *auth.Sessions, tokens *auth.TokenService, throttle *auth.LoginThrottle) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		Store:    store,
+		Sessions: sessions,
+		Tokens:   tokens,
+		Throttle: throttle,
+	}
+}
+
+func (h *TwoFactorHandler) RegisterTwoFactorRoutes(r *gin.Engine) {
+	r.POST("/login/2fa", h.LoginTwoFactor)
+
+	group := r.Group("/user/2fa")
+	group.Use(middleware.AuthMiddleware())
+	{
+		group.GET("", h.GetTwoFactor)
+		group.POST("/enroll", h.EnrollTwoFactor)
+		group.POST("/confirm", h.ConfirmTwoFactor)
+		group.POST("/recovery-codes", h.RegenerateRecoveryCodes)
+		group.DELETE("", h.DisableTwoFactor)
+	}
+}
+
+type TwoFactorLoginRequest struct {
+	TwoFactorToken string `json:"twoFactorToken" binding:"required"`
+	Code           string `json:"code" binding:"required"` // from the authenticator app, or a recovery code
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+/*
+finishes a login with the token LoginUser returned and a code, responding with the usual tokens.
+The token works for one login, and after models.MaxFailedLoginCodes wrong codes it stops working
+and the password has to be given again, where failed logins are throttled
+*/
+func (h *TwoFactorHandler) LoginTwoFactor(c *gin.Context) {
+	var loginReq TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&loginReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	userID, issuedAt, err := h.Tokens.VerifyTwoFactorToken(loginReq.TwoFactorToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login, log in again"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var user *models.User
+	if err := session.Load(&user, userID); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login, log in again"})
+		return
+	}
+
+	twoFactor, ok := loadTwoFactor(c, session, userID)
+	if !ok {
+		return // error is already added to gin context
+	}
+	// codes are throttled together with the passwords of the email
+	ip := c.ClientIP()
+	wait, err := h.Throttle.Attempt(user.Email, ip)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+		return
+	}
+	if wait > 0 {
+		h.recordLoginFailure(c, user, models.LoginFailureLocked)
+		retryAfter := int(wait.Round(time.Second) / time.Second)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed logins, try again later", "retryAfter": retryAfter})
+		return
+	}
+
+	// a token works for one login, and not after too many wrong codes
+	if !twoFactor.AcceptsLoginToken(issuedAt) {
+		h.recordLoginFailure(c, user, models.LoginFailureLocked)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "This login can't be used anymore, log in again"})
+		return
+	}
+
+	// turned off since the password was checked, the code isn't needed anymore
+	if twoFactor.EnabledAt != nil {
+		// counted before the code is checked, like the password
+		twoFactor.CountLoginCode(time.Now())
+		if !saveTwoFactor(c, session, twoFactor) {
+			return // error is already added to gin context
+		}
+
+		if !checkTwoFactorCode(c, twoFactor, loginReq.Code) {
+			h.recordLoginFailure(c, user, models.LoginFailureWrongCode)
+			return // error is already added to gin context
+		}
+	}
+	// a request sent again with the same token fails on the change vector
+	twoFactor.UseLoginToken(issuedAt)
+	if !saveTwoFactor(c, session, twoFactor) {
+		return // error is already added to gin context
+	}
+
+	// the login is complete only now, LoginUser left its attempt counted
+	if err := h.Throttle.Succeeded(user.Email, ip); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	respondNewSession(c, h.Sessions, h.Tokens, user)
+}
+
+// tells whether the current user has 2FA on and how many recovery codes they have left
+func (h *TwoFactorHandler) GetTwoFactor(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	twoFactor, ok := loadTwoFactor(c, session, userID.(string))
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":           twoFactor.EnabledAt != nil,
+		"enabledAt":         twoFactor.EnabledAt,
+		"recoveryCodesLeft": len(twoFactor.RecoveryCodeHashes),
+	})
+}
+
+/*
+starts setting up 2FA: returns a new secret and its otpauth:// uri for the website to show as a
+QR code. Nothing changes for logging in until ConfirmTwoFactor gets a code made with it
+*/
+func (h *TwoFactorHandler) EnrollTwoFactor(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	email, _ := c.Get("email")
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	twoFactor, ok := loadTwoFactor(c, session, userID.(string))
+	if !ok {
+		return // error is already added to gin context
+	}
+	if twoFactor.EnabledAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+	twoFactor.PendingSecret = secret
+	if !saveTwoFactor(c, session, twoFactor) {
+		return // error is already added to gin context
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    auth.TOTPURI(secret, email.(string)),
+	})
+}
+
+// turns 2FA on with a code from the app the secret was added to, responding with the recovery codes
+func (h *TwoFactorHandler) ConfirmTwoFactor(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var confirmReq TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&confirmReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	twoFactor, ok := loadTwoFactor(c, session, userID.(string))
+	if !ok {
+		return // error is already added to gin context
+	}
+	if twoFactor.EnabledAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if twoFactor.PendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Enroll before confirming"})
+		return
+	}
+
+	now := time.Now()
+	step, valid := auth.ValidateTOTP(twoFactor.PendingSecret, confirmReq.Code, now, twoFactor.LastUsedStep)
+	if !valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	twoFactor.Secret = twoFactor.PendingSecret
+	twoFactor.PendingSecret = ""
+	twoFactor.LastUsedStep = step
+	twoFactor.RecoveryCodeHashes = hashes
+	twoFactor.EnabledAt = &now
+
+	var user *models.User
+	if err := session.Load(&user, userID.(string)); err != nil || user == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+	user.TwoFactorEnabled = true
+	if err := session.Store(user); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store user"})
+		return
+	}
+	if !saveTwoFactor(c, session, twoFactor) {
+		return // error is already added to gin context
+	}
+
+	// shown once, only their hashes are kept
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// replaces the recovery codes, the old ones stop working
+func (h *TwoFactorHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var codeReq TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&codeReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	twoFactor, ok := loadEnabledTwoFactor(c, session, userID.(string))
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	if !checkTwoFactorCode(c, twoFactor, codeReq.Code) {
+		return // error is already added to gin context
+	}
+	twoFactor.RecoveryCodeHashes = hashes
+	if !saveTwoFactor(c, session, twoFactor) {
+		return // error is already added to gin context
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// turns 2FA off, with a code so a stolen session alone can't
+func (h *TwoFactorHandler) DisableTwoFactor(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var codeReq TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&codeReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	twoFactor, ok := loadEnabledTwoFactor(c, session, userID.(string))
+	if !ok {
+		return // error is already added to gin context
+	}
+	if !checkTwoFactorCode(c, twoFactor, codeReq.Code) {
+		return // error is already added to gin context
+	}
+
+	var user *models.User
+	if err := session.Load(&user, userID.(string)); err != nil || user == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+	user.TwoFactorEnabled = false
+	if err := session.Store(user); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store user"})
+		return
+	}
+
+	// the step is kept, a code that was just used stays used
+	twoFactor.Secret = ""
+	twoFactor.PendingSecret = ""
+	twoFactor.RecoveryCodeHashes = nil
+	twoFactor.EnabledAt = nil
+	if !saveTwoFactor(c, session, twoFactor) {
+		return // error is already added to gin context
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+/*
+  Helpers
+*/
+
+// keeps an audit record of a refused code, failing to write it doesn't change the response
+func (h *TwoFactorHandler) recordLoginFailure(c *gin.Context, user *models.User, reason string) {
+	if err := h.Throttle.RecordFailure(user.Email, user.ID, c.ClientIP(), c.Request.UserAgent(), reason); err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// loads the user's TOTP settings, new empty ones if they never enrolled
+func loadTwoFactor(c *gin.Context, session *ravendb.DocumentSession, userID string) (*models.TwoFactor, bool) {
+	var twoFactor *models.TwoFactor
+	if err := session.Load(&twoFactor, models.TwoFactorID(userID)); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return nil, false
+	}
+	if twoFactor == nil {
+		twoFactor = &models.TwoFactor{
+			ID:     models.TwoFactorID(userID),
+			UserID: userID,
+		}
+	}
+	return twoFactor, true
+}
+
+func loadEnabledTwoFactor(c *gin.Context, session *ravendb.DocumentSession, userID string) (*models.TwoFactor, bool) {
+	twoFactor, ok := loadTwoFactor(c, session, userID)
+	if !ok {
+		return nil, false
+	}
+	if twoFactor.EnabledAt == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return nil, false
+	}
+	return twoFactor, true
+}
+
+// accepts a TOTP code or a recovery code, using it up
+func checkTwoFactorCode(c *gin.Context, twoFactor *models.TwoFactor, code string) bool {
+	step, valid := auth.ValidateTOTP(twoFactor.Secret, code, time.Now(), twoFactor.LastUsedStep)
+	if valid {
+		twoFactor.LastUsedStep = step
+		return true
+	}
+	if twoFactor.UseRecoveryCode(auth.HashRecoveryCode(code)) {
+		return true
+	}
+
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+	return false
+}
+
+// checks the code and saves that it was used
+func useTwoFactorCode(c *gin.Context, session *ravendb.DocumentSession, twoFactor *models.TwoFactor, code string) bool {
+	if !checkTwoFactorCode(c, twoFactor, code) {
+		return false
+	}
+	return saveTwoFactor(c, session, twoFactor)
+}
+
+/*
+saves the settings with the change vector they were loaded with, a code sent twice at once is
+only accepted by one of the requests
+*/
+func saveTwoFactor(c *gin.Context, session *ravendb.DocumentSession, twoFactor *models.TwoFactor) bool {
+	// settings made by loadTwoFactor aren't in the session yet, and have nothing to protect
+	var err error
+	if changeVector, cvErr := session.Advanced().GetChangeVectorFor(twoFactor); cvErr == nil && changeVector != nil {
+		err = session.StoreWithChangeVectorAndID(twoFactor, *changeVector, twoFactor.ID)
+	} else {
+		err = session.Store(twoFactor)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store two-factor settings"})
+		return false
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return false
+		}
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return false
+	}
+	return true
+}
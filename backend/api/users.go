@@ -1,40 +1,53 @@
 package api
 
 import (
-	"bytes"
-	"encoding/base64"
 	"fmt"
-	"io"
-	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
 	"reflect"
+	"strconv"
+	"swapper/auth"
+	"swapper/imaging"
+	"swapper/mail"
 	"swapper/middleware"
 	"swapper/models"
+	"swapper/storage"
+	"swapper/uploads"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/ravendb/ravendb-go-client"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type UserHandler struct {
-	Store *ravendb.DocumentStore
+	Store    *ravendb.DocumentStore
+	Blobs    storage.BlobStore
+	Sessions *auth.Sessions
+	Tokens   *auth.TokenService
+	Mailer   mail.Mailer
+	Throttle *auth.LoginThrottle
 }
 
-func NewUserHandler(store *ravendb.DocumentStore) *UserHandler {
+func NewUserHandler(store *ravendb.DocumentStore, blobs storage.BlobStore, sessions *auth.Sessions, tokens *auth.TokenService, mailer mail.Mailer, throttle *auth.LoginThrottle) *UserHandler {
 	return &UserHandler{
-		Store: store,
+		Store:    store,
+		Blobs:    blobs,
+		Sessions: sessions,
+		Tokens:   tokens,
+		Mailer:   mailer,
+		Throttle: throttle,
 	}
 }
 
+// compared against when no user has the email, so both cases take as long
+var missingUserPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("swapper"), bcrypt.DefaultCost)
+
 func (h *UserHandler) RegisterUserRoutes(r *gin.Engine) {
 	r.POST("/signup", h.SignUp)
 	r.POST("/login", h.LoginUser)
 	r.PUT("/user", middleware.AuthMiddleware(), h.UpdateUser)
 	r.GET("/users/:id", h.GetUser)
+	r.GET("/users/:id/avatar", h.GetUserAvatar)
 	r.GET("/users/:id/ratings", h.GetUserRatings)
 	r.GET("/users/:id/items", h.GetUserItems)
 }
@@ -106,23 +119,13 @@ func (h *UserHandler) SignUp(c *gin.Context) {
 		return
 	}
 
-	// then create token to send back
 	// the id should be generated by the database and assigned back on the struct
 	fmt.Println(newUser)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":    newUser.ID,
-		"email": newUser.Email,
-		"name":  newUser.Name,
-		"exp":   time.Now().Add(time.Hour * 72).Unix(),
-	})
-
-	jwt, err := token.SignedString(jwtSecret)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-		return
-	}
+	verifyUser := newUser
+	go emailUserToken(h.Store, h.Mailer, websiteURL(), &verifyUser, models.TokenPurposeVerifyEmail)
 
-	c.JSON(http.StatusOK, gin.H{"token": jwt})
+	// then create tokens to send back
+	respondNewSession(c, h.Sessions, h.Tokens, &newUser)
 }
 
 type LoginRequest struct {
@@ -130,12 +133,6 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
-var jwtSecret []byte
-
-func init() {
-	jwtSecret = []byte(os.Getenv("JWT_SECRET_TOKEN"))
-}
-
 func (h *UserHandler) LoginUser(c *gin.Context) {
 	// Parse the request body into a User struct
 	var loginReq LoginRequest
@@ -144,6 +141,22 @@ func (h *UserHandler) LoginUser(c *gin.Context) {
 		return
 	}
 
+	// counted before the password is checked, guesses sent in parallel can't all get through
+	ip := c.ClientIP()
+	wait, err := h.Throttle.Attempt(loginReq.Email, ip)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+		return
+	}
+	if wait > 0 {
+		h.recordLoginFailure(c, loginReq.Email, "", models.LoginFailureLocked)
+		retryAfter := int(wait.Round(time.Second) / time.Second)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed logins, try again later", "retryAfter": retryAfter})
+		return
+	}
+
 	// Open a session for operations against the database
 	session, err := h.Store.OpenSession("")
 	if err != nil {
@@ -166,33 +179,39 @@ func (h *UserHandler) LoginUser(c *gin.Context) {
 		return
 	}
 
+	// the same answer, after the same work, whether the email or the password was wrong
 	if len(users) == 0 {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		bcrypt.CompareHashAndPassword(missingUserPasswordHash, []byte(loginReq.Password))
+		h.recordLoginFailure(c, loginReq.Email, "", models.LoginFailureUnknownEmail)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
 	user = users[0]
 
 	// Compare the password hash with the provided password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(loginReq.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		h.recordLoginFailure(c, loginReq.Email, user.ID, models.LoginFailureWrongPassword)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":       user.ID,
-		"email":    user.Email,
-		"username": user.Username,
-		"name":     user.Name,
-		"exp":      time.Now().Add(time.Hour * 72).Unix(),
-	})
-
-	jwt, err := token.SignedString(jwtSecret)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+	// the password alone isn't enough, the code goes to /login/2fa with this token. The attempt
+	// stays counted until the code is right too
+	if user.TwoFactorEnabled {
+		token, expiresAt, err := h.Tokens.IssueTwoFactorToken(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"twoFactorRequired": true, "twoFactorToken": token, "expiresAt": expiresAt})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": jwt})
+	if err := h.Throttle.Succeeded(loginReq.Email, ip); err != nil {
+		fmt.Println(err.Error())
+	}
+
+	respondNewSession(c, h.Sessions, h.Tokens, user)
 }
 
 type UpdateUserRequest struct {
@@ -200,6 +219,8 @@ type UpdateUserRequest struct {
 	Username string `form:"username"`
 	Email    string `form:"email"`
 	Password string `form:"password"`
+	// a new password needs the current one, a stolen access token alone can't take the account
+	CurrentPassword string `form:"currentPassword"`
 }
 
 func (h *UserHandler) UpdateUser(c *gin.Context) {
@@ -209,9 +230,8 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		return
 	}
 
-	if err := c.Request.ParseMultipartForm(32 << 20); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not parse multipart form"})
-		return
+	if !parseUploadForm(c, uploads.DefaultLimits) {
+		return // error is already added to gin context
 	}
 
 	var updateUserReq UpdateUserRequest
@@ -236,10 +256,24 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		return
 	}
 
+	// checked before anything changes, a wrong password changes nothing
+	if updateUserReq.Password != "" {
+		// accounts that only log in with a provider prove they own the email with a reset link
+		if u.PasswordHash == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Set a first password with a link from POST /password/forgot"})
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(updateUserReq.CurrentPassword)); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid current password"})
+			return
+		}
+	}
+
 	if updateUserReq.Name != "" {
 		u.Name = updateUserReq.Name
 	}
 
+	emailChanged := false
 	if updateUserReq.Email != "" {
 		// check for other users with the same email
 		tp := reflect.TypeOf(&models.User{})
@@ -266,6 +300,11 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 			}
 		}
 
+		// a new address has to be verified again
+		if u.Email != updateUserReq.Email {
+			u.EmailVerifiedAt = nil
+			emailChanged = true
+		}
 		u.Email = updateUserReq.Email
 	}
 
@@ -321,80 +360,78 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		return
 	}
 
-	form, _ := c.MultipartForm()
-	files := form.File["profilePicture"]
-	if len(files) > 0 {
-		// ok we have a new pfp so we need to delete all existing attachments if any hi david
-		attachments, err := session.Advanced().Attachments().GetNames(u)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
-			return
-		}
-
-		for _, attachment := range attachments {
-			err = session.Advanced().Attachments().Delete(u, attachment.Name)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachment"})
-				return
-			}
-		}
-
-		err = session.SaveChanges()
-		if err != nil {
+	// whoever knew the old password is logged out with it, this device stays logged in
+	if updateUserReq.Password != "" {
+		if err := h.Sessions.RevokeOthers(u.ID, c.GetString("sessionID")); err != nil {
 			fmt.Println(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out sessions"})
 			return
 		}
+	}
 
-		file := files[0]
-		ext := filepath.Ext(file.Filename)
-		if ext != ".jpg" && ext != ".png" && ext != ".jpeg" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Only jpg, png, and jpeg files are allowed"})
-			return
+	if emailChanged {
+		// a copy, the response below still changes u
+		verifyUser := *u
+		go emailUserToken(h.Store, h.Mailer, websiteURL(), &verifyUser, models.TokenPurposeVerifyEmail)
+	}
+
+	form, _ := c.MultipartForm()
+	files := form.File["profilePicture"]
+	if len(files) > 0 {
+		uploaded, ok := readUploadedImages(c, files[:1], uploads.DefaultLimits)
+		if !ok {
+			return // error is already added to gin context
 		}
+		file := uploaded[0]
 
-		fileStream, err := file.Open()
+		// resize before touching the current picture so a broken upload doesn't remove it
+		variants, err := imaging.Process(file.Data)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image"})
 			return
 		}
-		defer fileStream.Close()
 
-		fileBytes, err := io.ReadAll(fileStream)
+		// ok we have a new pfp so we need to delete all existing attachments if any hi david
+		attachments, err := h.Blobs.List(c.Request.Context(), u.ID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+			fmt.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
 			return
 		}
-		fileStream.Close() // Ensure the file is closed after reading
-
-		// Prepare the base64Encoded string
-		contentType := http.DetectContentType(fileBytes)
-		base64Encoded := base64.StdEncoding.EncodeToString(fileBytes)
-		base64Encoded = fmt.Sprintf("data:%s;base64,%s", contentType, base64Encoded)
 
-		// Now, convert fileBytes back into a stream for the .Store method
-		byteReader := bytes.NewReader(fileBytes)
-		mimeType := mime.TypeByExtension(ext) // This was determined from the file extension earlier
-
-		// Store the byteReader as an attachment
-		err = session.Advanced().Attachments().Store(u, file.Filename, byteReader, mimeType)
+		// Store every size of the picture before removing the old one
+		err = putImageVariants(c.Request.Context(), h.Blobs, u.ID, file.Name, variants)
 		if err != nil {
 			fmt.Println(err.Error())
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
 			return
 		}
 
-		// Proceed to save changes
-		err = session.SaveChanges()
-		if err != nil {
-			fmt.Println(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
-			return
+		stored := make(map[string]bool)
+		for _, variant := range variants {
+			stored[imaging.VariantName(file.Name, variant.Size)] = true
 		}
 
-		u.ProfilePicture = base64Encoded
+		for _, attachment := range attachments {
+			if stored[attachment.Name] {
+				continue // just replaced
+			}
+			err = h.Blobs.Delete(c.Request.Context(), u.ID, attachment.Name)
+			if err != nil {
+				fmt.Println(err.Error())
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachment"})
+				return
+			}
+		}
 	}
 
+	profilePicture, err := getProfilePictureURL(c, h.Blobs, u)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
+		return
+	}
+	u.ProfilePicture = profilePicture
+
 	u.PasswordHash = ""
 
 	c.JSON(http.StatusOK, gin.H{"user": u})
@@ -443,39 +480,73 @@ func (h *UserHandler) GetUser(c *gin.Context) {
 		avgRating = float64(sumRatings) / float64(totalRatings)
 	}
 
-	// read attachments
-	attachments, err := session.Advanced().Attachments().GetNames(u)
+	profilePicture, err := getProfilePictureURL(c, h.Blobs, u)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
 		return
 	}
+	u.ProfilePicture = profilePicture
 
-	if len(attachments) > 0 {
-		attachment := attachments[0]
-		stream, err := session.Advanced().Attachments().Get(u, attachment.Name)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment"})
-			return
-		}
-		bytes, err := io.ReadAll(stream.Data)
-		stream.Close()
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read attachment"})
-			return
-		}
+	u.AvgRating = avgRating
+	u.NumRatings = totalRatings
+	u.PasswordHash = ""
+	c.JSON(http.StatusOK, gin.H{"user": u})
+}
 
-		base64Encoded := base64.StdEncoding.EncodeToString(bytes)
+// streams the profile picture of a user
+func (h *UserHandler) GetUserAvatar(c *gin.Context) {
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
 
-		// add front mimetype to base64 string
-		base64Encoded = fmt.Sprintf("data:%s;base64,%s", stream.Details.ContentType, base64Encoded)
+	var u *models.User
+	err = session.Load(&u, "users/"+c.Param("id"))
+	if err != nil || u == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
 
-		u.ProfilePicture = base64Encoded
+	attachments, err := h.Blobs.List(c.Request.Context(), u.ID)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment names"})
+		return
 	}
 
-	u.AvgRating = avgRating
-	u.NumRatings = totalRatings
-	u.PasswordHash = ""
-	c.JSON(http.StatusOK, gin.H{"user": u})
+	picture := findProfilePicture(attachments)
+	if picture == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User has no profile picture"})
+		return
+	}
+
+	serveAttachment(c, h.Blobs, u.ID, picture.Name, publicAttachment)
+}
+
+// returns the url of the user's profile picture, or an empty string if they have none
+func getProfilePictureURL(c *gin.Context, blobs storage.BlobStore, u *models.User) (string, error) {
+	attachments, err := blobs.List(c.Request.Context(), u.ID)
+	if err != nil {
+		return "", err
+	}
+
+	picture := findProfilePicture(attachments)
+	if picture == nil {
+		return "", nil
+	}
+	return imageURL(c, picture.Hash, "users", shortID(u.ID), "avatar"), nil
+}
+
+// the profile picture is the user's only attachment besides its resized copies
+func findProfilePicture(attachments []storage.BlobInfo) *storage.BlobInfo {
+	for i := range attachments {
+		if !imaging.IsVariantName(attachments[i].Name) {
+			return &attachments[i]
+		}
+	}
+	return nil
 }
 
 func (h *UserHandler) GetUserRatings(c *gin.Context) {
@@ -528,6 +599,10 @@ func (h *UserHandler) GetUserItems(c *gin.Context) {
 		return
 	}
 
+	if !setItemThumbnails(c, h.Blobs, items) {
+		return // error is already added to gin context
+	}
+
 	for _, item := range items {
 		var ratings []*models.Rating
 		ratingsQuery := session.QueryCollection("Ratings") // Adjust if you have a specific collection name for ratings
@@ -551,13 +626,18 @@ func (h *UserHandler) GetUserItems(c *gin.Context) {
 
 		item.NumRatings = totalRatings
 		item.AvgRating = avgRating
-
-		attachmentData, err := getItemAttachments(c, 1, item, session)
-		if err != nil {
-			return // error is already added to gin context
-		}
-		item.Attachments = attachmentData
 	}
 
 	c.JSON(http.StatusOK, gin.H{"items": items})
 }
+
+/*
+  Helpers
+*/
+
+// keeps an audit record of a refused login, failing to write it doesn't change the response
+func (h *UserHandler) recordLoginFailure(c *gin.Context, email string, userID string, reason string) {
+	if err := h.Throttle.RecordFailure(email, userID, c.ClientIP(), c.Request.UserAgent(), reason); err != nil {
+		fmt.Println(err.Error())
+	}
+}
@@ -0,0 +1,333 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"swapper/auth"
+	"swapper/mail"
+	"swapper/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ravendb/ravendb-go-client"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	mailTimeout       = 30 * time.Second
+	defaultWebsiteURL = "http://localhost:5173"
+)
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// marks the email of a user verified with the token from the link they were sent
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var verifyReq VerifyEmailRequest
+	if err := c.ShouldBindJSON(&verifyReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	userToken, user, ok := consumeUserToken(c, session, verifyReq.Token, models.TokenPurposeVerifyEmail)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	// the link was sent to an address the user has since replaced
+	if userToken.Email != user.Email {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	if user.EmailVerifiedAt == nil {
+		user.EmailVerifiedAt = userToken.UsedAt
+	}
+	if !saveUserToken(c, session, user) {
+		return // error is already added to gin context
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// sends the current user a new verification link
+func (h *AuthHandler) ResendVerificationEmail(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	var user *models.User
+	if err := session.Load(&user, userID.(string)); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email is already verified"})
+		return
+	}
+
+	go emailUserToken(h.Store, h.Mailer, websiteURL(), user, models.TokenPurposeVerifyEmail)
+
+	c.Status(http.StatusAccepted)
+}
+
+/*
+sends a password reset link to the email if a user has it. The response is the same either way,
+and the email goes out in the background so the time it takes doesn't tell either
+*/
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var forgotReq ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&forgotReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	// counted whether a user has the email or not, like logins
+	wait, err := h.ResetThrottle.Attempt(forgotReq.Email, c.ClientIP())
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check reset requests"})
+		return
+	}
+	if wait > 0 {
+		retryAfter := int(wait.Round(time.Second) / time.Second)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many reset requests, try again later", "retryAfter": retryAfter})
+		return
+	}
+
+	base := websiteURL()
+	go func() {
+		session, err := h.Store.OpenSession("")
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		defer session.Close()
+
+		var users []*models.User
+		q := session.QueryCollectionForType(reflect.TypeOf(&models.User{}))
+		q = q.WhereEquals("email", forgotReq.Email).Take(1)
+		if err := q.GetResults(&users); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if len(users) == 0 {
+			return
+		}
+		emailUserToken(h.Store, h.Mailer, base, users[0], models.TokenPurposeResetPassword)
+	}()
+
+	c.Status(http.StatusAccepted)
+}
+
+// sets a new password with the token from a reset link and logs the user out everywhere
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var resetReq ResetPasswordRequest
+	if err := c.ShouldBindJSON(&resetReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(resetReq.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	session, err := h.Store.OpenSession("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open session"})
+		return
+	}
+	defer session.Close()
+
+	userToken, user, ok := consumeUserToken(c, session, resetReq.Token, models.TokenPurposeResetPassword)
+	if !ok {
+		return // error is already added to gin context
+	}
+
+	// the other links sent before would still give the account away
+	if err := auth.RevokeUserTokens(session, user.ID, models.TokenPurposeResetPassword); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tokens"})
+		return
+	}
+
+	user.PasswordHash = string(hash)
+	// opening the link proves the user reads the email
+	if user.EmailVerifiedAt == nil && userToken.Email == user.Email {
+		user.EmailVerifiedAt = userToken.UsedAt
+	}
+	if !saveUserToken(c, session, user) {
+		return // error is already added to gin context
+	}
+
+	// whoever knew the old password is logged out with it
+	if err := h.Sessions.RevokeAll(user.ID); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out sessions"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+/*
+  Helpers
+*/
+
+// marks the token used and loads its user, responding 400 for tokens that can't be used
+func consumeUserToken(c *gin.Context, session *ravendb.DocumentSession, token string, purpose string) (*models.UserToken, *models.User, bool) {
+	userToken, err := auth.ConsumeUserToken(session, token, purpose)
+	if errors.Is(err, auth.ErrInvalidUserToken) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return nil, nil, false
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load token"})
+		return nil, nil, false
+	}
+
+	var user *models.User
+	if err := session.Load(&user, userToken.UserID); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return nil, nil, false
+	}
+	if user == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return nil, nil, false
+	}
+	return userToken, user, true
+}
+
+// saves the user with the token consumed in the session, the token only works once even when used twice at once
+func saveUserToken(c *gin.Context, session *ravendb.DocumentSession, user *models.User) bool {
+	if err := session.Store(user); err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store user"})
+		return false
+	}
+	if err := session.SaveChanges(); err != nil {
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+			return false
+		}
+		fmt.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save changes"})
+		return false
+	}
+	return true
+}
+
+// the email a kind of user token is sent in, Text gets the user's name, the link and how long it works
+type userTokenEmail struct {
+	TTL     time.Duration
+	Path    string // on the website
+	Subject string
+	Text    string
+}
+
+var userTokenEmails = map[string]userTokenEmail{
+	models.TokenPurposeVerifyEmail: {
+		TTL:     auth.EmailVerificationTTL,
+		Path:    "/verify-email",
+		Subject: "Confirm your Swapper email",
+		Text:    "Hi %s,\n\nplease confirm this is your email address by opening the link below:\n\n%s\n\nThe link works for %s. If you didn't sign up for Swapper, you can ignore this email.\n",
+	},
+	models.TokenPurposeResetPassword: {
+		TTL:     auth.PasswordResetTTL,
+		Path:    "/reset-password",
+		Subject: "Reset your Swapper password",
+		Text:    "Hi %s,\n\nsomeone asked to reset the password of your Swapper account. Choose a new one by opening the link below:\n\n%s\n\nThe link works for %s. If it wasn't you, you can ignore this email and your password stays the same.\n",
+	},
+}
+
+/*
+issues a token for the user and emails them the link to use it. Runs after the response is
+sent, so failures are only logged
+*/
+func emailUserToken(store *ravendb.DocumentStore, mailer mail.Mailer, base string, user *models.User, purpose string) {
+	email := userTokenEmails[purpose]
+	token, err := auth.IssueUserToken(store, user.ID, purpose, user.Email, email.TTL)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	link := base + email.Path + "?token=" + url.QueryEscape(token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+	err = mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: email.Subject,
+		Text:    fmt.Sprintf(email.Text, user.Name, link, describeDuration(email.TTL)),
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// "an hour", "48 hours" or "30 minutes", for emails
+func describeDuration(d time.Duration) string {
+	count, unit := int(d/time.Minute), "minute"
+	if d >= time.Hour && d%time.Hour == 0 {
+		count, unit = int(d/time.Hour), "hour"
+	}
+	switch {
+	case count == 1 && unit == "hour":
+		return "an hour"
+	case count == 1:
+		return "a minute"
+	}
+	return fmt.Sprintf("%d %ss", count, unit)
+}
+
+// the website the links in emails open, WEBSITE_URL or the local dev server
+func websiteURL() string {
+	if base := os.Getenv("WEBSITE_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	return defaultWebsiteURL
+}
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"swapper/models"
+	"time"
+
+	"github.com/ravendb/ravendb-go-client"
+)
+
+const (
+	// tells API keys apart from access tokens in the Authorization header
+	APIKeyPrefix    = "swp_"
+	apiKeyShownSize = len(APIKeyPrefix) + 6
+	// last use is written at most this often, not on every request
+	apiKeyUsageInterval = time.Minute
+)
+
+var (
+	ErrInvalidAPIKey  = errors.New("API key is invalid, expired or revoked")
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// APIKeys keeps the personal API keys of users in RavenDB
+type APIKeys struct {
+	Store *ravendb.DocumentStore
+}
+
+func NewAPIKeys(store *ravendb.DocumentStore) *APIKeys {
+	return &APIKeys{
+		Store: store,
+	}
+}
+
+// IsAPIKey reports whether a bearer token is an API key rather than an access token
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// Create makes a key for the user and returns it with the key itself, which isn't stored
+func (k *APIKeys) Create(userID string, name string, scopes []string, expiresAt *time.Time) (*models.APIKey, string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	key := APIKeyPrefix + secret
+
+	session, err := k.Store.OpenSession("")
+	if err != nil {
+		return nil, "", err
+	}
+	defer session.Close()
+
+	apiKey := &models.APIKey{
+		ID:        apiKeyID(key),
+		UserID:    userID,
+		Name:      name,
+		Prefix:    key[:apiKeyShownSize],
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	if err := session.Store(apiKey); err != nil {
+		return nil, "", err
+	}
+	if err := session.SaveChanges(); err != nil {
+		return nil, "", err
+	}
+	return apiKey, key, nil
+}
+
+// List returns the user's keys, revoked ones included, newest first
+func (k *APIKeys) List(userID string) ([]*models.APIKey, error) {
+	session, err := k.Store.OpenSession("")
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var keys []*models.APIKey
+	q := session.QueryCollectionForType(reflect.TypeOf(&models.APIKey{}))
+	q = q.WaitForNonStaleResults(0).WhereEquals("userID", userID).OrderByDescending("createdAt")
+	if err := q.GetResults(&keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Revoke stops one of the user's keys from working, ErrAPIKeyNotFound if they have no such key
+func (k *APIKeys) Revoke(userID string, keyID string) (*models.APIKey, error) {
+	session, err := k.Store.OpenSession("")
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var apiKey *models.APIKey
+	if err := session.Load(&apiKey, keyID); err != nil {
+		return nil, err
+	}
+	if apiKey == nil || apiKey.UserID != userID {
+		return nil, ErrAPIKeyNotFound
+	}
+	if apiKey.RevokedAt != nil {
+		return apiKey, nil
+	}
+
+	now := time.Now()
+	apiKey.RevokedAt = &now
+	if err := session.Store(apiKey); err != nil {
+		return nil, err
+	}
+	return apiKey, session.SaveChanges()
+}
+
+/*
+VerifyAPIKey returns an active key and its user. Keys of users who were suspended or deleted
+their account stop working with them. The use is only noted by RecordAPIKeyUse, once the key
+turned out to open the route
+*/
+func (k *APIKeys) VerifyAPIKey(key string) (*models.APIKey, *models.User, error) {
+	if !IsAPIKey(key) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	session, err := k.Store.OpenSession("")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer session.Close()
+
+	var apiKey *models.APIKey
+	if err := session.Load(&apiKey, apiKeyID(key)); err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if apiKey == nil || !apiKey.IsActive(now) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	var user *models.User
+	if err := session.Load(&user, apiKey.UserID); err != nil {
+		return nil, nil, err
+	}
+	if user == nil || user.IsSuspended() || user.DeletedAt != nil {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	return apiKey, user, nil
+}
+
+/*
+RecordAPIKeyUse notes that a key from VerifyAPIKey was used, at most once per apiKeyUsageInterval.
+The key is stored with the change vector it was loaded with, a key revoked or used at the same
+time keeps what the other request wrote: a revoked key is never made active again
+*/
+func (k *APIKeys) RecordAPIKeyUse(apiKey *models.APIKey) error {
+	now := time.Now()
+	if apiKey.LastUsedAt != nil && now.Sub(*apiKey.LastUsedAt) < apiKeyUsageInterval {
+		return nil
+	}
+
+	session, err := k.Store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var stored *models.APIKey
+	if err := session.Load(&stored, apiKey.ID); err != nil {
+		return err
+	}
+	if stored == nil || stored.RevokedAt != nil {
+		return nil
+	}
+	changeVector, err := session.Advanced().GetChangeVectorFor(stored)
+	if err != nil || changeVector == nil {
+		return errors.New("no change vector for " + stored.ID)
+	}
+
+	stored.LastUsedAt = &now
+	if err := session.StoreWithChangeVectorAndID(stored, *changeVector, stored.ID); err != nil {
+		return err
+	}
+	err = session.SaveChanges()
+	var concurrencyErr *ravendb.ConcurrencyError
+	if errors.As(err, &concurrencyErr) {
+		return nil
+	}
+	return err
+}
+
+func apiKeyID(key string) string {
+	return "apikeys/" + hashSecret(key)
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+	minRSAKeyBits  = 2048
+)
+
+var (
+	ErrNoSigningKey   = errors.New("no signing key configured")
+	ErrUnsupportedKey = errors.New("unsupported key type")
+)
+
+/*
+Key is a key tokens are signed or verified with. Keys without a private part only verify, they
+are kept after a rotation until the tokens signed with them have expired
+*/
+type Key struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer // nil for keys that only verify
+	Public    crypto.PublicKey
+}
+
+// NewKey wraps an RSA or Ed25519 private or public key, picking the algorithm from its type
+func NewKey(id string, key interface{}) (*Key, error) {
+	if id == "" {
+		return nil, errors.New("key without an id")
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("key %s: RSA keys need at least %d bits", id, minRSAKeyBits)
+		}
+		return &Key{ID: id, Algorithm: AlgorithmRS256, Private: k, Public: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("key %s: RSA keys need at least %d bits", id, minRSAKeyBits)
+		}
+		return &Key{ID: id, Algorithm: AlgorithmRS256, Public: k}, nil
+	case ed25519.PrivateKey:
+		return &Key{ID: id, Algorithm: AlgorithmEdDSA, Private: k, Public: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &Key{ID: id, Algorithm: AlgorithmEdDSA, Public: k}, nil
+	default:
+		return nil, fmt.Errorf("%w: key %s is a %T", ErrUnsupportedKey, id, key)
+	}
+}
+
+/*
+LoadKeys reads every .pem file of a directory, the file name without the extension is the key id.
+Files can hold a PKCS#8 or PKCS#1 private key, or a PKIX public key for keys that only verify
+*/
+func LoadKeys(dir string) ([]*Key, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	keys := make([]*Key, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := parseKey(id, data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseKey(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s: no PEM block", id)
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: key %s is a %s", ErrUnsupportedKey, id, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", id, err)
+	}
+	return NewKey(id, key)
+}
+
+// a public key in the format of RFC 7517, as served on /.well-known/jwks.json
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"` // OKP keys
+	X         string `json:"x,omitempty"`   // OKP keys
+	N         string `json:"n,omitempty"`   // RSA keys
+	E         string `json:"e,omitempty"`   // RSA keys
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public part of the key
+func (k *Key) JWK() JWK {
+	jwk := JWK{
+		KeyID:     k.ID,
+		Algorithm: k.Algorithm,
+		Use:       "sig",
+	}
+	switch public := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return jwk
+}
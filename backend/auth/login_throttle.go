@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"errors"
+	"swapper/models"
+	"time"
+
+	"github.com/ravendb/ravendb-go-client"
+)
+
+// how many failed logins are let through before waiting, and how the wait grows after that
+type LoginLimit struct {
+	FreeFailures int
+	BaseDelay    time.Duration // the wait after the first failure past the free ones, doubled by each next one
+	MaxDelay     time.Duration
+}
+
+var (
+	AccountLoginLimit = LoginLimit{FreeFailures: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour}
+	// many users can share an address, it gets more room than an account
+	IPLoginLimit = LoginLimit{FreeFailures: 20, BaseDelay: 30 * time.Second, MaxDelay: time.Hour}
+	// every reset link is an email in someone's inbox, a few are enough to get one that arrives
+	AccountPasswordResetLimit = LoginLimit{FreeFailures: 3, BaseDelay: 5 * time.Minute, MaxDelay: 24 * time.Hour}
+	IPPasswordResetLimit      = LoginLimit{FreeFailures: 10, BaseDelay: time.Minute, MaxDelay: 24 * time.Hour}
+)
+
+const (
+	// failures this old are forgotten
+	loginFailuresTTL      = 24 * time.Hour
+	maxLoginCountAttempts = 5
+)
+
+/*
+LoginThrottle limits password guessing against an account and from an IP address. Failures are
+counted by email whether a user has it or not, so a lockout tells nothing about which emails
+exist
+*/
+type LoginThrottle struct {
+	Store        *ravendb.DocumentStore
+	AccountLimit LoginLimit
+	IPLimit      LoginLimit
+	accountID    func(email string) string
+	addressID    func(ip string) string
+}
+
+func NewLoginThrottle(store *ravendb.DocumentStore) *LoginThrottle {
+	return &LoginThrottle{
+		Store:        store,
+		AccountLimit: AccountLoginLimit,
+		IPLimit:      IPLoginLimit,
+		accountID:    models.LoginAttemptsForEmail,
+		addressID:    models.LoginAttemptsForIP,
+	}
+}
+
+// NewPasswordResetThrottle limits the reset links asked for an email and from an IP address, every request counts
+func NewPasswordResetThrottle(store *ravendb.DocumentStore) *LoginThrottle {
+	return &LoginThrottle{
+		Store:        store,
+		AccountLimit: AccountPasswordResetLimit,
+		IPLimit:      IPPasswordResetLimit,
+		accountID:    models.PasswordResetAttemptsForEmail,
+		addressID:    models.PasswordResetAttemptsForIP,
+	}
+}
+
+/*
+Attempt counts a login against the email and the IP address before its password is checked. It
+returns how long to wait when either of them is locked, the attempt isn't counted then
+*/
+func (t *LoginThrottle) Attempt(email string, ip string) (time.Duration, error) {
+	for attempt := 1; ; attempt++ {
+		wait, err := t.tryAttempt(email, ip)
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) && attempt < maxLoginCountAttempts {
+			continue
+		}
+		return wait, err
+	}
+}
+
+func (t *LoginThrottle) tryAttempt(email string, ip string) (time.Duration, error) {
+	session, err := t.Store.OpenSession("")
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	account, err := loadLoginAttempts(session, t.accountID(email))
+	if err != nil {
+		return 0, err
+	}
+	address, err := loadLoginAttempts(session, t.addressID(ip))
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	wait := lockedFor(account, now)
+	if addressWait := lockedFor(address, now); addressWait > wait {
+		wait = addressWait
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	countFailure(account, t.AccountLimit, now)
+	countFailure(address, t.IPLimit, now)
+	if err := storeLoginAttempts(session, account); err != nil {
+		return 0, err
+	}
+	if err := storeLoginAttempts(session, address); err != nil {
+		return 0, err
+	}
+	return 0, session.SaveChanges()
+}
+
+/*
+Succeeded takes back the attempt of a login whose password was right. The account starts over,
+the address only loses this attempt so a user logging in doesn't clear the guesses of others
+behind the same address
+*/
+func (t *LoginThrottle) Succeeded(email string, ip string) error {
+	for attempt := 1; ; attempt++ {
+		err := t.trySucceeded(email, ip)
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) && attempt < maxLoginCountAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+func (t *LoginThrottle) trySucceeded(email string, ip string) error {
+	session, err := t.Store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	account, err := loadLoginAttempts(session, t.accountID(email))
+	if err != nil {
+		return err
+	}
+	if changeVector, err := session.Advanced().GetChangeVectorFor(account); err == nil && changeVector != nil {
+		if err := session.DeleteByID(account.ID, *changeVector); err != nil {
+			return err
+		}
+	}
+
+	address, err := loadLoginAttempts(session, t.addressID(ip))
+	if err != nil {
+		return err
+	}
+	if address.Failures > 0 {
+		// the lock shortens with the count, it was set for one failure more
+		address.Failures--
+		lockAfterFailures(address, t.IPLimit)
+		if err := storeLoginAttempts(session, address); err != nil {
+			return err
+		}
+	}
+	return session.SaveChanges()
+}
+
+// RecordFailure keeps an audit record of a refused login, reason is one of models.LoginFailure*
+func (t *LoginThrottle) RecordFailure(email string, userID string, ip string, userAgent string, reason string) error {
+	session, err := t.Store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	failure := &models.LoginFailure{
+		Email:     email,
+		UserID:    userID,
+		IP:        ip,
+		UserAgent: userAgent,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+	if err := session.Store(failure); err != nil {
+		return err
+	}
+	return session.SaveChanges()
+}
+
+// loads the attempts with the id, new empty ones if there were none
+func loadLoginAttempts(session *ravendb.DocumentSession, id string) (*models.LoginAttempts, error) {
+	var attempts *models.LoginAttempts
+	if err := session.Load(&attempts, id); err != nil {
+		return nil, err
+	}
+	if attempts == nil {
+		attempts = &models.LoginAttempts{ID: id}
+	}
+	return attempts, nil
+}
+
+/*
+stores the attempts with the change vector they were loaded with so parallel logins can't count
+over each other. New ones have none, only the first logins of a burst can race
+*/
+func storeLoginAttempts(session *ravendb.DocumentSession, attempts *models.LoginAttempts) error {
+	if changeVector, err := session.Advanced().GetChangeVectorFor(attempts); err == nil && changeVector != nil {
+		return session.StoreWithChangeVectorAndID(attempts, *changeVector, attempts.ID)
+	}
+	return session.Store(attempts)
+}
+
+func lockedFor(attempts *models.LoginAttempts, at time.Time) time.Duration {
+	if attempts.LockedUntil == nil || !at.Before(*attempts.LockedUntil) {
+		return 0
+	}
+	return attempts.LockedUntil.Sub(at)
+}
+
+func countFailure(attempts *models.LoginAttempts, limit LoginLimit, at time.Time) {
+	if at.Sub(attempts.LastFailureAt) > loginFailuresTTL {
+		attempts.Failures = 0
+		attempts.LockedUntil = nil
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = at
+	lockAfterFailures(attempts, limit)
+}
+
+// locks from the last failure for as long as the failures counted call for, or unlocks
+func lockAfterFailures(attempts *models.LoginAttempts, limit LoginLimit) {
+	over := attempts.Failures - limit.FreeFailures
+	if over <= 0 {
+		attempts.LockedUntil = nil
+		return
+	}
+	delay := limit.MaxDelay
+	// past 2^20 the shift would only ever hit the maximum, or overflow
+	if over <= 20 && limit.BaseDelay<<(over-1) < limit.MaxDelay {
+		delay = limit.BaseDelay << (over - 1)
+	}
+	lockedUntil := attempts.LastFailureAt.Add(delay)
+	attempts.LockedUntil = &lockedUntil
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"swapper/models"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ravendb/ravendb-go-client"
+	"golang.org/x/oauth2"
+)
+
+// how long the user has to log in at the provider
+const OIDCLoginTTL = 10 * time.Minute
+
+var (
+	ErrInvalidOIDCLogin = errors.New("login is unknown, expired or already finished")
+	ErrInvalidIDToken   = errors.New("invalid id token")
+)
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+/*
+OIDCProvider is an OpenID Connect issuer users can log in with. Its discovery document is fetched
+on first use, so the server starts even while the issuer is down
+*/
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for public clients, PKCE protects the code either way
+	Scopes       []string
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// what the issuer vouches for about a user
+type OIDCIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Username      string
+}
+
+/*
+LoadOIDCProviders creates the providers listed in OIDC_PROVIDERS (comma separated names) from
+environment variables, for a provider named "corp":
+
+  - OIDC_CORP_ISSUER: issuer url, the discovery document is at <issuer>/.well-known/openid-configuration
+  - OIDC_CORP_CLIENT_ID, OIDC_CORP_CLIENT_SECRET: the client registered with the issuer
+  - OIDC_CORP_SCOPES: scopes besides openid (default "email profile")
+*/
+func LoadOIDCProviders() (map[string]*OIDCProvider, error) {
+	providers := make(map[string]*OIDCProvider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !providerNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid login provider name %q", name)
+		}
+
+		env := func(key string) string {
+			return os.Getenv("OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_" + key)
+		}
+		provider := &OIDCProvider{
+			Name:         name,
+			Issuer:       env("ISSUER"),
+			ClientID:     env("CLIENT_ID"),
+			ClientSecret: env("CLIENT_SECRET"),
+			Scopes:       strings.Fields(env("SCOPES")),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			return nil, fmt.Errorf("login provider %s needs an issuer and a client id", name)
+		}
+		if len(provider.Scopes) == 0 {
+			provider.Scopes = []string{"email", "profile"}
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// a failed discovery is tried again on the next login
+	if p.provider == nil {
+		provider, err := oidc.NewProvider(ctx, p.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		p.provider = provider
+	}
+	return p.provider, nil
+}
+
+func (p *OIDCProvider) config(provider *oidc.Provider, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, p.Scopes...),
+	}
+}
+
+// AuthCodeURL returns where to send the user to log in, the issuer sends them back to redirectURL
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, redirectURL string, state string, nonce string, verifier string) (string, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return p.config(provider, redirectURL).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange trades the code the issuer sent the user back with for their verified identity
+func (p *OIDCProvider) Exchange(ctx context.Context, redirectURL string, code string, nonce string, verifier string) (*OIDCIdentity, error) {
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := p.config(provider, redirectURL).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: the token response has none", ErrInvalidIDToken)
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: p.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	// the token was issued for the login this browser started, not replayed from another one
+	if idToken.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce doesn't match", ErrInvalidIDToken)
+	}
+
+	var claims struct {
+		Email             string      `json:"email"`
+		EmailVerified     interface{} `json:"email_verified"` // some issuers send "true"
+		Name              string      `json:"name"`
+		PreferredUsername string      `json:"preferred_username"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	return &OIDCIdentity{
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified == true || claims.EmailVerified == "true",
+		Name:          claims.Name,
+		Username:      claims.PreferredUsername,
+	}, nil
+}
+
+// StartOIDCLogin remembers a new login at the provider and returns its state and the url to send the user to
+func StartOIDCLogin(ctx context.Context, store *ravendb.DocumentStore, provider *OIDCProvider, redirectURL string, returnTo string) (string, string, error) {
+	state, err := newSecret()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := newSecret()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx, redirectURL, state, nonce, verifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	session, err := store.OpenSession("")
+	if err != nil {
+		return "", "", err
+	}
+	defer session.Close()
+
+	login := &models.OIDCLogin{
+		ID:          oidcLoginID(state),
+		Provider:    provider.Name,
+		Nonce:       nonce,
+		Verifier:    verifier,
+		RedirectURL: redirectURL,
+		ReturnTo:    returnTo,
+		ExpiresAt:   time.Now().Add(OIDCLoginTTL),
+	}
+	if err := session.Store(login); err != nil {
+		return "", "", err
+	}
+	if err := session.SaveChanges(); err != nil {
+		return "", "", err
+	}
+	return state, authURL, nil
+}
+
+/*
+FinishOIDCLogin ends the login the state was sent for, it can only be finished once, and exchanges
+the code for the user's identity
+*/
+func FinishOIDCLogin(ctx context.Context, store *ravendb.DocumentStore, provider *OIDCProvider, state string, code string) (*OIDCIdentity, *models.OIDCLogin, error) {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer session.Close()
+
+	var login *models.OIDCLogin
+	if err := session.Load(&login, oidcLoginID(state)); err != nil {
+		return nil, nil, err
+	}
+	if login == nil || login.Provider != provider.Name || !time.Now().Before(login.ExpiresAt) {
+		return nil, nil, ErrInvalidOIDCLogin
+	}
+
+	changeVector, err := session.Advanced().GetChangeVectorFor(login)
+	if err != nil || changeVector == nil {
+		return nil, nil, errors.New("no change vector for " + login.ID)
+	}
+	if err := session.DeleteByID(login.ID, *changeVector); err != nil {
+		return nil, nil, err
+	}
+	if err := session.SaveChanges(); err != nil {
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) {
+			return nil, nil, ErrInvalidOIDCLogin
+		}
+		return nil, nil, err
+	}
+
+	identity, err := provider.Exchange(ctx, login.RedirectURL, code, login.Nonce, login.Verifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	return identity, login, nil
+}
+
+func oidcLoginID(state string) string {
+	return "oidclogins/" + hashSecret(state)
+}
@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"swapper/models"
+	"time"
+
+	"github.com/ravendb/ravendb-go-client"
+)
+
+const (
+	// how long a device stays logged in without using the app
+	RefreshTokenTTL     = 30 * 24 * time.Hour
+	refreshSecretLength = 32
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+	// a refresh token was used after it had been replaced, the session is revoked
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+/*
+Sessions keeps the logged in devices of users in RavenDB. A refresh token is "<session>.<secret>",
+the session part finds the document and the secret proves the caller got the token from us
+*/
+type Sessions struct {
+	Store *ravendb.DocumentStore
+}
+
+func NewSessions(store *ravendb.DocumentStore) *Sessions {
+	return &Sessions{
+		Store: store,
+	}
+}
+
+// Create starts a session for the user and returns it with its first refresh token
+func (s *Sessions) Create(userID string, userAgent string) (*models.Session, string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	session, err := s.Store.OpenSession("")
+	if err != nil {
+		return nil, "", err
+	}
+	defer session.Close()
+
+	now := time.Now()
+	userSession := &models.Session{
+		UserID:     userID,
+		TokenHash:  hashSecret(secret),
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(RefreshTokenTTL),
+	}
+	if err := session.Store(userSession); err != nil {
+		return nil, "", err
+	}
+	if err := session.SaveChanges(); err != nil {
+		return nil, "", err
+	}
+
+	return userSession, refreshToken(userSession.ID, secret), nil
+}
+
+/*
+Refresh replaces a refresh token with a new one, extending the session. Presenting the token
+the last refresh replaced revokes the session: either the client or whoever stole the token
+already refreshed, and there is no telling which one is asking
+*/
+func (s *Sessions) Refresh(token string) (*models.Session, string, error) {
+	sessionID, secret, ok := parseRefreshToken(token)
+	if !ok {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	session, err := s.Store.OpenSession("")
+	if err != nil {
+		return nil, "", err
+	}
+	defer session.Close()
+
+	var userSession *models.Session
+	if err := session.Load(&userSession, sessionID); err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	if userSession == nil || !userSession.IsActive(now) {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	hash := hashSecret(secret)
+	if userSession.PreviousTokenHash != "" && equalHashes(hash, userSession.PreviousTokenHash) {
+		userSession.RevokedAt = &now
+		if err := session.Store(userSession); err != nil {
+			return nil, "", err
+		}
+		if err := session.SaveChanges(); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrRefreshTokenReused
+	}
+	if !equalHashes(hash, userSession.TokenHash) {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	nextSecret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	userSession.PreviousTokenHash = userSession.TokenHash
+	userSession.TokenHash = hashSecret(nextSecret)
+	userSession.LastUsedAt = now
+	userSession.ExpiresAt = now.Add(RefreshTokenTTL)
+
+	// two refreshes with the same token at once, only one of them gets a new token
+	changeVector, err := session.Advanced().GetChangeVectorFor(userSession)
+	if err != nil || changeVector == nil {
+		return nil, "", errors.New("no change vector for " + userSession.ID)
+	}
+	if err := session.StoreWithChangeVectorAndID(userSession, *changeVector, userSession.ID); err != nil {
+		return nil, "", err
+	}
+	if err := session.SaveChanges(); err != nil {
+		var concurrencyErr *ravendb.ConcurrencyError
+		if errors.As(err, &concurrencyErr) {
+			return nil, "", ErrInvalidRefreshToken
+		}
+		return nil, "", err
+	}
+
+	return userSession, refreshToken(userSession.ID, nextSecret), nil
+}
+
+// Revoke logs a device out, its refresh token and access tokens stop working
+func (s *Sessions) Revoke(sessionID string) error {
+	session, err := s.Store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var userSession *models.Session
+	if err := session.Load(&userSession, sessionID); err != nil {
+		return err
+	}
+	if userSession == nil || userSession.RevokedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	userSession.RevokedAt = &now
+	if err := session.Store(userSession); err != nil {
+		return err
+	}
+	return session.SaveChanges()
+}
+
+// RevokeAll logs the user out of every device
+func (s *Sessions) RevokeAll(userID string) error {
+	return s.RevokeOthers(userID, "")
+}
+
+// RevokeOthers logs the user out of every device but the one of the session
+func (s *Sessions) RevokeOthers(userID string, keepSessionID string) error {
+	session, err := s.Store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var sessions []*models.Session
+	q := session.QueryCollection("Sessions")
+	q = q.WaitForNonStaleResults(0)
+	q = q.WhereEquals("userID", userID).Not().WhereExists("revokedAt")
+	if err := q.GetResults(&sessions); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, userSession := range sessions {
+		if userSession.ID == keepSessionID {
+			continue
+		}
+		userSession.RevokedAt = &now
+		if err := session.Store(userSession); err != nil {
+			return err
+		}
+	}
+	return session.SaveChanges()
+}
+
+// IsRevoked reports whether access tokens of the session must be refused
+func (s *Sessions) IsRevoked(sessionID string) (bool, error) {
+	session, err := s.Store.OpenSession("")
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+
+	var userSession *models.Session
+	if err := session.Load(&userSession, sessionID); err != nil {
+		return false, err
+	}
+	return userSession == nil || !userSession.IsActive(time.Now()), nil
+}
+
+func newSecret() (string, error) {
+	secret := make([]byte, refreshSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// the secrets are random, a plain hash is enough to keep a database leak from handing them out
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func equalHashes(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// "sessions/12-A" and its secret become "12-A.<secret>"
+func refreshToken(sessionID string, secret string) string {
+	return strings.TrimPrefix(sessionID, "sessions/") + "." + secret
+}
+
+func parseRefreshToken(token string) (string, string, bool) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" || strings.Contains(id, "/") {
+		return "", "", false
+	}
+	return "sessions/" + id, secret, true
+}
@@ -0,0 +1,332 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"swapper/models"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// access tokens are checked against their session on every request, but keeping them short
+	// limits what a copied one is good for
+	AccessTokenTTL = 15 * time.Minute
+	// time to type the code after the password
+	TwoFactorTokenTTL = 5 * time.Minute
+	// long enough to load a conversation's photos, short enough that a logged url soon stops working
+	ImageTokenTTL = 10 * time.Minute
+	// only has to last until the websocket is opened right after it was asked for
+	SocketTicketTTL  = 30 * time.Second
+	defaultIssuer    = "swapper"
+	purposeTwoFactor = "2fa"
+	purposeImage     = "image"
+	purposeSocket    = "socket"
+)
+
+var (
+	ErrUnknownKey   = errors.New("token signed with an unknown key")
+	ErrTokenPurpose = errors.New("token can't be used for this")
+)
+
+// the claims of a Swapper access token
+type Claims struct {
+	ID       string `json:"id"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	// the session the token was issued for, logging it out revokes the token
+	SessionID string `json:"sid"`
+	// the user's role when the token was issued, empty for models.RoleUser
+	Role string `json:"role,omitempty"`
+	// set on tokens that aren't access tokens, "2fa" for a login waiting for its second factor,
+	// "image" for the photos of one message and "socket" for opening a websocket
+	Purpose string `json:"purpose,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// a logged in user's tokens, as returned by signup, login and refresh
+type TokenPair struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refreshToken"`
+	ExpiresAt    time.Time `json:"expiresAt"` // when token expires and has to be refreshed
+}
+
+/*
+TokenService signs and verifies access tokens. Tokens are signed with one key and name it in
+their "kid" header, every other key keeps verifying the tokens it signed so keys can be rotated
+without logging anyone out
+*/
+type TokenService struct {
+	Issuer  string
+	signing *Key
+	keys    map[string]*Key
+}
+
+func NewTokenService(issuer string, keys []*Key, signingKeyID string) (*TokenService, error) {
+	s := &TokenService{
+		Issuer: issuer,
+		keys:   make(map[string]*Key, len(keys)),
+	}
+	for _, key := range keys {
+		if _, ok := s.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %s", key.ID)
+		}
+		s.keys[key.ID] = key
+	}
+
+	// a single private key signs without having to be named
+	if signingKeyID == "" {
+		for _, key := range keys {
+			if key.Private == nil {
+				continue
+			}
+			if signingKeyID != "" {
+				return nil, fmt.Errorf("%w: several private keys, pick one with JWT_SIGNING_KEY_ID", ErrNoSigningKey)
+			}
+			signingKeyID = key.ID
+		}
+	}
+
+	s.signing = s.keys[signingKeyID]
+	if s.signing == nil || s.signing.Private == nil {
+		return nil, ErrNoSigningKey
+	}
+	return s, nil
+}
+
+/*
+LoadTokenService creates the TokenService from environment variables, failing when there is no
+key to sign with:
+
+  - JWT_KEYS_DIR: directory of the keys, see LoadKeys
+  - JWT_SIGNING_KEY_ID: key new tokens are signed with, needed when there are several private keys
+  - JWT_ISSUER: "iss" of the tokens (default "swapper")
+*/
+func LoadTokenService() (*TokenService, error) {
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		return nil, fmt.Errorf("%w: JWT_KEYS_DIR is not set", ErrNoSigningKey)
+	}
+	keys, err := LoadKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := os.Getenv("JWT_ISSUER")
+	if issuer == "" {
+		issuer = defaultIssuer
+	}
+	return NewTokenService(issuer, keys, os.Getenv("JWT_SIGNING_KEY_ID"))
+}
+
+// IssueAccessToken signs a token for the user, "sid" names the session it belongs to
+func (s *TokenService) IssueAccessToken(user *models.User, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(AccessTokenTTL)
+	claims := &Claims{
+		ID:        user.ID,
+		Email:     user.Email,
+		Username:  user.Username,
+		Name:      user.Name,
+		SessionID: sessionID,
+		Role:      user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.Issuer,
+			Subject:   user.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	signed, err := s.sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// NewTokenPair signs an access token for the session and pairs it with the session's refresh token
+func (s *TokenService) NewTokenPair(user *models.User, session *models.Session, refreshToken string) (*TokenPair, error) {
+	token, expiresAt, err := s.IssueAccessToken(user, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+/*
+IssueTwoFactorToken signs a token saying the user gave the right password, to exchange together
+with a code for access tokens. It doesn't work as an access token
+*/
+func (s *TokenService) IssueTwoFactorToken(user *models.User) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(TwoFactorTokenTTL)
+	claims := &Claims{
+		ID:      user.ID,
+		Purpose: purposeTwoFactor,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.Issuer,
+			Subject:   user.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	signed, err := s.sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// Verify checks an access token and returns its claims
+func (s *TokenService) Verify(tokenString string) (*Claims, error) {
+	claims, err := s.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, ErrTokenPurpose
+	}
+	return claims, nil
+}
+
+// VerifyTwoFactorToken checks a token from IssueTwoFactorToken and returns the id of its user and when it was issued
+func (s *TokenService) VerifyTwoFactorToken(tokenString string) (string, time.Time, error) {
+	claims, err := s.parse(tokenString)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if claims.Purpose != purposeTwoFactor || claims.IssuedAt == nil {
+		return "", time.Time{}, ErrTokenPurpose
+	}
+	return claims.ID, claims.IssuedAt.Time, nil
+}
+
+/*
+IssueImageToken signs a token that lets the user load the photos of one message, for urls of <img>
+tags that can't send the access token. It doesn't work as an access token
+*/
+func (s *TokenService) IssueImageToken(userID string, messageID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ImageTokenTTL)
+	claims := &Claims{
+		ID:      userID,
+		Purpose: purposeImage,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.Issuer,
+			Subject:   messageID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	signed, err := s.sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// VerifyImageToken checks a token from IssueImageToken was issued for the message and returns its user
+func (s *TokenService) VerifyImageToken(tokenString string, messageID string) (string, error) {
+	claims, err := s.parse(tokenString)
+	if err != nil {
+		return "", err
+	}
+	if claims.Purpose != purposeImage || claims.Subject != messageID {
+		return "", ErrTokenPurpose
+	}
+	return claims.ID, nil
+}
+
+/*
+IssueSocketTicket signs a ticket that opens a websocket for the session of an access token, for
+the url of the websocket where browsers can't set headers. It expires within seconds and doesn't
+work as an access token
+*/
+func (s *TokenService) IssueSocketTicket(claims *Claims) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(SocketTicketTTL)
+	ticket := &Claims{
+		ID:        claims.ID,
+		Email:     claims.Email,
+		Username:  claims.Username,
+		Name:      claims.Name,
+		SessionID: claims.SessionID,
+		Role:      claims.Role,
+		Purpose:   purposeSocket,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.Issuer,
+			Subject:   claims.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	signed, err := s.sign(ticket)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// VerifySocketTicket checks a ticket from IssueSocketTicket and returns the claims it carries
+func (s *TokenService) VerifySocketTicket(ticket string) (*Claims, error) {
+	claims, err := s.parse(ticket)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purposeSocket {
+		return nil, ErrTokenPurpose
+	}
+	return claims, nil
+}
+
+func (s *TokenService) sign(claims *Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(s.signing.Algorithm), claims)
+	token.Header["kid"] = s.signing.ID
+	return token.SignedString(s.signing.Private)
+}
+
+// checks the signature, expiry and issuer of a token and returns its claims
+func (s *TokenService) parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := s.keys[kid]
+		if key == nil {
+			return nil, ErrUnknownKey
+		}
+		// the header can't pick another algorithm than the key's, or a public key could be used as an HMAC secret
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("key %s doesn't sign %s tokens", kid, token.Method.Alg())
+		}
+		return key.Public, nil
+	},
+		jwt.WithValidMethods([]string{AlgorithmRS256, AlgorithmEdDSA}),
+		jwt.WithIssuer(s.Issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// JWKS returns the public keys, for other services to verify tokens with
+func (s *TokenService) JWKS() JWKSet {
+	set := JWKSet{Keys: make([]JWK, 0, len(s.keys))}
+	for _, key := range s.keys {
+		set.Keys = append(set.Keys, key.JWK())
+	}
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].KeyID < set.Keys[j].KeyID
+	})
+	return set
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the parameters every authenticator app supports (RFC 6238 defaults)
+const (
+	totpDigits     = 6
+	totpPeriod     = 30 * time.Second
+	totpSkew       = 1 // steps before and after the current one that are accepted, for clocks that are off
+	totpSecretSize = 20
+	totpIssuer     = "Swapper"
+
+	RecoveryCodeCount  = 10
+	recoveryCodeGroups = 4
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random base32 secret to share with the user's authenticator app
+func NewTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth:// uri authenticator apps read from a QR code
+func TOTPURI(secret string, account string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	label := url.PathEscape(totpIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+/*
+ValidateTOTP checks a code against the secret at the given time. It returns the time step the code
+belongs to, codes of steps up to lastStep are refused so a code can't be used twice
+*/
+func ValidateTOTP(secret string, code string, at time.Time, lastStep int64) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := at.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// the code of a time step (RFC 4226 dynamic truncation)
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+/*
+NewRecoveryCodes returns codes that each replace a TOTP code once, like "k7qd-2m4x-pw9a-c3ne", and
+their hashes to store. 80 random bits make a plain hash enough
+*/
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 10)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(base32NoPadding.EncodeToString(random))
+		groups := make([]string, 0, recoveryCodeGroups)
+		for len(encoded) > 0 {
+			size := len(encoded) / (recoveryCodeGroups - len(groups))
+			groups = append(groups, encoded[:size])
+			encoded = encoded[size:]
+		}
+		codes[i] = strings.Join(groups, "-")
+		hashes[i] = HashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode hashes a recovery code as typed, ignoring case, spaces and dashes
+func HashRecoveryCode(code string) string {
+	normalized := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"errors"
+	"reflect"
+	"swapper/models"
+	"time"
+
+	"github.com/ravendb/ravendb-go-client"
+)
+
+const (
+	EmailVerificationTTL = 48 * time.Hour
+	// reset links give the account away, they don't last long
+	PasswordResetTTL = time.Hour
+)
+
+var ErrInvalidUserToken = errors.New("token is invalid, expired or already used")
+
+// IssueUserToken creates a single use token for the user, to send to email
+func IssueUserToken(store *ravendb.DocumentStore, userID string, purpose string, email string, ttl time.Duration) (string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+
+	session, err := store.OpenSession("")
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	now := time.Now()
+	userToken := &models.UserToken{
+		ID:        userTokenID(secret),
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := session.Store(userToken); err != nil {
+		return "", err
+	}
+	if err := session.SaveChanges(); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+/*
+ConsumeUserToken marks the token used in the session and returns it. Nothing is saved: the caller
+saves it together with what the token allows, and a token used twice at once fails one of the
+saves with a *ravendb.ConcurrencyError
+*/
+func ConsumeUserToken(session *ravendb.DocumentSession, token string, purpose string) (*models.UserToken, error) {
+	if token == "" {
+		return nil, ErrInvalidUserToken
+	}
+
+	var userToken *models.UserToken
+	if err := session.Load(&userToken, userTokenID(token)); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if userToken == nil || userToken.Purpose != purpose || userToken.UsedAt != nil || !now.Before(userToken.ExpiresAt) {
+		return nil, ErrInvalidUserToken
+	}
+
+	userToken.UsedAt = &now
+	changeVector, err := session.Advanced().GetChangeVectorFor(userToken)
+	if err != nil || changeVector == nil {
+		return nil, errors.New("no change vector for " + userToken.ID)
+	}
+	if err := session.StoreWithChangeVectorAndID(userToken, *changeVector, userToken.ID); err != nil {
+		return nil, err
+	}
+	return userToken, nil
+}
+
+/*
+RevokeUserTokens marks the user's unused tokens of a purpose used in the session, for the caller
+to save with the one that was consumed: once a reset link worked, the others sent before stop
+working
+*/
+func RevokeUserTokens(session *ravendb.DocumentSession, userID string, purpose string) error {
+	var userTokens []*models.UserToken
+	q := session.QueryCollectionForType(reflect.TypeOf(&models.UserToken{}))
+	q = q.WhereEquals("userID", userID).WhereEquals("purpose", purpose).WaitForNonStaleResults(0)
+	if err := q.GetResults(&userTokens); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, userToken := range userTokens {
+		if userToken.UsedAt == nil && now.Before(userToken.ExpiresAt) {
+			userToken.UsedAt = &now
+		}
+	}
+	return nil
+}
+
+func userTokenID(token string) string {
+	return "usertokens/" + hashSecret(token)
+}
@@ -0,0 +1,145 @@
+/*
+migrateblobs copies the images of every document from one storage backend to another.
+
+The source is configured like the server (STORAGE_BACKEND, STORAGE_LOCAL_DIR, STORAGE_S3_*), the
+target with the same variables prefixed with MIGRATE_TO_. Moving the images out of RavenDB into
+MinIO looks like:
+
+	MIGRATE_TO_STORAGE_BACKEND=s3 \
+	MIGRATE_TO_STORAGE_S3_ENDPOINT=localhost:9000 \
+	MIGRATE_TO_STORAGE_S3_BUCKET=swapper \
+	MIGRATE_TO_STORAGE_S3_ACCESS_KEY=minioadmin \
+	MIGRATE_TO_STORAGE_S3_SECRET_KEY=minioadmin \
+	go run ./cmd/migrateblobs -delete
+
+after which the server is started with the MIGRATE_TO_ variables as its STORAGE_ ones. Blobs the
+target already has are skipped, so an interrupted run can simply be started again.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"swapper/storage"
+
+	"github.com/ravendb/ravendb-go-client"
+)
+
+// collections whose documents have blobs
+var prefixes = []string{"items/", "users/", "messages/"}
+
+const pageSize = 100
+
+func main() {
+	url := flag.String("url", "http://localhost:8080", "RavenDB server url")
+	database := flag.String("database", "swapper", "RavenDB database")
+	deleteSource := flag.Bool("delete", false, "delete blobs from the source once they are copied")
+	dryRun := flag.Bool("dry-run", false, "only print what would be copied")
+	flag.Parse()
+
+	store := ravendb.NewDocumentStore([]string{*url}, *database)
+	if err := store.Initialize(); err != nil {
+		log.Fatalf("Failed to initialize document store: %v", err)
+	}
+	defer store.Close()
+
+	from, err := storage.New(store, "")
+	if err != nil {
+		log.Fatalf("Failed to initialize source storage: %v", err)
+	}
+	to, err := storage.New(store, "MIGRATE_TO_")
+	if err != nil {
+		log.Fatalf("Failed to initialize target storage: %v", err)
+	}
+
+	ctx := context.Background()
+	copied, skipped := 0, 0
+	for _, prefix := range prefixes {
+		err := forEachDocument(store, prefix, func(docID string) error {
+			c, s, err := migrateDocument(ctx, from, to, docID, *deleteSource, *dryRun)
+			copied += c
+			skipped += s
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Failed to migrate %s: %v", prefix, err)
+		}
+	}
+
+	fmt.Printf("Copied %d blobs, skipped %d already in the target\n", copied, skipped)
+}
+
+// copies the blobs of one document, returning how many were copied and skipped
+func migrateDocument(ctx context.Context, from storage.BlobStore, to storage.BlobStore, docID string, deleteSource bool, dryRun bool) (int, int, error) {
+	blobs, err := from.List(ctx, docID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(blobs) == 0 {
+		return 0, 0, nil
+	}
+
+	existing, err := to.List(ctx, docID)
+	if err != nil {
+		return 0, 0, err
+	}
+	inTarget := make(map[string]bool)
+	for _, blob := range existing {
+		inTarget[blob.Name] = true
+	}
+
+	copied, skipped := 0, 0
+	for _, blob := range blobs {
+		if inTarget[blob.Name] {
+			skipped++
+		} else {
+			fmt.Printf("%s %s (%d bytes)\n", docID, blob.Name, blob.Size)
+			if !dryRun {
+				if err := storage.Copy(ctx, from, to, docID, blob.Name); err != nil {
+					return copied, skipped, fmt.Errorf("%s %s: %w", docID, blob.Name, err)
+				}
+			}
+			copied++
+		}
+
+		if deleteSource && !dryRun {
+			if err := from.Delete(ctx, docID, blob.Name); err != nil {
+				return copied, skipped, fmt.Errorf("%s %s: %w", docID, blob.Name, err)
+			}
+		}
+	}
+	return copied, skipped, nil
+}
+
+// calls fn with the id of every document whose id starts with prefix
+func forEachDocument(store *ravendb.DocumentStore, prefix string, fn func(docID string) error) error {
+	for start := 0; ; start += pageSize {
+		cmd, err := ravendb.NewGetDocumentsCommandFull(prefix, "", "", "", start, pageSize, true)
+		if err != nil {
+			return err
+		}
+		if err := store.GetRequestExecutor("").ExecuteCommand(cmd, nil); err != nil {
+			return err
+		}
+		if cmd.Result == nil || len(cmd.Result.Results) == 0 {
+			return nil
+		}
+
+		for _, document := range cmd.Result.Results {
+			metadata, _ := document["@metadata"].(map[string]interface{})
+			docID, _ := metadata["@id"].(string)
+			if docID == "" {
+				continue
+			}
+			if err := fn(docID); err != nil {
+				return err
+			}
+		}
+
+		if len(cmd.Result.Results) < pageSize {
+			return nil
+		}
+	}
+}
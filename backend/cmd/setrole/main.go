@@ -0,0 +1,77 @@
+/*
+setrole gives the user with an email a role, which is how the first admin is made. Admins can
+change the roles of other users through the admin API afterwards, but not of other admins:
+
+	go run ./cmd/setrole -email you@example.com -role admin
+
+The user's sessions are revoked, they log in again with the new role.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"reflect"
+	"swapper/auth"
+	"swapper/models"
+
+	"github.com/ravendb/ravendb-go-client"
+)
+
+func main() {
+	url := flag.String("url", "http://localhost:8080", "RavenDB server url")
+	database := flag.String("database", "swapper", "RavenDB database")
+	email := flag.String("email", "", "email of the user")
+	role := flag.String("role", "", "user, moderator or admin")
+	flag.Parse()
+
+	if *email == "" || !models.IsRole(*role) {
+		flag.Usage()
+		log.Fatal("an email and a role of user, moderator or admin are required")
+	}
+
+	store := ravendb.NewDocumentStore([]string{*url}, *database)
+	if err := store.Initialize(); err != nil {
+		log.Fatalf("Failed to initialize document store: %v", err)
+	}
+	defer store.Close()
+
+	userID, err := setRole(store, *email, *role)
+	if err != nil {
+		log.Fatalf("Failed to set role: %v", err)
+	}
+	if err := auth.NewSessions(store).RevokeAll(userID); err != nil {
+		log.Fatalf("Failed to log out sessions: %v", err)
+	}
+
+	fmt.Printf("%s (%s) is now %s\n", *email, userID, *role)
+}
+
+func setRole(store *ravendb.DocumentStore, email string, role string) (string, error) {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var users []*models.User
+	q := session.QueryCollectionForType(reflect.TypeOf(&models.User{}))
+	q = q.WhereEquals("email", email).Take(1)
+	if err := q.GetResults(&users); err != nil {
+		return "", err
+	}
+	if len(users) == 0 {
+		return "", fmt.Errorf("no user has the email %s", email)
+	}
+
+	user := users[0]
+	user.Role = role
+	if role == models.RoleUser {
+		user.Role = ""
+	}
+	if err := session.Store(user); err != nil {
+		return "", err
+	}
+	return user.ID, session.SaveChanges()
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"log"
+	"swapper/models"
+
+	ravendb "github.com/ravendb/ravendb-go-client"
+)
+
+const (
+	conversationsBackfilledID = "migrations/conversations"
+	backfillPageSize          = 256
+)
+
+type migrationMarker struct {
+	Done bool `json:"done"`
+}
+
+/*
+BackfillConversations creates the conversation documents for messages sent before conversations
+existed and links the messages to them. Runs once, a marker document remembers it is done.
+Old messages count as read, there is no way to tell which ones were.
+*/
+func BackfillConversations(store *ravendb.DocumentStore) error {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	var marker *migrationMarker
+	err = session.Load(&marker, conversationsBackfilledID)
+	session.Close()
+	if err != nil {
+		return err
+	}
+	if marker != nil && marker.Done {
+		return nil
+	}
+
+	conversations := make(map[string]*models.Conversation)
+	linked := 0
+	for {
+		// every page links its messages, so the next query starts with the remaining ones
+		n, err := backfillMessagePage(store, conversations)
+		if err != nil {
+			return err
+		}
+		linked += n
+		if n < backfillPageSize {
+			break
+		}
+	}
+
+	session, err = store.OpenSession("")
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	for _, conversation := range conversations {
+		var existing *models.Conversation
+		if err := session.Load(&existing, conversation.ID); err != nil {
+			return err
+		}
+		if existing != nil {
+			continue // a message was sent to it since the server started
+		}
+		if err := session.Store(conversation); err != nil {
+			return err
+		}
+	}
+	if err := session.StoreWithID(&migrationMarker{Done: true}, conversationsBackfilledID); err != nil {
+		return err
+	}
+	if err := session.SaveChanges(); err != nil {
+		return err
+	}
+
+	log.Printf("Backfilled %d conversations from %d messages", len(conversations), linked)
+	return nil
+}
+
+// links a page of oldest messages without a conversation, returns how many there were
+func backfillMessagePage(store *ravendb.DocumentStore, conversations map[string]*models.Conversation) (int, error) {
+	session, err := store.OpenSession("")
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	var messages []*models.Message
+	q := session.QueryCollection("messages")
+	q = q.WaitForNonStaleResults(0)
+	q = q.WhereEquals("conversationID", "").OrElse().Not().WhereExists("conversationID")
+	q = q.OrderBy("sentAt")
+	q = q.Take(backfillPageSize)
+	if err := q.GetResults(&messages); err != nil {
+		return 0, err
+	}
+
+	for _, message := range messages {
+		message.ConversationID = models.ConversationID(message.ItemID, message.SenderID, message.RecipientID)
+
+		conversation, ok := conversations[message.ConversationID]
+		if !ok {
+			conversation = models.NewConversation(message.ItemID, message.SenderID, message.RecipientID)
+			conversation.CreatedAt = message.SentAt
+			conversations[message.ConversationID] = conversation
+		}
+		conversation.AddMessage(message)
+		for _, participant := range conversation.ParticipantIDs {
+			conversation.MarkRead(participant, message.SentAt)
+		}
+
+		if err := session.Store(message); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := session.SaveChanges(); err != nil {
+		return 0, err
+	}
+	return len(messages), nil
+}
@@ -14,13 +14,14 @@ import (
 	"reflect"
 	"strings"
 	"swapper/models"
+	"swapper/storage"
 	"time"
 
 	"github.com/brianvoe/gofakeit/v7"
 	"github.com/ravendb/ravendb-go-client"
 )
 
-func Seed(store *ravendb.DocumentStore) {
+func Seed(store *ravendb.DocumentStore, blobs storage.BlobStore) {
 	PRODUCTS_ZIP := "db/seeding/datasets/products.zip"
 	REVIEWS_ZIP := "db/seeding/datasets/reviews.zip"
 	PRODUCTS_UNZIP := "db/seeding/datasets/products"
@@ -112,7 +113,7 @@ func Seed(store *ravendb.DocumentStore) {
 			userIDs[i] = setID
 
 			// Note: the fakerjs generates just images with rng, so we can't use it for seeding
-			/*err = AddUserAttachments(base64img, u, store)
+			/*err = AddUserAttachments(base64img, u, blobs)
 			if err != nil {
 				fmt.Printf("Error adding attachments: %s\n", err)
 				return
@@ -209,7 +210,7 @@ func Seed(store *ravendb.DocumentStore) {
 					}
 
 					// add the base64 encoded image stream as an attachment to the item
-					err = AddProductAttachments([]string{s}, newItem, store)
+					err = AddProductAttachments([]string{s}, newItem, blobs)
 					if err != nil {
 						fmt.Printf("Error adding attachments: %s\n", err)
 						return
@@ -2,6 +2,7 @@ package seeding
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/csv"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"swapper/models"
+	"swapper/storage"
 
 	"github.com/brianvoe/gofakeit/v7"
 	"github.com/ravendb/ravendb-go-client"
@@ -139,36 +141,18 @@ func CreateItem(i *models.Item, store *ravendb.DocumentStore) (string, error) {
 	return i.ID, nil
 }
 
-func AddProductAttachments(base64Encoded []string, i *models.Item, store *ravendb.DocumentStore) error {
+func AddProductAttachments(base64Encoded []string, i *models.Item, blobs storage.BlobStore) error {
 	for loopI, img := range base64Encoded {
 		fileBytes, err := base64.StdEncoding.DecodeString(img)
 		if err != nil {
 			return err
 		}
-		// Now, convert fileBytes back into a stream for the .Store method
+		// Now, convert fileBytes back into a stream for the .Put method
 		byteReader := bytes.NewReader(fileBytes)
-		mimeType := mime.TypeByExtension("image/png")
+		mimeType := mime.TypeByExtension(".png")
 
-		session, err := store.OpenSession("")
-		if err != nil {
-			return err
-		}
-		defer session.Close()
-
-		// retrieve user
-		err = session.Load(&i, i.ID)
-		if err != nil {
-			return err
-		}
-
-		// Store the byteReader as an attachment
-		err = session.Advanced().Attachments().Store(i, "item_"+string(loopI)+".png", byteReader, mimeType)
-		if err != nil {
-			return err
-		}
-
-		// Save changes
-		err = session.SaveChanges()
+		// Store the byteReader as a blob of the item
+		err = blobs.Put(context.Background(), i.ID, "item_"+strconv.Itoa(loopI)+".png", byteReader, int64(len(fileBytes)), mimeType)
 		if err != nil {
 			return err
 		}
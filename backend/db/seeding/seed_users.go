@@ -2,9 +2,11 @@ package seeding
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"mime"
 	"swapper/models"
+	"swapper/storage"
 
 	"github.com/brianvoe/gofakeit/v7"
 	"github.com/ravendb/ravendb-go-client"
@@ -52,38 +54,15 @@ func CreateUser(u *models.User, store *ravendb.DocumentStore) (string, error) {
 	return u.ID, nil
 }
 
-func AddUserAttachments(base64Encoded string, u *models.User, store *ravendb.DocumentStore) error {
+func AddUserAttachments(base64Encoded string, u *models.User, blobs storage.BlobStore) error {
 	fileBytes, err := base64.StdEncoding.DecodeString(base64Encoded)
 	if err != nil {
 		return err
 	}
-	// Now, convert fileBytes back into a stream for the .Store method
+	// Now, convert fileBytes back into a stream for the .Put method
 	byteReader := bytes.NewReader(fileBytes)
-	mimeType := mime.TypeByExtension("image/png")
+	mimeType := mime.TypeByExtension(".png")
 
-	session, err := store.OpenSession("")
-	if err != nil {
-		return err
-	}
-	defer session.Close()
-
-	// retrieve user
-	err = session.Load(&u, u.ID)
-	if err != nil {
-		return err
-	}
-
-	// Store the byteReader as an attachment
-	err = session.Advanced().Attachments().Store(u, "pfp.png", byteReader, mimeType)
-	if err != nil {
-		return err
-	}
-
-	// Save changes
-	err = session.SaveChanges()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// Store the byteReader as a blob of the user
+	return blobs.Put(context.Background(), u.ID, "pfp.png", byteReader, int64(len(fileBytes)), mimeType)
 }
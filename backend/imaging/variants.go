@@ -0,0 +1,122 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// sizes an uploaded image is stored in, the full size keeps the uploaded name and the
+// smaller ones are stored next to it as "<size>/<name>"
+const (
+	SizeThumbnail = "thumbnail"
+	SizeMedium    = "medium"
+	SizeFull      = "full"
+)
+
+var Sizes = []string{SizeThumbnail, SizeMedium, SizeFull}
+
+// longest edge in pixels per size, images are never scaled up
+var maxEdge = map[string]int{
+	SizeThumbnail: 256,
+	SizeMedium:    1024,
+	SizeFull:      2048,
+}
+
+const jpegQuality = 85
+
+var ErrUnsupportedImage = errors.New("unsupported or corrupt image")
+
+type Variant struct {
+	Size        string
+	Data        []byte
+	ContentType string
+}
+
+/*
+Process decodes an uploaded jpg, png or webp and re-encodes it once per size, webp is stored as
+jpg. Re-encoding drops every metadata block of the upload, EXIF (including GPS position) in
+particular, so the orientation EXIF asks for is applied to the pixels first.
+*/
+func Process(data []byte) ([]Variant, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+
+	variants := make([]Variant, 0, len(Sizes))
+	for _, size := range Sizes {
+		resized := applyOrientation(fit(img, maxEdge[size]), orientation)
+
+		var buf bytes.Buffer
+		contentType := "image/jpeg"
+		if format == "png" {
+			contentType = "image/png"
+			err = png.Encode(&buf, resized)
+		} else {
+			err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: jpegQuality})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		variants = append(variants, Variant{Size: size, Data: buf.Bytes(), ContentType: contentType})
+	}
+	return variants, nil
+}
+
+// VariantName returns the attachment name an image is stored under for a size
+func VariantName(name string, size string) string {
+	if size == SizeFull || size == "" {
+		return name
+	}
+	return size + "/" + name
+}
+
+// IsVariantName reports whether an attachment holds a resized copy rather than an image itself
+func IsVariantName(name string) bool {
+	return strings.Contains(name, "/")
+}
+
+func IsValidSize(size string) bool {
+	_, ok := maxEdge[size]
+	return ok
+}
+
+// scales the image down so its longest edge is at most max pixels
+func fit(img image.Image, max int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= max && h <= max {
+		return img
+	}
+
+	if w >= h {
+		h = h * max / w
+		w = max
+	} else {
+		w = w * max / h
+		h = max
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
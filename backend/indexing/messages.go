@@ -0,0 +1,30 @@
+package indexing
+
+import (
+	"github.com/ravendb/ravendb-go-client"
+)
+
+/*
+full-text index over the text of messages, unsent messages are left out. Messages between two
+users are found by their participants, group messages have no recipient and are found by the
+conversation, so only its current members can search them
+*/
+func NewMessagesByTextIndex() *ravendb.IndexCreationTask {
+	indexName := "Messages/ByText"
+	res := ravendb.NewIndexCreationTask(indexName)
+
+	res.Map = `
+from message in docs.Messages
+where message.deletedAt == null
+select new {
+	Text = message.text,
+	ParticipantIDs = new[] { message.recipientID != "" ? message.senderID : null, message.recipientID },
+	HiddenFor = message.hiddenFor,
+	ConversationID = message.conversationID,
+	SentAt = message.sentAt
+}`
+	res.Index("Text", ravendb.FieldIndexingSearch)
+	res.Analyze("Text", "StandardAnalyzer")
+
+	return res
+}
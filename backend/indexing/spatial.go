@@ -46,6 +46,7 @@ select new {
 	Attributes_OwnershipHistory = item.attributes.ownershipHistory,
 	Attributes_Authenticity = item.attributes.authenticity,
 	Categories = item.categories,
+	UserID = item.userId,
 	CreatedAt = item.createdAt
 }`
 	// Configure index options
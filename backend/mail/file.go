@@ -0,0 +1,31 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+writes every email to a file in a directory instead of sending it, for development: the links
+in them can be opened without a mail server
+*/
+type FileMailer struct {
+	Dir string
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileMailer{
+		Dir: dir,
+	}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, message Message) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), filepath.Base(message.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), format("swapper@localhost", message), 0o600)
+}
@@ -0,0 +1,61 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// backends a Mailer can be created for
+const (
+	BackendFile   = "file"
+	BackendMemory = "memory"
+	BackendSMTP   = "smtp"
+)
+
+var ErrUnknownBackend = errors.New("unknown mail backend")
+
+// a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+/*
+New creates the Mailer for a backend from environment variables:
+
+  - MAIL_BACKEND: file (default), memory or smtp
+  - MAIL_FROM: sender address of the smtp backend
+  - MAIL_FILE_DIR: directory of the file backend (default "data/mail")
+  - SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD: the smtp backend
+*/
+func New() (Mailer, error) {
+	switch backend := strings.ToLower(os.Getenv("MAIL_BACKEND")); backend {
+	case "", BackendFile:
+		dir := os.Getenv("MAIL_FILE_DIR")
+		if dir == "" {
+			dir = "data/mail"
+		}
+		return NewFileMailer(dir)
+	case BackendMemory:
+		return NewMemoryMailer(), nil
+	case BackendSMTP:
+		return NewSMTPMailer(SMTPConfig{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		})
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
+	}
+}
@@ -2,8 +2,16 @@ package main
 
 import (
 	"log"
+	"os"
+	"strings"
 	"swapper/api"
+	"swapper/auth"
+	"swapper/db"
 	"swapper/indexing"
+	"swapper/mail"
+	"swapper/middleware"
+	"swapper/realtime"
+	"swapper/storage"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -32,6 +40,12 @@ func main() {
 	corsConfig.AllowCredentials = true
 	r.Use(cors.New(corsConfig))
 
+	// logins are limited per client address, only proxies we run may tell us what it is
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatalf("Failed to set trusted proxies: %v", err)
+		return
+	}
+
 	documentStore, err := getDocumentStore("swapper")
 	if err != nil {
 		log.Fatalf("Failed to initialize document store: %v", err)
@@ -39,6 +53,40 @@ func main() {
 	}
 	defer documentStore.Close()
 
+	// images are kept in RavenDB unless STORAGE_BACKEND says otherwise
+	blobStore, err := storage.New(documentStore, "")
+	if err != nil {
+		log.Fatalf("Failed to initialize blob storage: %v", err)
+		return
+	}
+
+	// refuse to start rather than sign tokens with a missing key
+	tokenService, err := auth.LoadTokenService()
+	if err != nil {
+		log.Fatalf("Failed to load token keys: %v", err)
+		return
+	}
+
+	// emails are written to data/mail unless MAIL_BACKEND says otherwise
+	mailer, err := mail.New()
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+		return
+	}
+
+	// what deleting an account keeps, anonymized, unless ACCOUNT_DELETION_* say otherwise
+	deletionPolicy, err := api.LoadDeletionPolicy()
+	if err != nil {
+		log.Fatalf("Failed to load account deletion policy: %v", err)
+		return
+	}
+
+	oidcProviders, err := auth.LoadOIDCProviders()
+	if err != nil {
+		log.Fatalf("Failed to load login providers: %v", err)
+		return
+	}
+
 	//setup spatial indexing
 	err = documentStore.ExecuteIndex(indexing.NewItemsWithSpatialAndFullTextSearchIndex(), "swapper")
 	if err != nil {
@@ -46,32 +94,99 @@ func main() {
 		return
 	}
 
+	err = documentStore.ExecuteIndex(indexing.NewMessagesByTextIndex(), "swapper")
+	if err != nil {
+		log.Fatalf("Failed to execute index: %v", err)
+		return
+	}
+
+	// link messages sent before conversations existed
+	err = db.BackfillConversations(documentStore)
+	if err != nil {
+		log.Fatalf("Failed to backfill conversations: %v", err)
+		return
+	}
+
 	// Seed the database
-	//seeding.Seed(documentStore)
+	//seeding.Seed(documentStore, blobStore)
 
-	setupRoutes(r, documentStore)
+	setupRoutes(r, documentStore, blobStore, tokenService, mailer, oidcProviders, deletionPolicy)
 
 	if err := r.Run(":5050"); err != nil {
 		log.Fatalf("Failed to run server: %v", err)
 	}
 }
 
-func setupRoutes(r *gin.Engine, store *ravendb.DocumentStore) {
+// TRUSTED_PROXIES lists the addresses or CIDRs of proxies whose X-Forwarded-For is believed
+func trustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+func setupRoutes(r *gin.Engine, store *ravendb.DocumentStore, blobs storage.BlobStore, tokens *auth.TokenService, mailer mail.Mailer, oidcProviders map[string]*auth.OIDCProvider, deletionPolicy api.DeletionPolicy) {
 	r.GET("/", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "Hello, world!",
 		})
 	})
 
-	userHandler := api.NewUserHandler(store)
+	sessions := auth.NewSessions(store)
+	middleware.SetTokenService(tokens)
+	// access tokens of logged out devices are refused from now on
+	middleware.SetRevocationChecker(sessions)
+	apiKeys := auth.NewAPIKeys(store)
+	// scripts use API keys instead of access tokens on the routes their scopes open
+	middleware.SetAPIKeyVerifier(apiKeys)
+
+	// password logins and their second factor count against the same failures
+	loginThrottle := auth.NewLoginThrottle(store)
+
+	authHandler := api.NewAuthHandler(store, sessions, tokens, mailer, auth.NewPasswordResetThrottle(store))
+	authHandler.RegisterAuthRoutes(r)
+
+	twoFactorHandler := api.NewTwoFactorHandler(store, sessions, tokens, loginThrottle)
+	twoFactorHandler.RegisterTwoFactorRoutes(r)
+
+	oidcHandler := api.NewOIDCHandler(store, sessions, tokens, oidcProviders)
+	oidcHandler.RegisterOIDCRoutes(r)
+
+	userHandler := api.NewUserHandler(store, blobs, sessions, tokens, mailer, loginThrottle)
 	userHandler.RegisterUserRoutes(r)
 
-	itemHandler := api.NewItemHandler(store)
+	itemHandler := api.NewItemHandler(store, blobs)
 	itemHandler.RegisterItemRoutes(r)
 
-	messageHandler := api.NewMessageHandler(store)
+	hub := realtime.NewMemoryHub()
+
+	messageHandler := api.NewMessageHandler(store, blobs, hub, tokens)
 	messageHandler.RegisterMessageRoutes(r)
 
+	conversationHandler := api.NewConversationHandler(store, blobs, hub)
+	conversationHandler.RegisterConversationRoutes(r)
+
 	ratingHandler := api.NewRatingHandler(store)
 	ratingHandler.RegisterRatingRoutes(r)
+
+	swapHandler := api.NewSwapHandler(store)
+	swapHandler.RegisterSwapRoutes(r)
+
+	bookingHandler := api.NewBookingHandler(store)
+	bookingHandler.RegisterBookingRoutes(r)
+
+	blockHandler := api.NewBlockHandler(store)
+	blockHandler.RegisterBlockRoutes(r)
+
+	apiKeyHandler := api.NewAPIKeyHandler(apiKeys)
+	apiKeyHandler.RegisterAPIKeyRoutes(r)
+
+	accountHandler := api.NewAccountHandler(store, blobs, sessions, hub, deletionPolicy)
+	accountHandler.RegisterAccountRoutes(r)
+
+	adminHandler := api.NewAdminHandler(store, blobs, sessions)
+	adminHandler.RegisterAdminRoutes(r)
 }
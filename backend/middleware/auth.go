@@ -1,62 +1,236 @@
 package middleware
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
-	"os"
 	"strings"
+	"swapper/auth"
+	"swapper/models"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt"
 )
 
-type CustomClaims struct {
-	ID    string `json:"id"`
-	Email string `json:"email"`
-	Name  string `json:"name"`
-	jwt.StandardClaims
+// tells whether the session of a token was logged out or expired
+type RevocationChecker interface {
+	IsRevoked(sessionID string) (bool, error)
 }
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+// finds the key and user of a personal API key, and notes when a key was used
+type APIKeyVerifier interface {
+	VerifyAPIKey(key string) (*models.APIKey, *models.User, error)
+	RecordAPIKeyUse(apiKey *models.APIKey) error
+}
+
+var (
+	tokens      *auth.TokenService
+	revocations RevocationChecker
+	apiKeys     APIKeyVerifier
+)
 
-func verifyToken(tokenString string) (*CustomClaims, error) {
-	claims := &CustomClaims{}
+// SetTokenService sets the service tokens are verified with, no token is accepted before
+func SetTokenService(service *auth.TokenService) {
+	tokens = service
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+// SetRevocationChecker makes the middlewares refuse tokens of revoked sessions
+func SetRevocationChecker(checker RevocationChecker) {
+	revocations = checker
+}
 
+// SetAPIKeyVerifier lets routes that name scopes accept API keys, none are accepted before
+func SetAPIKeyVerifier(verifier APIKeyVerifier) {
+	apiKeys = verifier
+}
+
+func verifyToken(tokenString string) (*auth.Claims, error) {
+	if tokens == nil {
+		return nil, errors.New("no token service")
+	}
+
+	claims, err := tokens.Verify(tokenString)
 	if err != nil {
 		return nil, err
 	}
+	return claims, checkSession(claims)
+}
 
-	if claims, ok := token.Claims.(*CustomClaims); ok && token.Valid {
-		return claims, nil
-	} else {
-		return nil, err
+// refuses the claims of a token whose session was logged out
+func checkSession(claims *auth.Claims) error {
+	// every token names its session, without one it couldn't be revoked
+	if claims.SessionID == "" {
+		return errors.New("token has no session")
 	}
+	if revocations != nil {
+		revoked, err := revocations.IsRevoked(claims.SessionID)
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return errors.New("session is revoked")
+		}
+	}
+	return nil
 }
 
 /*
 * AuthMiddleware is a middleware that checks for a valid JWT token in the Authorization header
-* and sets the userID, email, and name in the context for all routes needing authentication
+* and sets the userID, email, and name in the context for all routes needing authentication.
+* A route that names scopes also accepts API keys that were given all of them
  */
-func AuthMiddleware() gin.HandlerFunc {
+func AuthMiddleware(scopes ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-		claims, err := verifyToken(tokenString)
+		if !authenticate(c, tokenString, scopes) {
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+/*
+* SocketAuthMiddleware works like AuthMiddleware but also accepts a "ticket" url param from
+* auth.TokenService.IssueSocketTicket, browsers can't set headers when opening a websocket. The
+* access token itself never goes in the url, where logs and proxies would keep it
+ */
+func SocketAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if tokenString != "" || c.Query("ticket") == "" {
+			if !authenticate(c, tokenString, nil) {
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if tokens == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+		claims, err := tokens.VerifySocketTicket(c.Query("ticket"))
+		if err == nil {
+			err = checkSession(claims)
+		}
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
 			return
 		}
+		setClaims(c, claims)
 
-		//set claims
-		c.Set("userID", claims.ID)
-		c.Set("email", claims.Email)
-		c.Set("name", claims.Name)
+		c.Next()
+	}
+}
+
+/*
+* OptionalAuthMiddleware sets the claims like AuthMiddleware when the request has a valid token
+* and lets it through without them otherwise, for public routes that tailor what they return
+ */
+func OptionalAuthMiddleware(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if tokenString != "" {
+			if auth.IsAPIKey(tokenString) {
+				if key, user, err := verifyAPIKey(tokenString, scopes); err == nil {
+					setAPIKey(c, key, user)
+				}
+			} else if claims, err := verifyToken(tokenString); err == nil {
+				setClaims(c, claims)
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// sets the claims of an access token or API key, responding with the error if there is none
+func authenticate(c *gin.Context, tokenString string, scopes []string) bool {
+	if !auth.IsAPIKey(tokenString) {
+		claims, err := verifyToken(tokenString)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return false
+		}
+		setClaims(c, claims)
+		return true
+	}
+
+	key, user, err := verifyAPIKey(tokenString, scopes)
+	if errors.Is(err, errMissingScope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key can't be used here", "scopes": scopes})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return false
+	}
+	setAPIKey(c, key, user)
+	return true
+}
+
+var errMissingScope = errors.New("API key is missing a scope of the route")
+
+// routes that name no scopes only take access tokens, API keys can't manage the account
+func verifyAPIKey(key string, scopes []string) (*models.APIKey, *models.User, error) {
+	if apiKeys == nil {
+		return nil, nil, errors.New("no API key verifier")
+	}
+
+	apiKey, user, err := apiKeys.VerifyAPIKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(scopes) == 0 {
+		return nil, nil, errMissingScope
+	}
+	for _, scope := range scopes {
+		if !apiKey.HasScope(scope) {
+			return nil, nil, errMissingScope
+		}
+	}
+
+	// only a key that opens the route was used, failing to note it doesn't change the response
+	if err := apiKeys.RecordAPIKeyUse(apiKey); err != nil {
+		fmt.Println(err.Error())
+	}
+	return apiKey, user, nil
+}
+
+/*
+* RequireRole lets through users whose role is at least the given one. It goes after
+* AuthMiddleware, which sets the role from the token
+ */
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !models.RoleAtLeast(c.GetString("role"), role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
+		}
 
 		c.Next()
 	}
 }
+
+func setClaims(c *gin.Context, claims *auth.Claims) {
+	c.Set("userID", claims.ID)
+	c.Set("email", claims.Email)
+	c.Set("name", claims.Name)
+	c.Set("sessionID", claims.SessionID)
+	c.Set("role", claims.Role)
+}
+
+// requests made with an API key have no session and no role, whatever the user's role is
+func setAPIKey(c *gin.Context, key *models.APIKey, user *models.User) {
+	c.Set("userID", user.ID)
+	c.Set("email", user.Email)
+	c.Set("name", user.Name)
+	c.Set("apiKeyID", key.ID)
+}
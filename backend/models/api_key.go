@@ -0,0 +1,55 @@
+package models
+
+import "time"
+
+// what an APIKey can be used for, each scope opens a set of routes
+const (
+	ScopeItemsRead     = "items:read"
+	ScopeItemsWrite    = "items:write"
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+)
+
+var Scopes = []string{ScopeItemsRead, ScopeItemsWrite, ScopeMessagesRead, ScopeMessagesWrite}
+
+// IsScope reports whether scope is one of Scopes
+func IsScope(scope string) bool {
+	for _, known := range Scopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+a personal API key a user made for their scripts, used instead of an access token on the routes
+its scopes open. Only its hash is stored, as part of the id so the key is found without a query:
+"apikeys/<hash>"
+*/
+type APIKey struct {
+	ID         string     `json:"id,omitempty"`
+	UserID     string     `json:"userID"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // the start of the key, to tell keys apart
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"` // never when not set
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// IsActive reports whether the key can still be used at the given time
+func (k *APIKey) IsActive(at time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || at.Before(*k.ExpiresAt))
+}
+
+// HasScope reports whether the key was given the scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
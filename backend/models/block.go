@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// a user blocking another one, they can't message each other and the blocked user no longer
+// sees the blocker's items
+type Block struct {
+	ID        string    `json:"id,omitempty"`
+	BlockerID string    `json:"blockerID"`
+	BlockedID string    `json:"blockedID"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// BlockID returns the id of the block of blockedID by blockerID, "blocks/1-A_2-A" when users/1-A
+// blocks users/2-A, so checking for a block is a load instead of a query
+func BlockID(blockerID string, blockedID string) string {
+	return "blocks/" + trimCollection(blockerID) + "_" + trimCollection(blockedID)
+}
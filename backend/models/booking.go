@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// booking statuses, a booking is requested by the renter, approved or rejected by the owner,
+// becomes active once the item is picked up and ends when the item is returned
+const (
+	BookingStatusRequested = "requested"
+	BookingStatusApproved  = "approved"
+	BookingStatusRejected  = "rejected"
+	BookingStatusCancelled = "cancelled"
+	BookingStatusActive    = "active"
+	BookingStatusReturned  = "returned"
+)
+
+// model for a rental of an item over an inclusive range of days
+type Booking struct {
+	ID         string     `json:"id,omitempty"`
+	ItemID     string     `json:"itemID"`
+	OwnerID    string     `json:"ownerID"`
+	RenterID   string     `json:"renterID"`
+	StartDate  time.Time  `json:"startDate"`
+	EndDate    time.Time  `json:"endDate"`
+	Message    string     `json:"message,omitempty"`
+	Status     string     `json:"status"`
+	PickedUpAt *time.Time `json:"pickedUpAt,omitempty"`
+	ReturnedAt *time.Time `json:"returnedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+}
+
+// Overlaps reports whether the booking shares at least one day with the inclusive range
+func (b *Booking) Overlaps(start time.Time, end time.Time) bool {
+	return !b.StartDate.After(end) && !start.After(b.EndDate)
+}
+
+// IsOverdue reports whether the item should have been returned before the given time
+func (b *Booking) IsOverdue(now time.Time) bool {
+	return b.Status == BookingStatusActive && now.After(b.EndDate.AddDate(0, 0, 1))
+}
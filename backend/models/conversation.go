@@ -0,0 +1,217 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// header of a conversation between users, updated with every message so the inbox never has
+// to look at the messages themselves
+type Conversation struct {
+	ID             string               `json:"id,omitempty"`
+	ParticipantIDs []string             `json:"participantIDs"`
+	ItemID         string               `json:"itemID,omitempty"`
+	Group          bool                 `json:"group,omitempty"`
+	Title          string               `json:"title,omitempty"`
+	CreatorID      string               `json:"creatorID,omitempty"`      // manages the members of a group
+	PendingFor     string               `json:"pendingFor,omitempty"`     // whose message requests the conversation is in until they answer or accept it
+	PendingMembers []string             `json:"pendingMembers,omitempty"` // the same for the members of a group
+	LastMessage    *Message             `json:"lastMessage,omitempty"`
+	UnreadCounts   map[string]int       `json:"unreadCounts"`
+	LastReadAt     map[string]time.Time `json:"lastReadAt"`
+	CreatedAt      time.Time            `json:"createdAt"`
+	UpdatedAt      time.Time            `json:"updatedAt"`
+}
+
+/*
+ConversationID returns the id of the conversation between the users, the same whichever of them
+starts it: "conversations/1-A_2-A" for users/1-A and users/2-A. Conversations about an item are
+separate from the general one, "conversations/1-A_2-A_item-5-A" is about items/5-A. The ids have
+to be full document ids (see UserDocumentID), only the users/ and items/ prefixes are left out
+*/
+func ConversationID(itemID string, userIDs ...string) string {
+	ids := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		ids[i] = strings.TrimPrefix(userID, "users/")
+	}
+	sort.Strings(ids)
+
+	id := "conversations/" + strings.Join(ids, "_")
+	if itemID != "" {
+		id += "_item-" + strings.TrimPrefix(itemID, "items/")
+	}
+	return id
+}
+
+// NewConversation starts an empty conversation between the users, about an item if itemID is set
+func NewConversation(itemID string, userIDs ...string) *Conversation {
+	participants := append([]string{}, userIDs...)
+	sort.Strings(participants)
+
+	now := time.Now()
+	conversation := &Conversation{
+		ID:             ConversationID(itemID, userIDs...),
+		ParticipantIDs: participants,
+		ItemID:         itemID,
+		UnreadCounts:   make(map[string]int),
+		LastReadAt:     make(map[string]time.Time),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	for _, userID := range participants {
+		conversation.UnreadCounts[userID] = 0
+	}
+	return conversation
+}
+
+/*
+NewGroupConversation starts a conversation between any number of users. Unlike conversations
+between two users it isn't found by its participants, so it gets a generated id when stored
+*/
+func NewGroupConversation(creatorID string, title string, memberIDs ...string) *Conversation {
+	now := time.Now()
+	conversation := &Conversation{
+		Group:        true,
+		Title:        title,
+		CreatorID:    creatorID,
+		UnreadCounts: make(map[string]int),
+		LastReadAt:   make(map[string]time.Time),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	conversation.AddParticipant(creatorID)
+	for _, userID := range memberIDs {
+		conversation.AddParticipant(userID)
+	}
+	return conversation
+}
+
+// AddParticipant adds a user to a group, they start with nothing unread
+func (c *Conversation) AddParticipant(userID string) {
+	if c.IsParticipant(userID) {
+		return
+	}
+	c.ParticipantIDs = append(c.ParticipantIDs, userID)
+	sort.Strings(c.ParticipantIDs)
+	c.MarkRead(userID, time.Now())
+}
+
+// RemoveParticipant removes a user from a group, the next member takes over if they created it
+func (c *Conversation) RemoveParticipant(userID string) {
+	participants := make([]string, 0, len(c.ParticipantIDs))
+	for _, participant := range c.ParticipantIDs {
+		if participant != userID {
+			participants = append(participants, participant)
+		}
+	}
+	c.ParticipantIDs = participants
+	c.PendingMembers = removeID(c.PendingMembers, userID)
+	delete(c.UnreadCounts, userID)
+	delete(c.LastReadAt, userID)
+
+	if c.CreatorID == userID {
+		c.CreatorID = ""
+		if len(participants) > 0 {
+			c.CreatorID = participants[0]
+		}
+	}
+}
+
+// IsParticipant reports whether the user takes part in the conversation
+func (c *Conversation) IsParticipant(userID string) bool {
+	for _, participant := range c.ParticipantIDs {
+		if participant == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// AddMessage makes the message the latest one, unread for everyone but its sender
+func (c *Conversation) AddMessage(message *Message) {
+	if c.UnreadCounts == nil {
+		c.UnreadCounts = make(map[string]int)
+	}
+
+	last := *message
+	c.LastMessage = &last
+	c.UpdatedAt = message.SentAt
+
+	for _, participant := range c.ParticipantIDs {
+		if participant != message.SenderID {
+			c.UnreadCounts[participant]++
+		}
+	}
+	// whoever writes has read everything before, answering a message request accepts it
+	c.MarkRead(message.SenderID, message.SentAt)
+	c.Accept(message.SenderID)
+}
+
+// IsPendingFor reports whether the conversation is in the user's message requests
+func (c *Conversation) IsPendingFor(userID string) bool {
+	if c.PendingFor == userID {
+		return true
+	}
+	for _, memberID := range c.PendingMembers {
+		if memberID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept moves the conversation out of the user's message requests
+func (c *Conversation) Accept(userID string) {
+	if c.PendingFor == userID {
+		c.PendingFor = ""
+	}
+	c.PendingMembers = removeID(c.PendingMembers, userID)
+}
+
+// MarkRead marks every message of the conversation read for the user
+func (c *Conversation) MarkRead(userID string, at time.Time) {
+	if c.UnreadCounts == nil {
+		c.UnreadCounts = make(map[string]int)
+	}
+	if c.LastReadAt == nil {
+		c.LastReadAt = make(map[string]time.Time)
+	}
+	c.UnreadCounts[userID] = 0
+	c.LastReadAt[userID] = at
+}
+
+// RemoveUnread stops counting the message as unread for the user, if they hadn't read it yet
+func (c *Conversation) RemoveUnread(userID string, message *Message) {
+	if message.SenderID == userID || c.UnreadCounts[userID] == 0 {
+		return
+	}
+	if readAt, ok := c.LastReadAt[userID]; ok && !readAt.Before(message.SentAt) {
+		return
+	}
+	c.UnreadCounts[userID]--
+}
+
+// UpdateMessage replaces the copy of the latest message if it is the given one
+func (c *Conversation) UpdateMessage(message *Message) {
+	if c.LastMessage != nil && c.LastMessage.ID == message.ID {
+		last := *message
+		c.LastMessage = &last
+	}
+}
+
+// returns the ids without the given one, nil when none are left
+func removeID(ids []string, id string) []string {
+	var kept []string
+	for _, other := range ids {
+		if other != id {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+// "users/1-A" becomes "1-A"
+func trimCollection(id string) string {
+	return id[strings.Index(id, "/")+1:]
+}
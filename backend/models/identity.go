@@ -0,0 +1,40 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+/*
+an account at an OpenID Connect provider linked to a user, who can log in with it. Its id is
+made of the provider and the subject so logging in finds it without a query
+*/
+type Identity struct {
+	ID       string    `json:"id,omitempty"`
+	UserID   string    `json:"userID"`
+	Provider string    `json:"provider"`
+	Subject  string    `json:"subject"`
+	Email    string    `json:"email,omitempty"` // as the provider last reported it
+	LinkedAt time.Time `json:"linkedAt"`
+}
+
+/*
+IdentityID returns the id of a provider's subject, "identities/corp-<hash>". Subjects are opaque
+strings of up to 255 characters, hashing keeps them out of the id's syntax
+*/
+func IdentityID(provider string, subject string) string {
+	sum := sha256.Sum256([]byte(subject))
+	return "identities/" + provider + "-" + hex.EncodeToString(sum[:])
+}
+
+// a login at an OpenID Connect provider that was started and not finished yet
+type OIDCLogin struct {
+	ID          string    `json:"id,omitempty"` // made of the state sent to the provider
+	Provider    string    `json:"provider"`
+	Nonce       string    `json:"nonce"`
+	Verifier    string    `json:"verifier"` // the PKCE code verifier
+	RedirectURL string    `json:"redirectURL"`
+	ReturnTo    string    `json:"returnTo,omitempty"` // path of the website to go back to
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
@@ -19,6 +19,14 @@ type Location struct {
 	Longitude float64 `json:"longitude"`
 }
 
+// item statuses, an item moves from available to pending once a swap is
+// accepted and to swapped once the swap is completed
+const (
+	ItemStatusAvailable = "available"
+	ItemStatusPending   = "pending"
+	ItemStatusSwapped   = "swapped"
+)
+
 // model for an item with associated userID
 type Item struct {
 	ID          string     `json:"id,omitempty"`
@@ -30,8 +38,19 @@ type Item struct {
 	Status      string     `json:"status"`
 	Location    Location   `json:"location"`
 	Attachments []string   `json:"attachments"`
+	ImageOrder  []string   `json:"imageOrder,omitempty"`
 	Attributes  Attributes `json:"attributes"`
 	CreatedAt   time.Time  `json:"createdAt"`
 	AvgRating   float64    `json:"avgRating"`
 	NumRatings  int        `json:"numRatings"`
+	// bumped by every booking approval so two approvals of the item can't both be saved
+	BookingsVersion int `json:"bookingsVersion,omitempty"`
+}
+
+// the part of an item shown next to something referring to it, like a conversation about it
+type ItemSummary struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Status string `json:"status"`
+	Image  string `json:"image,omitempty"`
 }
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// why a login was refused, see LoginFailure
+const (
+	LoginFailureUnknownEmail  = "unknown-email"
+	LoginFailureWrongPassword = "wrong-password"
+	LoginFailureLocked        = "locked"
+	LoginFailureWrongCode     = "wrong-code" // the second factor, after the right password
+)
+
+/*
+the recent failed logins of an email or an IP address. Attempts are counted when they start, so
+parallel guesses can't slip past the limit, and taken back once the password turned out right
+*/
+type LoginAttempts struct {
+	ID            string     `json:"id,omitempty"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"lastFailureAt"`
+	LockedUntil   *time.Time `json:"lockedUntil,omitempty"` // no login is tried before then
+}
+
+// LoginAttemptsForEmail returns the id of the attempts on an email, whether a user has it or not
+func LoginAttemptsForEmail(email string) string {
+	return "loginattempts/email-" + hashKey(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// LoginAttemptsForIP returns the id of the attempts made from an IP address
+func LoginAttemptsForIP(ip string) string {
+	return "loginattempts/ip-" + hashKey(ip)
+}
+
+// PasswordResetAttemptsForEmail returns the id of the reset links asked for an email, counted apart
+// from its logins so asking for links can't lock anyone out
+func PasswordResetAttemptsForEmail(email string) string {
+	return "loginattempts/reset-email-" + hashKey(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// PasswordResetAttemptsForIP returns the id of the reset links asked for from an IP address
+func PasswordResetAttemptsForIP(ip string) string {
+	return "loginattempts/reset-ip-" + hashKey(ip)
+}
+
+// an audit record of a refused login
+type LoginFailure struct {
+	ID        string    `json:"id,omitempty"`
+	Email     string    `json:"email"`
+	UserID    string    `json:"userID,omitempty"` // empty when no user has the email
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// emails and addresses can hold characters that mean something in ids
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -5,8 +5,56 @@ import (
 )
 
 type Message struct {
-	SenderID    string    `json:"senderID" binding:"required"`
-	RecipientID string    `json:"recipientID" binding:"required"`
-	Text        string    `json:"text" binding:"required"`
-	SentAt      time.Time `json:"sentAt"`
+	ID             string        `json:"id"`
+	ConversationID string        `json:"conversationID"`
+	SenderID       string        `json:"senderID" binding:"required"`
+	RecipientID    string        `json:"recipientID"` // empty in group conversations, they go to every participant
+	ItemID         string        `json:"itemID,omitempty"`
+	Text           string        `json:"text"`
+	Images         []string      `json:"images,omitempty"` // names of the photos sent with the message, in order
+	SentAt         time.Time     `json:"sentAt"`
+	DeliveredAt    *time.Time    `json:"deliveredAt,omitempty"`
+	EditedAt       *time.Time    `json:"editedAt,omitempty"`
+	Edits          []MessageEdit `json:"edits,omitempty"` // earlier versions of the text, oldest first
+	// set when the sender unsent the message, its text and photos are gone but the message stays
+	// in place so the conversation and pagination cursors still find it
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	HiddenFor []string   `json:"hiddenFor,omitempty"` // participants who removed the message for themselves
+}
+
+// a text the message had before it was edited
+type MessageEdit struct {
+	Text     string    `json:"text"`
+	EditedAt time.Time `json:"editedAt"` // when it was replaced
+}
+
+// Edit replaces the text, keeping the previous one in the history
+func (m *Message) Edit(text string, at time.Time) {
+	m.Edits = append(m.Edits, MessageEdit{Text: m.Text, EditedAt: at})
+	m.Text = text
+	m.EditedAt = &at
+}
+
+// Unsend turns the message into a tombstone for both participants
+func (m *Message) Unsend(at time.Time) {
+	m.Text = ""
+	m.Images = nil
+	m.Edits = nil
+	m.DeletedAt = &at
+}
+
+// Hide removes the message for the user only
+func (m *Message) Hide(userID string) {
+	if !m.IsHiddenFor(userID) {
+		m.HiddenFor = append(m.HiddenFor, userID)
+	}
+}
+
+func (m *Message) IsHiddenFor(userID string) bool {
+	for _, hiddenFor := range m.HiddenFor {
+		if hiddenFor == userID {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// what a moderator did, see ModerationAction
+const (
+	ModerationSuspendUser   = "suspend-user"
+	ModerationUnsuspendUser = "unsuspend-user"
+	ModerationSetRole       = "set-role"
+	ModerationRemoveItem    = "remove-item"
+	ModerationRemoveRating  = "remove-rating"
+)
+
+// an audit record of something done through the admin API
+type ModerationAction struct {
+	ID          string    `json:"id,omitempty"`
+	ModeratorID string    `json:"moderatorID"`
+	Action      string    `json:"action"`
+	TargetID    string    `json:"targetID"` // the user, item or rating acted on
+	Reason      string    `json:"reason,omitempty"`
+	Detail      string    `json:"detail,omitempty"` // the new role of set-role
+	CreatedAt   time.Time `json:"createdAt"`
+}
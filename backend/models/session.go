@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+/*
+a logged in device. The refresh token it was given is only stored as a hash and replaced on every
+refresh, access tokens name the session so revoking it logs the device out
+*/
+type Session struct {
+	ID                string     `json:"id,omitempty"`
+	UserID            string     `json:"userID"`
+	TokenHash         string     `json:"tokenHash"`
+	PreviousTokenHash string     `json:"previousTokenHash,omitempty"` // the token replaced by the last refresh, using it again means it was stolen
+	UserAgent         string     `json:"userAgent,omitempty"`
+	CreatedAt         time.Time  `json:"createdAt"`
+	LastUsedAt        time.Time  `json:"lastUsedAt"`
+	ExpiresAt         time.Time  `json:"expiresAt"`
+	RevokedAt         *time.Time `json:"revokedAt,omitempty"`
+}
+
+// IsActive reports whether the session can still be used at the given time
+func (s *Session) IsActive(at time.Time) bool {
+	return s.RevokedAt == nil && at.Before(s.ExpiresAt)
+}
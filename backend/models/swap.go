@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+// swap proposal statuses
+const (
+	SwapStatusProposed  = "proposed"
+	SwapStatusCountered = "countered"
+	SwapStatusAccepted  = "accepted"
+	SwapStatusDeclined  = "declined"
+	SwapStatusCancelled = "cancelled"
+	SwapStatusCompleted = "completed"
+)
+
+// a single offer (or counter-offer) made during a swap negotiation
+type SwapOffer struct {
+	ProposedBy     string    `json:"proposedBy"`
+	OfferedItemIDs []string  `json:"offeredItemIDs"`
+	Message        string    `json:"message,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// model for a proposal to swap one or more of the proposer's items for an item owned by another user
+type SwapProposal struct {
+	ID             string      `json:"id,omitempty"`
+	ProposerID     string      `json:"proposerID"`
+	OwnerID        string      `json:"ownerID"`
+	TargetItemID   string      `json:"targetItemID"`
+	OfferedItemIDs []string    `json:"offeredItemIDs"`
+	Status         string      `json:"status"`
+	AwaitingUserID string      `json:"awaitingUserID,omitempty"`
+	CompletedBy    []string    `json:"completedBy,omitempty"` // participants who confirmed the items changed hands
+	History        []SwapOffer `json:"history"`
+	CreatedAt      time.Time   `json:"createdAt"`
+	UpdatedAt      time.Time   `json:"updatedAt"`
+}
+
+// IsOpen reports whether the proposal is still being negotiated
+func (s *SwapProposal) IsOpen() bool {
+	return s.Status == SwapStatusProposed || s.Status == SwapStatusCountered
+}
+
+// IsParticipant reports whether the user is either side of the swap
+func (s *SwapProposal) IsParticipant(userID string) bool {
+	return userID == s.ProposerID || userID == s.OwnerID
+}
+
+// ItemIDs returns every item involved in the swap, target first
+func (s *SwapProposal) ItemIDs() []string {
+	return append([]string{s.TargetItemID}, s.OfferedItemIDs...)
+}
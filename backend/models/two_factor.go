@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+/*
+the TOTP settings of a user, kept apart from the user so the secret never ends up in a response
+that returns users. "twofactors/1-A" belongs to users/1-A
+*/
+type TwoFactor struct {
+	ID                 string     `json:"id,omitempty"`
+	UserID             string     `json:"userID"`
+	Secret             string     `json:"secret,omitempty"`             // base32, set once confirmed
+	PendingSecret      string     `json:"pendingSecret,omitempty"`      // enrolled in an app but not confirmed with a code yet
+	RecoveryCodeHashes []string   `json:"recoveryCodeHashes,omitempty"` // the codes not used yet
+	LastUsedStep       int64      `json:"lastUsedStep"`                 // time step of the last code accepted, a code works once
+	EnabledAt          *time.Time `json:"enabledAt,omitempty"`
+	FailedLoginCodes   int        `json:"failedLoginCodes,omitempty"` // codes tried at login since the last right one
+	// two-factor tokens issued until then are refused, set when too many codes were wrong or a
+	// login finished with one
+	LoginTokensValidAfter *time.Time `json:"loginTokensValidAfter,omitempty"`
+}
+
+// MaxFailedLoginCodes is how many codes a login may try, after that the password has to be given again
+const MaxFailedLoginCodes = 5
+
+// AcceptsLoginToken reports whether a two-factor token issued at the time can still be used
+func (t *TwoFactor) AcceptsLoginToken(issuedAt time.Time) bool {
+	return t.LoginTokensValidAfter == nil || issuedAt.After(*t.LoginTokensValidAfter)
+}
+
+/*
+CountLoginCode counts a code tried at login before it is checked, so guesses sent in parallel are
+all counted. The last one allowed refuses the tokens issued until now and starts the count over
+*/
+func (t *TwoFactor) CountLoginCode(at time.Time) {
+	t.FailedLoginCodes++
+	if t.FailedLoginCodes >= MaxFailedLoginCodes {
+		t.FailedLoginCodes = 0
+		t.LoginTokensValidAfter = &at
+	}
+}
+
+// UseLoginToken refuses the two-factor token a login finished with, and any issued before it
+func (t *TwoFactor) UseLoginToken(issuedAt time.Time) {
+	t.FailedLoginCodes = 0
+	if t.AcceptsLoginToken(issuedAt) {
+		t.LoginTokensValidAfter = &issuedAt
+	}
+}
+
+// TwoFactorID returns the id of the user's TOTP settings
+func TwoFactorID(userID string) string {
+	return "twofactors/" + trimCollection(userID)
+}
+
+// UseRecoveryCode removes the code with the hash from the unused ones, reporting whether it was one
+func (t *TwoFactor) UseRecoveryCode(hash string) bool {
+	for i, unused := range t.RecoveryCodeHashes {
+		if unused == hash {
+			t.RecoveryCodeHashes = append(t.RecoveryCodeHashes[:i], t.RecoveryCodeHashes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
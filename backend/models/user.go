@@ -1,12 +1,77 @@
 package models
 
+import (
+	"strings"
+	"time"
+)
+
+// what a user may do besides using the app, each role can do everything the ones before it can
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// IsRole reports whether role is one of the Role constants
+func IsRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// RoleAtLeast reports whether role can do everything required can, an empty role is RoleUser
+func RoleAtLeast(role string, required string) bool {
+	if role == "" {
+		role = RoleUser
+	}
+	return roleRanks[role] >= roleRanks[required]
+}
+
 type User struct {
 	ID             string  `json:"id,omitempty"`
-	Name           string  `json:"name", validate:"required"`
-	Username       string  `json:"username", validate:"required"`
-	Email          string  `json:"email", validate:"required,email"`
-	PasswordHash   string  `json:"password_hash", validate:"required"`
+	Name           string  `json:"name" validate:"required"`
+	Username       string  `json:"username" validate:"required"`
+	Email          string  `json:"email" validate:"required,email"`
+	PasswordHash   string  `json:"password_hash" validate:"required"`
 	ProfilePicture string  `json:"profilePicture"`
 	AvgRating      float64 `json:"avgRating"`
 	NumRatings     int     `json:"numRatings"`
+	// set once the user opened the link sent to Email, cleared when the email changes
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt,omitempty"`
+	// logging in asks for a TOTP code after the password, see TwoFactor
+	TwoFactorEnabled bool `json:"twoFactorEnabled,omitempty"`
+	// one of the Role constants, users who never got another role have none
+	Role string `json:"role,omitempty"`
+	// set while a moderator keeps the user from logging in
+	SuspendedAt     *time.Time `json:"suspendedAt,omitempty"`
+	SuspendedReason string     `json:"suspendedReason,omitempty"`
+	// set when the user deleted their account and the profile was kept without anything personal
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// IsSuspended reports whether the user is kept from logging in
+func (u *User) IsSuspended() bool {
+	return u.SuspendedAt != nil
+}
+
+// Anonymize removes everything about the user but their id, what refers to them still finds a user
+func (u *User) Anonymize(at time.Time) {
+	*u = User{
+		ID:        u.ID,
+		Name:      "Deleted user",
+		DeletedAt: &at,
+	}
+}
+
+// UserDocumentID returns the full document id of a user, "2-A" as sent by a client becomes "users/2-A"
+func UserDocumentID(id string) string {
+	if id == "" || strings.Contains(id, "/") {
+		return id
+	}
+	return "users/" + id
 }
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// what a UserToken can be used for
+const (
+	TokenPurposeVerifyEmail   = "verify-email"
+	TokenPurposeResetPassword = "reset-password"
+)
+
+/*
+a single use token sent to a user by email. Only its hash is stored, as part of the id so the
+token is found without a query: "usertokens/<hash>"
+*/
+type UserToken struct {
+	ID        string     `json:"id,omitempty"`
+	UserID    string     `json:"userID"`
+	Purpose   string     `json:"purpose"`
+	Email     string     `json:"email"` // the address it was sent to, verifying it only counts while the user still has it
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+}
@@ -0,0 +1,110 @@
+package realtime
+
+import (
+	"sync"
+)
+
+// event types pushed to connected clients
+const (
+	EventMessage   = "message"   // a new message, sent to both participants
+	EventDelivered = "delivered" // the recipient's client received a message
+	EventEdited    = "edited"    // the sender changed the text of a message
+	EventDeleted   = "deleted"   // a message was unsent, or hidden by the user on another connection
+	EventTyping    = "typing"    // the other participant started or stopped typing
+	EventRead      = "read"      // a participant read a conversation up to now
+	EventMembers   = "members"   // someone joined or left a group
+	EventError     = "error"     // a frame from the client was rejected
+)
+
+// events are plain json so a broker backed hub can pass them between servers as is
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+/*
+Hub delivers events to the connections of users. MemoryHub only reaches connections of this
+process, running several servers needs a Hub backed by a broker (e.g. redis pub/sub) that
+publishes to every server and delivers to the local subscribers.
+*/
+type Hub interface {
+	// registers a connection of the user, it receives events published to the user until closed
+	Subscribe(userID string) *Subscription
+	// sends the event to every connection of the users
+	Publish(event Event, userIDs ...string)
+}
+
+type Subscription struct {
+	UserID string
+	// closed when the subscription is closed, or when the connection falls too far behind
+	Events <-chan Event
+
+	close func()
+}
+
+func (s *Subscription) Close() {
+	s.close()
+}
+
+// events buffered per connection before it is considered too slow and dropped
+const subscriberBuffer = 64
+
+type MemoryHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan Event]struct{}
+}
+
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{
+		subscribers: make(map[string]map[chan Event]struct{}),
+	}
+}
+
+func (h *MemoryHub) Subscribe(userID string) *Subscription {
+	events := make(chan Event, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[chan Event]struct{})
+	}
+	h.subscribers[userID][events] = struct{}{}
+	h.mu.Unlock()
+
+	return &Subscription{
+		UserID: userID,
+		Events: events,
+		close: func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.remove(userID, events)
+		},
+	}
+}
+
+func (h *MemoryHub) Publish(event Event, userIDs ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, userID := range userIDs {
+		for events := range h.subscribers[userID] {
+			select {
+			case events <- event:
+			default:
+				// the client stopped reading, dropping it makes it reconnect and refetch
+				h.remove(userID, events)
+			}
+		}
+	}
+}
+
+// removes and closes a subscriber, the caller holds the lock
+func (h *MemoryHub) remove(userID string, events chan Event) {
+	if _, ok := h.subscribers[userID][events]; !ok {
+		return
+	}
+	delete(h.subscribers[userID], events)
+	if len(h.subscribers[userID]) == 0 {
+		delete(h.subscribers, userID)
+	}
+	close(events)
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	localDataDir  = "data"
+	localMetaDir  = "meta"
+	localMetaExt  = ".json"
+	localFileMode = 0o644
+	localDirMode  = 0o755
+)
+
+/*
+stores blobs as files in a directory, one directory per document:
+
+	<root>/<document id>/data/<name>        the contents
+	<root>/<document id>/meta/<name>.json   the content type, size and hash
+
+ids and names are path escaped so "items/1-A" and "thumbnail/photo.jpg" are single path elements
+*/
+type LocalBlobStore struct {
+	Root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(root, localDirMode); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{
+		Root: root,
+	}, nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, docID string, name string, data io.Reader, size int64, contentType string) error {
+	if err := validateName(docID, name); err != nil {
+		return err
+	}
+
+	dataPath, metaPath := s.paths(docID, name)
+	for _, dir := range []string{filepath.Dir(dataPath), filepath.Dir(metaPath)} {
+		if err := os.MkdirAll(dir, localDirMode); err != nil {
+			return err
+		}
+	}
+
+	// write to a temporary file first so a failed upload never leaves half a blob behind
+	tmp, err := os.CreateTemp(filepath.Dir(dataPath), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	info := BlobInfo{
+		Name:        name,
+		ContentType: contentType,
+		Size:        written,
+		Hash:        base64.StdEncoding.EncodeToString(hash.Sum(nil)),
+	}
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	// a blob only shows up once its metadata is written
+	if err := os.Rename(tmp.Name(), dataPath); err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, meta, localFileMode)
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, docID string, name string) (*Blob, error) {
+	if err := validateName(docID, name); err != nil {
+		return nil, err
+	}
+
+	dataPath, metaPath := s.paths(docID, name)
+	info, err := readLocalMeta(metaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(dataPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Blob{BlobInfo: *info, Data: file}, nil
+}
+
+func (s *LocalBlobStore) List(ctx context.Context, docID string) ([]BlobInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Root, url.PathEscape(docID), localMetaDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]BlobInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), localMetaExt) {
+			continue
+		}
+		info, err := readLocalMeta(filepath.Join(s.Root, url.PathEscape(docID), localMetaDir, entry.Name()))
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted while listing
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, *info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, docID string, name string) error {
+	if err := validateName(docID, name); err != nil {
+		return err
+	}
+
+	dataPath, metaPath := s.paths(docID, name)
+	for _, path := range []string{metaPath, dataPath} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) paths(docID string, name string) (string, string) {
+	dir := filepath.Join(s.Root, url.PathEscape(docID))
+	escaped := url.PathEscape(name)
+	return filepath.Join(dir, localDataDir, escaped), filepath.Join(dir, localMetaDir, escaped+localMetaExt)
+}
+
+func readLocalMeta(path string) (*BlobInfo, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var info BlobInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sort"
+
+	"github.com/ravendb/ravendb-go-client"
+)
+
+// stores blobs as attachments of their document, the document has to exist
+type RavenBlobStore struct {
+	Store *ravendb.DocumentStore
+}
+
+func NewRavenBlobStore(store *ravendb.DocumentStore) *RavenBlobStore {
+	return &RavenBlobStore{
+		Store: store,
+	}
+}
+
+func (s *RavenBlobStore) Put(ctx context.Context, docID string, name string, data io.Reader, size int64, contentType string) error {
+	if err := validateName(docID, name); err != nil {
+		return err
+	}
+	op := ravendb.NewPutAttachmentOperation(docID, name, data, contentType, nil)
+	return s.Store.Operations().Send(op, nil)
+}
+
+func (s *RavenBlobStore) Get(ctx context.Context, docID string, name string) (*Blob, error) {
+	if err := validateName(docID, name); err != nil {
+		return nil, err
+	}
+
+	op := ravendb.NewGetAttachmentOperation(docID, name, ravendb.AttachmentDocument, "", nil)
+	if err := s.Store.Operations().Send(op, nil); err != nil {
+		return nil, err
+	}
+	result := op.Command.Result
+	if result == nil {
+		return nil, ErrNotFound
+	}
+
+	return &Blob{
+		BlobInfo: BlobInfo{
+			Name:        name,
+			ContentType: result.Details.ContentType,
+			Size:        result.Details.Size,
+			Hash:        result.Details.Hash,
+		},
+		Data: attachmentReader{Reader: result.Data, Closer: result},
+	}, nil
+}
+
+// reads the attachment names from the metadata of the document without loading its body
+func (s *RavenBlobStore) List(ctx context.Context, docID string) ([]BlobInfo, error) {
+	lists, err := s.ListMany(ctx, []string{docID})
+	if err != nil {
+		return nil, err
+	}
+	return lists[docID], nil
+}
+
+// same as List for many documents, fetching the metadata of all of them in one request
+func (s *RavenBlobStore) ListMany(ctx context.Context, docIDs []string) (map[string][]BlobInfo, error) {
+	lists := make(map[string][]BlobInfo, len(docIDs))
+	if len(docIDs) == 0 {
+		return lists, nil
+	}
+
+	cmd, err := ravendb.NewGetDocumentsCommand(docIDs, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Store.GetRequestExecutor("").ExecuteCommand(cmd, nil); err != nil {
+		return nil, err
+	}
+	if cmd.Result == nil {
+		return lists, nil
+	}
+
+	// results come in the order of the ids, nil for missing documents
+	for i, document := range cmd.Result.Results {
+		if i < len(docIDs) && document != nil {
+			lists[docIDs[i]] = attachmentInfos(document)
+		}
+	}
+	return lists, nil
+}
+
+func (s *RavenBlobStore) Delete(ctx context.Context, docID string, name string) error {
+	if err := validateName(docID, name); err != nil {
+		return err
+	}
+	op := ravendb.NewDeleteAttachmentOperation(docID, name, nil)
+	return s.Store.Operations().Send(op, nil)
+}
+
+func attachmentInfos(document map[string]interface{}) []BlobInfo {
+	metadata, _ := document["@metadata"].(map[string]interface{})
+	attachments, _ := metadata["@attachments"].([]interface{})
+
+	infos := make([]BlobInfo, 0, len(attachments))
+	for _, a := range attachments {
+		attachment, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		info := BlobInfo{}
+		info.Name, _ = attachment["Name"].(string)
+		info.ContentType, _ = attachment["ContentType"].(string)
+		info.Hash, _ = attachment["Hash"].(string)
+		if size, ok := attachment["Size"].(float64); ok {
+			info.Size = int64(size)
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// the attachment body is read through Data but closed through the result
+type attachmentReader struct {
+	io.Reader
+	io.Closer
+}
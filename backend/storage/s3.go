@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3Config struct {
+	Endpoint  string // host[:port] without scheme, e.g. "localhost:9000" for MinIO
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+}
+
+// stores blobs as objects of a bucket in any S3 compatible service, keyed "<document id>/<name>"
+type S3BlobStore struct {
+	Client *minio.Client
+	Bucket string
+}
+
+// connects to the bucket, creating it if it doesn't exist yet
+func NewS3BlobStore(config S3Config) (*S3BlobStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("s3 storage needs an endpoint and a bucket")
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &S3BlobStore{
+		Client: client,
+		Bucket: config.Bucket,
+	}, nil
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, docID string, name string, data io.Reader, size int64, contentType string) error {
+	if err := validateName(docID, name); err != nil {
+		return err
+	}
+	_, err := s.Client.PutObject(ctx, s.Bucket, objectKey(docID, name), data, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, docID string, name string) (*Blob, error) {
+	if err := validateName(docID, name); err != nil {
+		return nil, err
+	}
+
+	object, err := s.Client.GetObject(ctx, s.Bucket, objectKey(docID, name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	// GetObject is lazy, Stat makes the request and tells whether the object exists
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, s3Error(err)
+	}
+
+	return &Blob{
+		BlobInfo: BlobInfo{
+			Name:        name,
+			ContentType: stat.ContentType,
+			Size:        stat.Size,
+			Hash:        stat.ETag,
+		},
+		Data: object,
+	}, nil
+}
+
+func (s *S3BlobStore) List(ctx context.Context, docID string) ([]BlobInfo, error) {
+	prefix := docID + "/"
+
+	var infos []BlobInfo
+	for object := range s.Client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, s3Error(object.Err)
+		}
+		infos = append(infos, BlobInfo{
+			Name:        strings.TrimPrefix(object.Key, prefix),
+			ContentType: object.ContentType,
+			Size:        object.Size,
+			Hash:        strings.Trim(object.ETag, `"`),
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, docID string, name string) error {
+	if err := validateName(docID, name); err != nil {
+		return err
+	}
+	// deleting a missing object succeeds in S3
+	return s.Client.RemoveObject(ctx, s.Bucket, objectKey(docID, name), minio.RemoveObjectOptions{})
+}
+
+func objectKey(docID string, name string) string {
+	return docID + "/" + name
+}
+
+func s3Error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
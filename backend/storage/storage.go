@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ravendb/ravendb-go-client"
+)
+
+// backends a BlobStore can be created for
+const (
+	BackendRavenDB = "ravendb"
+	BackendLocal   = "local"
+	BackendS3      = "s3"
+)
+
+var (
+	ErrNotFound       = errors.New("blob not found")
+	ErrInvalidName    = errors.New("invalid blob name")
+	ErrUnknownBackend = errors.New("unknown storage backend")
+)
+
+// describes a stored blob, Hash changes whenever the contents do
+type BlobInfo struct {
+	Name        string
+	ContentType string
+	Size        int64
+	Hash        string
+}
+
+// an open blob, the caller closes Data
+type Blob struct {
+	BlobInfo
+	Data io.ReadCloser
+}
+
+/*
+BlobStore keeps the files (images) that belong to a document. Blobs are addressed by the id of
+the document they belong to ("items/1-A") and a name unique within that document, names may
+contain "/" (resized copies are stored as "thumbnail/photo.jpg").
+
+The document itself stays in RavenDB, a backend other than RavenDB doesn't know when one is
+deleted so whoever deletes a document deletes its blobs too.
+*/
+type BlobStore interface {
+	// stores a blob, replacing one with the same name. size is -1 when unknown
+	Put(ctx context.Context, docID string, name string, data io.Reader, size int64, contentType string) error
+	// opens a blob, ErrNotFound if there is none
+	Get(ctx context.Context, docID string, name string) (*Blob, error)
+	// lists the blobs of a document ordered by name
+	List(ctx context.Context, docID string) ([]BlobInfo, error)
+	// deletes a blob, deleting a missing blob is not an error
+	Delete(ctx context.Context, docID string, name string) error
+}
+
+// BatchLister is implemented by backends that can list the blobs of many documents at once
+type BatchLister interface {
+	// lists the blobs of every document by its id, documents without blobs may be left out
+	ListMany(ctx context.Context, docIDs []string) (map[string][]BlobInfo, error)
+}
+
+// ListMany lists the blobs of every document, in one go when the backend is a BatchLister
+func ListMany(ctx context.Context, blobs BlobStore, docIDs []string) (map[string][]BlobInfo, error) {
+	if lister, ok := blobs.(BatchLister); ok {
+		return lister.ListMany(ctx, docIDs)
+	}
+
+	lists := make(map[string][]BlobInfo, len(docIDs))
+	for _, docID := range docIDs {
+		infos, err := blobs.List(ctx, docID)
+		if err != nil {
+			return nil, err
+		}
+		lists[docID] = infos
+	}
+	return lists, nil
+}
+
+// DeleteAll deletes every blob of a document
+func DeleteAll(ctx context.Context, blobs BlobStore, docID string) error {
+	infos, err := blobs.List(ctx, docID)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := blobs.Delete(ctx, docID, info.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy copies a blob from one store to another
+func Copy(ctx context.Context, from BlobStore, to BlobStore, docID string, name string) error {
+	blob, err := from.Get(ctx, docID, name)
+	if err != nil {
+		return err
+	}
+	defer blob.Data.Close()
+
+	return to.Put(ctx, docID, name, blob.Data, blob.Size, blob.ContentType)
+}
+
+/*
+New creates the BlobStore for a backend from environment variables, prefixed with prefix so a
+second store can be configured next to the first one (the migration command reads the target
+from MIGRATE_TO_*):
+
+  - STORAGE_BACKEND: ravendb (default), local or s3
+  - STORAGE_LOCAL_DIR: directory of the local backend (default "data/blobs")
+  - STORAGE_S3_ENDPOINT, STORAGE_S3_BUCKET, STORAGE_S3_ACCESS_KEY, STORAGE_S3_SECRET_KEY,
+    STORAGE_S3_REGION, STORAGE_S3_USE_SSL: the s3 backend
+*/
+func New(store *ravendb.DocumentStore, prefix string) (BlobStore, error) {
+	env := func(name string) string {
+		return os.Getenv(prefix + name)
+	}
+
+	switch backend := strings.ToLower(env("STORAGE_BACKEND")); backend {
+	case "", BackendRavenDB:
+		return NewRavenBlobStore(store), nil
+	case BackendLocal:
+		dir := env("STORAGE_LOCAL_DIR")
+		if dir == "" {
+			dir = "data/blobs"
+		}
+		return NewLocalBlobStore(dir)
+	case BackendS3:
+		return NewS3BlobStore(S3Config{
+			Endpoint:  env("STORAGE_S3_ENDPOINT"),
+			Bucket:    env("STORAGE_S3_BUCKET"),
+			AccessKey: env("STORAGE_S3_ACCESS_KEY"),
+			SecretKey: env("STORAGE_S3_SECRET_KEY"),
+			Region:    env("STORAGE_S3_REGION"),
+			UseSSL:    env("STORAGE_S3_USE_SSL") == "true",
+		})
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
+	}
+}
+
+// names end up in file paths and object keys, so they can't walk out of their document
+func validateName(docID string, name string) error {
+	for _, value := range []string{docID, name} {
+		for _, part := range strings.Split(value, "/") {
+			if part == "" || part == "." || part == ".." {
+				return ErrInvalidName
+			}
+		}
+	}
+	return nil
+}
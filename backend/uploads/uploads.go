@@ -0,0 +1,186 @@
+package uploads
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime/multipart"
+
+	_ "golang.org/x/image/webp"
+)
+
+/*
+image formats detected from the file contents and never from the name. HEIC is only recognized to
+be refused with a clearer error, it can't be decoded here so its EXIF and GPS data couldn't be
+stripped
+*/
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+	FormatHEIC = "heic"
+)
+
+var contentTypes = map[string]string{
+	FormatJPEG: "image/jpeg",
+	FormatPNG:  "image/png",
+	FormatWebP: "image/webp",
+}
+
+type Limits struct {
+	MaxFileSize     int64 // bytes per file
+	MaxRequestSize  int64 // bytes per request, all files and fields together
+	MaxImagesPerDoc int   // images a single item may have
+	MaxPixels       int   // width * height, guards against decompression bombs
+}
+
+var DefaultLimits = Limits{
+	MaxFileSize:     10 << 20,
+	MaxRequestSize:  50 << 20,
+	MaxImagesPerDoc: 10,
+	MaxPixels:       40_000_000,
+}
+
+var (
+	ErrFileTooLarge    = errors.New("file is too large")
+	ErrUnsupportedType = errors.New("only jpg, png and webp images are allowed")
+	ErrHEICUnsupported = errors.New("heic images aren't supported yet, please upload a jpg, png or webp")
+	ErrTooManyPixels   = errors.New("image dimensions are too large")
+	ErrCorruptImage    = errors.New("image could not be read")
+)
+
+// an uploaded image that passed validation
+type File struct {
+	Name        string
+	Data        []byte
+	Format      string
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// wraps a validation error with the name of the file it is about
+type FileError struct {
+	Name string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Err.Error())
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// ReadImage reads an uploaded file and makes sure it is an image we accept within the limits
+func ReadImage(header *multipart.FileHeader, limits Limits) (*File, error) {
+	if header.Size > limits.MaxFileSize {
+		return nil, &FileError{Name: header.Filename, Err: ErrFileTooLarge}
+	}
+
+	stream, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	// read one byte past the limit so a lying Size header is still caught
+	data, err := io.ReadAll(io.LimitReader(stream, limits.MaxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limits.MaxFileSize {
+		return nil, &FileError{Name: header.Filename, Err: ErrFileTooLarge}
+	}
+
+	format := Sniff(data)
+	if format == "" {
+		return nil, &FileError{Name: header.Filename, Err: ErrUnsupportedType}
+	}
+	if format == FormatHEIC {
+		return nil, &FileError{Name: header.Filename, Err: ErrHEICUnsupported}
+	}
+
+	width, height, err := dimensions(data)
+	if err != nil {
+		return nil, &FileError{Name: header.Filename, Err: err}
+	}
+	if width*height > limits.MaxPixels {
+		return nil, &FileError{Name: header.Filename, Err: ErrTooManyPixels}
+	}
+
+	return &File{
+		Name:        header.Filename,
+		Data:        data,
+		Format:      format,
+		ContentType: contentTypes[format],
+		Width:       width,
+		Height:      height,
+	}, nil
+}
+
+// ReadImages validates every file, stopping at the first one that is rejected
+func ReadImages(headers []*multipart.FileHeader, limits Limits) ([]*File, error) {
+	files := make([]*File, 0, len(headers))
+	for _, header := range headers {
+		file, err := ReadImage(header, limits)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Sniff returns the image format of the data based on its magic bytes, or "" if it isn't one we accept
+func Sniff(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return FormatWebP
+	case isHEIC(data):
+		return FormatHEIC
+	}
+	return ""
+}
+
+// HEIC files start with an ISO media "ftyp" box naming a HEIF brand
+func isHEIC(data []byte) bool {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+
+	size := int(binary.BigEndian.Uint32(data[:4]))
+	if size < 16 || size > len(data) {
+		return false
+	}
+
+	// the major brand followed by the compatible brands, skipping the minor version
+	brands := append([]byte{}, data[8:12]...)
+	brands = append(brands, data[16:size]...)
+	for i := 0; i+4 <= len(brands); i += 4 {
+		switch string(brands[i : i+4]) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis":
+			return true
+		}
+	}
+	return false
+}
+
+// reads the pixel size from the image header without decoding the pixels
+func dimensions(data []byte) (int, int, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, ErrCorruptImage
+	}
+	return config.Width, config.Height, nil
+}
@@ -9,6 +9,10 @@ import ProfileSettings from "./pages/profile/ProfileSettings";
 import MessagePanel from "./components/MessagePanel";
 import ConversationsPage from "./pages/ConversationsPage";
 import LogoutPage from "./pages/LogoutPage";
+import LoginCallbackPage from "./pages/LoginCallbackPage";
+import TwoFactorPage from "./pages/TwoFactorPage";
+import VerifyEmailPage from "./pages/VerifyEmailPage";
+import ResetPasswordPage from "./pages/ResetPasswordPage";
 import { AuthProvider } from "./contexts/AuthContext";
 import { NewItemPage } from "./pages/Items/NewItemPage";
 import ProtectedRoute from "./components/ProtectedRoute";
@@ -55,8 +59,12 @@ function App() {
 
               {/* Authentication Routes */}
               <Route path="/login" element={<LoginPage />} />
+              <Route path="/login/callback" element={<LoginCallbackPage />} />
+              <Route path="/login/2fa" element={<TwoFactorPage />} />
               <Route path="/register" element={<RegisterPage />} />
               <Route path="/logout" element={<LogoutPage />} />
+              <Route path="/verify-email" element={<VerifyEmailPage />} />
+              <Route path="/reset-password" element={<ResetPasswordPage />} />
 
               {/* Profile Routes */}
               <Route
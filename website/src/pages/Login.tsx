@@ -1,6 +1,10 @@
-import { useContext, useState } from "react";
-import { login } from "../services/AuthService";
-import { useNavigate } from "react-router-dom";
+import { useContext, useEffect, useState } from "react";
+import {
+  getOIDCProviders,
+  login,
+  oidcLoginURL,
+} from "../services/AuthService";
+import { Link, useLocation, useNavigate } from "react-router-dom";
 import { useAuth } from "../contexts/AuthContext";
 import Header from "../components/Header";
 const LoginPage = () => {
@@ -8,13 +12,28 @@ const LoginPage = () => {
   const [password, setPassword] = useState("");
   const [error, setError] = useState("");
   const nav = useNavigate();
+  const location = useLocation();
+  const notice: string | undefined = location.state?.notice;
   const { loginUser } = useAuth();
+  const [providers, setProviders] = useState<string[]>([]);
+
+  useEffect(() => {
+    getOIDCProviders()
+      .then(setProviders)
+      .catch((e) => console.log(e));
+  }, []);
 
   const handleSubmit = async (e: React.FormEvent<HTMLFormElement>) => {
     e.preventDefault();
     login({ email, password })
-      .then((user) => {
-        loginUser(user);
+      .then((result) => {
+        if ("twoFactorToken" in result) {
+          nav("/login/2fa", {
+            state: { twoFactorToken: result.twoFactorToken },
+          });
+          return;
+        }
+        loginUser(result);
         nav("/"); // Redirect to home page on successful login
       })
       .catch((e) => {
@@ -35,6 +54,7 @@ const LoginPage = () => {
           <h3 className="text-2xl font-bold text-center">
             Login to your account
           </h3>
+          {notice && !error && <p className="text-green-600">{notice}</p>}
           {error && <p className="text-red-500">{error}</p>}
           <form onSubmit={handleSubmit}>
             <div className="mt-4">
@@ -70,9 +90,28 @@ const LoginPage = () => {
                 <button className="px-6 py-2 mt-4 text-white bg-blue-600 rounded-lg hover:bg-blue-900">
                   Login
                 </button>
+                <Link
+                  to="/reset-password"
+                  className="text-sm text-blue-600 hover:underline"
+                >
+                  Forgot password?
+                </Link>
               </div>
             </div>
           </form>
+          {providers.length > 0 && (
+            <div className="mt-6 border-t pt-4">
+              {providers.map((provider) => (
+                <a
+                  key={provider}
+                  href={oidcLoginURL(provider)}
+                  className="block w-full px-6 py-2 mt-2 text-center border rounded-lg hover:bg-gray-100"
+                >
+                  Continue with {provider}
+                </a>
+              ))}
+            </div>
+          )}
         </div>
       </div>
     </div>
@@ -0,0 +1,70 @@
+import { useEffect, useRef, useState } from "react";
+import { Link, useNavigate } from "react-router-dom";
+import Header from "../components/Header";
+import { useAuth } from "../contexts/AuthContext";
+import { safeReturnTo, startSession } from "../services/AuthService";
+
+// what the error codes of a failed single sign-on mean
+const oidcErrors: Record<string, string> = {
+  denied: "The login was cancelled at the provider.",
+  invalid_login: "The login expired or was already used, please try again.",
+  email_required: "The provider didn't share an email address for the account.",
+  account_exists:
+    "An account already has this email. Log in with its password to use it.",
+  suspended: "This account is suspended.",
+  server_error: "An error occurred. Please try again.",
+};
+
+// the page a single sign-on comes back to, with the tokens or an error in the url fragment
+const LoginCallbackPage = () => {
+  const [error, setError] = useState("");
+  const nav = useNavigate();
+  const { loginUser } = useAuth();
+  // the effect runs twice in strict mode
+  const handled = useRef(false);
+
+  useEffect(() => {
+    if (handled.current) {
+      return;
+    }
+    handled.current = true;
+
+    const fragment = new URLSearchParams(window.location.hash.slice(1));
+    const code = fragment.get("error");
+    const token = fragment.get("token");
+    const refreshToken = fragment.get("refreshToken");
+    const expiresAt = fragment.get("expiresAt");
+    if (code || !token || !refreshToken || !expiresAt) {
+      setError(oidcErrors[code ?? ""] ?? oidcErrors.server_error);
+      return;
+    }
+
+    const user = startSession({ token, refreshToken, expiresAt });
+    loginUser(user);
+    // replaced so the tokens don't stay in the history
+    nav(safeReturnTo(fragment.get("returnTo")), { replace: true });
+  }, []);
+
+  return (
+    <div>
+      <Header />
+      <div className="flex items-center justify-center min-h-screen bg-gray-100">
+        <div className="px-8 py-6 mt-4 text-left bg-white shadow-lg">
+          <h3 className="text-2xl font-bold text-center">Login</h3>
+          {error ? (
+            <div className="mt-4">
+              <p className="text-red-500">{error}</p>
+              <Link to="/login" className="text-blue-600 hover:underline">
+                Back to login
+              </Link>
+            </div>
+          ) : (
+            <p className="mt-4">Logging you in...</p>
+          )}
+        </div>
+      </div>
+    </div>
+  );
+};
+
+export default LoginCallbackPage;
@@ -1,5 +1,4 @@
 import { useEffect } from "react";
-import { logout } from "../services/AuthService";
 import { useNavigate } from "react-router-dom";
 import { useAuth } from "../contexts/AuthContext";
 
@@ -8,7 +7,6 @@ const LogoutPage = () => {
   const { logoutUser } = useAuth();
 
   useEffect(() => {
-    logout();
     logoutUser();
     nav("/");
   }, []);
@@ -0,0 +1,142 @@
+import { useState } from "react";
+import { Link, useNavigate, useSearchParams } from "react-router-dom";
+import Header from "../components/Header";
+import { useAuth } from "../contexts/AuthContext";
+import { forgotPassword, resetPassword } from "../services/AuthService";
+
+// asks for a reset link, or sets the new password when opened from one
+const ResetPasswordPage = () => {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get("token");
+  const [email, setEmail] = useState("");
+  const [password, setPassword] = useState("");
+  const [confirmPassword, setConfirmPassword] = useState("");
+  const [error, setError] = useState("");
+  const [sent, setSent] = useState(false);
+  const nav = useNavigate();
+  const { logoutUser } = useAuth();
+
+  const handleError = (e: any) => {
+    console.log(e);
+    setError(e.response?.data?.error ?? "An error occurred. Please try again.");
+  };
+
+  const handleForgot = async (e: React.FormEvent<HTMLFormElement>) => {
+    e.preventDefault();
+    setError("");
+    forgotPassword(email)
+      .then(() => setSent(true))
+      .catch(handleError);
+  };
+
+  const handleReset = async (e: React.FormEvent<HTMLFormElement>) => {
+    e.preventDefault();
+    if (!token) {
+      return;
+    }
+    if (password !== confirmPassword) {
+      setError("The passwords don't match.");
+      return;
+    }
+    setError("");
+    resetPassword(token, password)
+      .then(() => {
+        // every session was logged out, this one too
+        logoutUser();
+        nav("/login", {
+          state: { notice: "Your password was changed, log in with it." },
+        });
+      })
+      .catch(handleError);
+  };
+
+  return (
+    <div>
+      <Header />
+      <div className="flex items-center justify-center min-h-screen bg-gray-100">
+        <div className="px-8 py-6 mt-4 text-left bg-white shadow-lg">
+          <h3 className="text-2xl font-bold text-center">
+            Reset your password
+          </h3>
+          {error && <p className="text-red-500">{error}</p>}
+          {token ? (
+            <form onSubmit={handleReset}>
+              <div className="mt-4">
+                <div>
+                  <label className="block" htmlFor="password">
+                    New password
+                  </label>
+                  <input
+                    type="password"
+                    placeholder="New password"
+                    className="w-full px-4 py-2 mt-2 border rounded-md"
+                    id="password"
+                    value={password}
+                    onChange={(e) => setPassword(e.target.value)}
+                    required
+                  />
+                </div>
+                <div className="mt-4">
+                  <label className="block" htmlFor="confirmPassword">
+                    Confirm new password
+                  </label>
+                  <input
+                    type="password"
+                    placeholder="Confirm new password"
+                    className="w-full px-4 py-2 mt-2 border rounded-md"
+                    id="confirmPassword"
+                    value={confirmPassword}
+                    onChange={(e) => setConfirmPassword(e.target.value)}
+                    required
+                  />
+                </div>
+                <div className="flex items-baseline justify-between">
+                  <button className="px-6 py-2 mt-4 text-white bg-blue-600 rounded-lg hover:bg-blue-900">
+                    Change password
+                  </button>
+                </div>
+              </div>
+            </form>
+          ) : sent ? (
+            <p className="mt-4">
+              If an account has this email, a link to reset its password is on
+              its way. It works for an hour.
+            </p>
+          ) : (
+            <form onSubmit={handleForgot}>
+              <div className="mt-4">
+                <div>
+                  <label className="block" htmlFor="email">
+                    Email
+                  </label>
+                  <input
+                    type="email"
+                    placeholder="Email"
+                    className="w-full px-4 py-2 mt-2 border rounded-md"
+                    id="email"
+                    value={email}
+                    onChange={(e) => setEmail(e.target.value)}
+                    required
+                  />
+                </div>
+                <div className="flex items-baseline justify-between">
+                  <button className="px-6 py-2 mt-4 text-white bg-blue-600 rounded-lg hover:bg-blue-900">
+                    Send reset link
+                  </button>
+                  <Link
+                    to="/login"
+                    className="text-sm text-blue-600 hover:underline"
+                  >
+                    Back to login
+                  </Link>
+                </div>
+              </div>
+            </form>
+          )}
+        </div>
+      </div>
+    </div>
+  );
+};
+
+export default ResetPasswordPage;
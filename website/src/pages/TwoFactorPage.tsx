@@ -0,0 +1,94 @@
+import { useState } from "react";
+import { Link, useLocation, useNavigate } from "react-router-dom";
+import Header from "../components/Header";
+import { useAuth } from "../contexts/AuthContext";
+import { loginTwoFactor, safeReturnTo } from "../services/AuthService";
+
+/*
+asks users with two-factor authentication for a code to finish their login. The login page passes
+the twoFactorToken in the router state, a single sign-on in the url fragment
+*/
+const TwoFactorPage = () => {
+  const location = useLocation();
+  const fragment = new URLSearchParams(location.hash.slice(1));
+  const twoFactorToken: string | null =
+    location.state?.twoFactorToken ?? fragment.get("twoFactorToken");
+  const returnTo = fragment.get("returnTo");
+  const [code, setCode] = useState("");
+  const [error, setError] = useState("");
+  const nav = useNavigate();
+  const { loginUser } = useAuth();
+
+  const handleSubmit = async (e: React.FormEvent<HTMLFormElement>) => {
+    e.preventDefault();
+    if (!twoFactorToken) {
+      return;
+    }
+    loginTwoFactor(twoFactorToken, code.trim())
+      .then((user) => {
+        loginUser(user);
+        nav(safeReturnTo(returnTo), { replace: true });
+      })
+      .catch((e) => {
+        console.log(e);
+        setError(
+          e.response?.data?.error ?? "An error occurred. Please try again."
+        );
+      });
+  };
+
+  return (
+    <div>
+      <Header />
+      <div className="flex items-center justify-center min-h-screen bg-gray-100">
+        <div className="px-8 py-6 mt-4 text-left bg-white shadow-lg">
+          <h3 className="text-2xl font-bold text-center">
+            Two-factor authentication
+          </h3>
+          {!twoFactorToken ? (
+            <div className="mt-4">
+              <p className="text-red-500">This login expired or is already finished.</p>
+              <Link to="/login" className="text-blue-600 hover:underline">
+                Log in again
+              </Link>
+            </div>
+          ) : (
+            <>
+              {error && <p className="text-red-500">{error}</p>}
+              <form onSubmit={handleSubmit}>
+                <div className="mt-4">
+                  <label className="block" htmlFor="code">
+                    Code from your authenticator app, or a recovery code
+                  </label>
+                  <input
+                    type="text"
+                    placeholder="Code"
+                    className="w-full px-4 py-2 mt-2 border rounded-md"
+                    id="code"
+                    autoComplete="one-time-code"
+                    value={code}
+                    onChange={(e) => setCode(e.target.value)}
+                    required
+                  />
+                  <div className="flex items-baseline justify-between">
+                    <button className="px-6 py-2 mt-4 text-white bg-blue-600 rounded-lg hover:bg-blue-900">
+                      Verify
+                    </button>
+                    <Link
+                      to="/login"
+                      className="text-sm text-blue-600 hover:underline"
+                    >
+                      Back to login
+                    </Link>
+                  </div>
+                </div>
+              </form>
+            </>
+          )}
+        </div>
+      </div>
+    </div>
+  );
+};
+
+export default TwoFactorPage;
@@ -0,0 +1,99 @@
+import { useEffect, useRef, useState } from "react";
+import { Link, useSearchParams } from "react-router-dom";
+import Header from "../components/Header";
+import { useAuth } from "../contexts/AuthContext";
+import { resendVerification, verifyEmail } from "../services/AuthService";
+
+// the page the link in the verification email opens
+const VerifyEmailPage = () => {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get("token");
+  const [status, setStatus] = useState<"verifying" | "verified" | "failed">(
+    "verifying"
+  );
+  const [error, setError] = useState("");
+  const [resent, setResent] = useState(false);
+  const { isAuthenticated } = useAuth();
+  // tokens work once, the effect runs twice in strict mode
+  const sent = useRef(false);
+
+  useEffect(() => {
+    if (sent.current) {
+      return;
+    }
+    sent.current = true;
+
+    if (!token) {
+      setError("The link is missing its token.");
+      setStatus("failed");
+      return;
+    }
+    verifyEmail(token)
+      .then(() => setStatus("verified"))
+      .catch((e) => {
+        console.log(e);
+        setError(
+          e.response?.data?.error ?? "An error occurred. Please try again."
+        );
+        setStatus("failed");
+      });
+  }, [token]);
+
+  const handleResend = () => {
+    resendVerification()
+      .then(() => setResent(true))
+      .catch((e) => {
+        console.log(e);
+        setError(
+          e.response?.data?.error ?? "An error occurred. Please try again."
+        );
+      });
+  };
+
+  return (
+    <div>
+      <Header />
+      <div className="flex items-center justify-center min-h-screen bg-gray-100">
+        <div className="px-8 py-6 mt-4 text-left bg-white shadow-lg">
+          <h3 className="text-2xl font-bold text-center">Verify your email</h3>
+          {status === "verifying" && (
+            <p className="mt-4">Verifying your email address...</p>
+          )}
+          {status === "verified" && (
+            <p className="mt-4">
+              Your email address is verified.{" "}
+              <Link to="/" className="text-blue-600 hover:underline">
+                Continue to Swapper
+              </Link>
+            </p>
+          )}
+          {status === "failed" && (
+            <div className="mt-4">
+              <p className="text-red-500">{error}</p>
+              {resent ? (
+                <p className="mt-2">A new link is on its way to your inbox.</p>
+              ) : isAuthenticated ? (
+                <button
+                  className="px-6 py-2 mt-4 text-white bg-blue-600 rounded-lg hover:bg-blue-900"
+                  onClick={handleResend}
+                >
+                  Send a new link
+                </button>
+              ) : (
+                <p className="mt-2">
+                  Links work for two days.{" "}
+                  <Link to="/login" className="text-blue-600 hover:underline">
+                    Log in
+                  </Link>{" "}
+                  and open the link again to get a new one.
+                </p>
+              )}
+            </div>
+          )}
+        </div>
+      </div>
+    </div>
+  );
+};
+
+export default VerifyEmailPage;
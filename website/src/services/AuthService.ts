@@ -1,6 +1,24 @@
 import api from "./AxiosInterceptor";
 import { jwtDecode } from "jwt-decode";
 import { User } from "../models/User";
+import { TokenPair, clearTokens, storeTokens } from "./Tokens";
+import { API_URL } from "../config/constants";
+
+// what /login answers for users with two-factor authentication instead of the tokens
+export interface TwoFactorChallenge {
+  twoFactorRequired: true;
+  twoFactorToken: string;
+  expiresAt: string;
+}
+
+// keeps the tokens of a new login and returns the user they are for
+export const startSession = (pair: TokenPair): User => {
+  storeTokens(pair);
+
+  const decoded: User = jwtDecode<User>(pair.token);
+  localStorage.setItem("user", JSON.stringify(decoded));
+  return decoded;
+};
 
 export const register = async (
   username: string,
@@ -10,7 +28,7 @@ export const register = async (
 ): Promise<User> => {
   return new Promise(async (resolve, reject) => {
     try {
-      const response = await api.post<{ token: string }>(`/signup`, {
+      const response = await api.post<TokenPair>(`/signup`, {
         email,
         username,
         password,
@@ -20,12 +38,7 @@ export const register = async (
       if (response.status !== 200) {
         reject(response);
       } else {
-        const tok = response.data.token;
-        localStorage.setItem("token", tok);
-
-        const decoded: User = jwtDecode<User>(tok);
-        localStorage.setItem("user", JSON.stringify(decoded));
-        resolve(decoded);
+        resolve(startSession(response.data));
       }
     } catch (error) {
       reject(error);
@@ -36,25 +49,94 @@ export const register = async (
 export const login = (u: {
   email: string;
   password: string;
-}): Promise<User> => {
+}): Promise<User | TwoFactorChallenge> => {
   return new Promise(async (resolve, reject) => {
     try {
-      const response = await api.post<{ token: string }>(`/login`, u);
-      const tok = response.data.token;
-      localStorage.setItem("token", tok);
-
-      const decoded: User = jwtDecode<User>(tok);
-      localStorage.setItem("user", JSON.stringify(decoded));
-      resolve(decoded);
+      const response = await api.post<TokenPair | TwoFactorChallenge>(
+        `/login`,
+        u
+      );
+      if ("twoFactorRequired" in response.data) {
+        // the login finishes with a code on the /login/2fa page
+        resolve(response.data);
+        return;
+      }
+      resolve(startSession(response.data));
     } catch (error) {
       reject(error);
     }
   });
 };
 
-export const logout = () => {
+// finishes a login of a user with two-factor authentication
+export const loginTwoFactor = async (
+  twoFactorToken: string,
+  code: string
+): Promise<User> => {
+  const response = await api.post<TokenPair>("/login/2fa", {
+    twoFactorToken,
+    code,
+  });
+  return startSession(response.data);
+};
+
+// the OpenID Connect providers users can log in with
+export const getOIDCProviders = async (): Promise<string[]> => {
+  const response = await api.get<{ providers: string[] }>(
+    "/auth/oidc/providers"
+  );
+  return response.data.providers;
+};
+
+// the path to open after a login, only paths of the website like the backend allows
+export const safeReturnTo = (returnTo: string | null): string => {
+  if (!returnTo || !returnTo.startsWith("/") || returnTo.startsWith("//")) {
+    return "/";
+  }
+  return returnTo;
+};
+
+// the backend page that starts a login with the provider, it comes back to /login/callback
+export const oidcLoginURL = (provider: string, returnTo = "/"): string => {
+  return `${API_URL}/auth/oidc/${encodeURIComponent(
+    provider
+  )}/login?returnTo=${encodeURIComponent(returnTo)}`;
+};
+
+export const logout = async () => {
+  if (localStorage.getItem("token")) {
+    try {
+      // ends the session on the server too, its refresh token stops working
+      await api.post("/logout");
+    } catch {
+      // logged out on this device either way
+    }
+  }
+  localStorage.removeItem("user");
+  clearTokens();
+};
+
+// confirms the email address with the token from the link the backend emailed
+export const verifyEmail = async (token: string) => {
+  await api.post("/email/verify", { token });
+};
+
+// emails a new verification link to the logged in user
+export const resendVerification = async () => {
+  await api.post("/email/verify/resend");
+};
+
+// emails a password reset link if an account has the address, the answer is the same either way
+export const forgotPassword = async (email: string) => {
+  await api.post("/password/forgot", { email });
+};
+
+// sets a new password with the token from a reset link. Every session of the account is
+// logged out, this device's included
+export const resetPassword = async (token: string, password: string) => {
+  await api.post("/password/reset", { token, password });
   localStorage.removeItem("user");
-  localStorage.removeItem("token");
+  clearTokens();
 };
 
 export const isAuth = (): boolean => {
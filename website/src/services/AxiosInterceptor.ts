@@ -1,5 +1,6 @@
-import axios from "axios";
+import axios, { AxiosRequestConfig } from "axios";
 import { API_URL } from "../config/constants";
+import { clearTokens, refreshTokens } from "./Tokens";
 
 const api = axios.create({
   baseURL: API_URL,
@@ -8,16 +9,13 @@ const api = axios.create({
 // Request interceptor for API calls
 api.interceptors.request.use(
   (config) => {
-    const user = JSON.parse(localStorage.getItem("user") || "{}");
     const tok = localStorage.getItem("token");
 
     if (!config.headers) {
       config.headers = {};
     }
 
-    if (user && user.token) {
-      config.headers["Authorization"] = `Bearer ${user.token}`;
-    } else if (tok) {
+    if (tok) {
       config.headers["Authorization"] = `Bearer ${tok}`;
     }
     return config;
@@ -30,15 +28,36 @@ api.interceptors.request.use(
 // Response interceptor for API calls
 api.interceptors.response.use(
   (response) => response,
-  (error) => {
-    if (error.response && error.response.status == 401) {
-      if (
-        window.location.pathname !== "/login" &&
-        window.location.pathname !== "/signup"
-      ) {
-        // Redirect to logout if not already on login page
-        //window.location.href = '/logout';
+  async (error) => {
+    // access tokens expire after 15 minutes, the refresh token gets a new one and the request
+    // is sent again once
+    const config = error.config as
+      | (AxiosRequestConfig & { retried?: boolean })
+      | undefined;
+    if (
+      error.response &&
+      error.response.status == 401 &&
+      config &&
+      !config.retried &&
+      localStorage.getItem("refreshToken")
+    ) {
+      config.retried = true;
+      try {
+        await refreshTokens();
+      } catch {
+        // the session was logged out or expired, a new login is needed
+        clearTokens();
+        localStorage.removeItem("user");
+        if (
+          window.location.pathname !== "/login" &&
+          window.location.pathname !== "/signup"
+        ) {
+          window.location.href = "/login";
+        }
+        return Promise.reject(error);
       }
+      // the request interceptor sets the new token
+      return api(config);
     }
     return Promise.reject(error);
   }
@@ -0,0 +1,41 @@
+import axios from "axios";
+import { API_URL } from "../config/constants";
+
+// the tokens of a login, as /signup, /login, /login/2fa and /auth/refresh return them
+export interface TokenPair {
+  token: string;
+  refreshToken: string;
+  expiresAt: string;
+}
+
+export const storeTokens = (pair: TokenPair) => {
+  localStorage.setItem("token", pair.token);
+  localStorage.setItem("refreshToken", pair.refreshToken);
+};
+
+export const clearTokens = () => {
+  localStorage.removeItem("token");
+  localStorage.removeItem("refreshToken");
+};
+
+let refreshing: Promise<string> | null = null;
+
+// trades the refresh token for a new pair and returns the new access token. A refresh token
+// only works once, so requests failing at the same time share a single refresh
+export const refreshTokens = (): Promise<string> => {
+  if (!refreshing) {
+    const refreshToken = localStorage.getItem("refreshToken");
+    const request = refreshToken
+      ? axios
+          .post<TokenPair>(`${API_URL}/auth/refresh`, { refreshToken })
+          .then((response) => {
+            storeTokens(response.data);
+            return response.data.token;
+          })
+      : Promise.reject(new Error("No refresh token"));
+    refreshing = request.finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+};